@@ -0,0 +1,103 @@
+package urlenc
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"reflect"
+)
+
+// MarshalBatch marshals the struct v into multiple query strings, for
+// APIs that limit the number of values accepted per request. The slice
+// field tagged with the "batch" keyword (e.g. `urlenc:"ids,batch"`) is
+// split into chunks of at most perBatch elements, and each query string
+// carries one chunk along with all of the other fields.
+//
+// If the batched slice is empty, a single query string without any of
+// its elements is returned.
+func MarshalBatch(v interface{}, perBatch int, options ...Option) ([][]byte, error) {
+	if perBatch <= 0 {
+		return nil, errors.New("urlenc.MarshalBatch: perBatch must be positive")
+	}
+
+	rv := reflect.ValueOf(v)
+	if rv == zeroval {
+		return nil, fmt.Errorf("urlenc.MarshalBatch: can not marshal a %w", ErrNilValue)
+	}
+	rv = reflect.Indirect(rv)
+	if !rv.IsValid() {
+		return nil, fmt.Errorf("urlenc.MarshalBatch: can not marshal a %w (nil pointer)", ErrNilValue)
+	}
+	if rv.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("urlenc.MarshalBatch: %w (struct required)", ErrUnsupportedType)
+	}
+
+	opts := newOptions(options)
+	fields, err := t2f.getStructFields(rv.Type(), opts)
+	if err != nil {
+		return nil, fmt.Errorf("urlenc.MarshalBatch: %w", err)
+	}
+
+	var batchfield *structfield
+	for i := range fields {
+		if !fields[i].Batch {
+			continue
+		}
+		if batchfield != nil {
+			return nil, errors.New("urlenc.MarshalBatch: multiple fields tagged with batch")
+		}
+		batchfield = &fields[i]
+	}
+	if batchfield == nil {
+		return nil, errors.New("urlenc.MarshalBatch: no field tagged with batch")
+	}
+
+	fv := fieldByIndex(rv, batchfield.Index, false)
+	if !fv.IsValid() {
+		return nil, fmt.Errorf("urlenc.MarshalBatch: field %s tagged with batch is in a nil embedded struct", batchfield.FieldName)
+	}
+	if fv.Kind() != reflect.Slice {
+		return nil, fmt.Errorf("urlenc.MarshalBatch: field %s tagged with batch must be a slice", batchfield.FieldName)
+	}
+
+	// The other fields are the same for every chunk, so encode them once.
+	// The chunks are encoded on their own, without writing them into the
+	// struct, which may share embedded pointers with the caller's value
+	base := url.Values{}
+	for _, f := range fields {
+		if f.Batch {
+			continue
+		}
+		ffv := fieldByIndex(rv, f.Index, false)
+		if !ffv.IsValid() {
+			// The field is in a nil embedded struct
+			continue
+		}
+		if err := marshalField(&base, f, ffv, opts); err != nil {
+			return nil, err
+		}
+	}
+
+	n := fv.Len()
+	var list [][]byte
+	for i := 0; i == 0 || i < n; i += perBatch {
+		j := i + perBatch
+		if j > n {
+			j = n
+		}
+
+		uv := make(url.Values, len(base)+1)
+		for k, v := range base {
+			uv[k] = append([]string(nil), v...)
+		}
+		if err := marshalField(&uv, *batchfield, fv.Slice(i, j), opts); err != nil {
+			return nil, err
+		}
+		buf, err := encodeValues(uv, opts)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, buf)
+	}
+	return list, nil
+}
@@ -0,0 +1,112 @@
+package urlenc
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+var bytesType = reflect.TypeOf([]byte(nil))
+
+// isDefaultBase64 returns true if fields of type t are encoded as base64
+// when no encoding is specified. This is limited to []byte itself, unless
+// a converter has been registered for it
+func isDefaultBase64(t reflect.Type) bool {
+	if t != bytesType {
+		return false
+	}
+	_, ok := lookupConverter(t)
+	return !ok
+}
+
+// checkEncoding verifies that a field of type t can be represented
+// using the given encoding
+func checkEncoding(t reflect.Type, encoding string) error {
+	switch encoding {
+	case "base64", "hex", "csv":
+	default:
+		return fmt.Errorf("unknown encoding %q", encoding)
+	}
+
+	switch t.Kind() {
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return nil
+		}
+	}
+	return fmt.Errorf("encoding %q requires a byte slice or array (got %s)", encoding, t)
+}
+
+// encodeBytes encodes the contents of a byte slice or array into a
+// single string
+func encodeBytes(rv reflect.Value, encoding string) (string, error) {
+	buf := make([]byte, rv.Len())
+	reflect.Copy(reflect.ValueOf(buf), rv)
+
+	switch encoding {
+	case "base64":
+		return base64.URLEncoding.EncodeToString(buf), nil
+	case "hex":
+		return hex.EncodeToString(buf), nil
+	case "csv":
+		// Each byte as a decimal number, e.g. "1,2,255"
+		list := make([]string, len(buf))
+		for i, b := range buf {
+			list[i] = strconv.Itoa(int(b))
+		}
+		return strings.Join(list, ","), nil
+	default:
+		return "", fmt.Errorf("unknown encoding %q", encoding)
+	}
+}
+
+// decodeBytes decodes s into a new value of type t, which is either a
+// byte slice or a byte array. For arrays, the decoded length must match
+// the length of the array
+func decodeBytes(t reflect.Type, s string, encoding string) (reflect.Value, error) {
+	var buf []byte
+	switch encoding {
+	case "base64":
+		var err error
+		buf, err = base64.URLEncoding.DecodeString(s)
+		if err != nil {
+			return zeroval, err
+		}
+	case "hex":
+		var err error
+		buf, err = hex.DecodeString(s)
+		if err != nil {
+			return zeroval, err
+		}
+	case "csv":
+		if s == "" {
+			break
+		}
+		list := strings.Split(s, ",")
+		buf = make([]byte, len(list))
+		for i, elem := range list {
+			n, err := strconv.ParseUint(strings.TrimSpace(elem), 10, 8)
+			if err != nil {
+				return zeroval, fmt.Errorf("failed to decode element %d: %w", i, err)
+			}
+			buf[i] = byte(n)
+		}
+	default:
+		return zeroval, fmt.Errorf("unknown encoding %q", encoding)
+	}
+
+	var rv reflect.Value
+	if t.Kind() == reflect.Array {
+		if len(buf) != t.Len() {
+			return zeroval, fmt.Errorf("expected %d bytes for %s, got %d", t.Len(), t, len(buf))
+		}
+		rv = reflect.New(t).Elem()
+	} else {
+		rv = reflect.MakeSlice(t, len(buf), len(buf))
+	}
+	reflect.Copy(rv, reflect.ValueOf(buf))
+	return rv, nil
+}
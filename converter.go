@@ -0,0 +1,82 @@
+package urlenc
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+)
+
+var customConverters = converterRegistry{
+	types: make(map[reflect.Type]converter),
+}
+
+type converterRegistry struct {
+	lock  sync.RWMutex
+	types map[reflect.Type]converter
+}
+
+// RegisterConverter registers the functions used to convert values of the
+// type of sample to and from their string representation. This is useful
+// for types that can not be given methods, such as types from other
+// packages. encode is given a value of the type of sample, and decode must
+// return a value of that same type.
+//
+// Registered converters take precedence over everything else, including
+// the built-in conversions, TextMarshaler, and registered enums. Fields of
+// the type (and slices of it) are treated as single values.
+//
+// RegisterConverter is safe to call concurrently with Marshal/Unmarshal,
+// but it is usually called once during initialization. Registering the
+// same type again replaces the previous functions.
+func RegisterConverter(sample interface{}, encode func(interface{}) (string, error), decode func(string) (interface{}, error)) error {
+	if sample == nil {
+		return fmt.Errorf("urlenc.RegisterConverter: %w", ErrNilValue)
+	}
+	if encode == nil || decode == nil {
+		return fmt.Errorf("urlenc.RegisterConverter: both encode and decode functions are required")
+	}
+
+	t := reflect.TypeOf(sample)
+	c := converter{
+		encode: func(rv reflect.Value) (string, error) {
+			return encode(rv.Interface())
+		},
+		decode: func(s string) (reflect.Value, error) {
+			v, err := decode(s)
+			if err != nil {
+				return zeroval, err
+			}
+			rv := reflect.ValueOf(v)
+			if !rv.IsValid() || rv.Type() != t {
+				return zeroval, fmt.Errorf("urlenc: converter for %s returned a value of type %T", t, v)
+			}
+			return rv, nil
+		},
+	}
+
+	customConverters.lock.Lock()
+	customConverters.types[t] = c
+	customConverters.lock.Unlock()
+
+	// Struct fields are classified using the converters, so the cached
+	// fields may be out of date
+	t2f.lock.Lock()
+	t2f.types = make(map[fieldsKey][]structfield)
+	t2f.lock.Unlock()
+	return nil
+}
+
+func (r *converterRegistry) Lookup(t reflect.Type) (converter, bool) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	c, ok := r.types[t]
+	return c, ok
+}
+
+func lookupConverter(t reflect.Type) (converter, bool) {
+	if c, ok := customConverters.Lookup(t); ok {
+		return c, true
+	}
+	c, ok := converters[t]
+	return c, ok
+}
@@ -0,0 +1,48 @@
+package urlenc
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+)
+
+// Decoder reads a query string from an input stream, and decodes it.
+type Decoder struct {
+	r                     io.Reader
+	buf                   bytes.Buffer
+	disallowUnknownFields bool
+}
+
+// NewDecoder creates a new Decoder that reads from r.
+func NewDecoder(r io.Reader) *Decoder {
+	return &Decoder{r: r}
+}
+
+// Decode reads the entire contents of the underlying reader, and decodes
+// it into v. See Unmarshal for details on how v is populated.
+func (d *Decoder) Decode(v interface{}) error {
+	d.buf.Reset()
+	if _, err := d.buf.ReadFrom(d.r); err != nil {
+		return fmt.Errorf("urlenc.Decoder: failed to read input: %w", err)
+	}
+
+	var options []Option
+	if d.disallowUnknownFields {
+		options = append(options, WithDisallowUnknownKeys())
+	}
+	return UnmarshalWithOptions(d.buf.Bytes(), v, options...)
+}
+
+// DisallowUnknownFields causes the Decoder to return an error wrapping
+// ErrUnknownKeys when the input contains keys that do not map to any of
+// the fields of the destination struct. See WithDisallowUnknownKeys.
+func (d *Decoder) DisallowUnknownFields() {
+	d.disallowUnknownFields = true
+}
+
+// Reset makes the Decoder read from r. The internal buffer is kept, so a
+// Decoder can be pooled and reused across inputs without reallocating.
+func (d *Decoder) Reset(r io.Reader) {
+	d.r = r
+	d.buf.Reset()
+}
@@ -0,0 +1,61 @@
+package urlenc_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"github.com/lestrrat-go/urlenc"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDecoderReset(t *testing.T) {
+	dec := urlenc.NewDecoder(strings.NewReader(`bar=one&baz=2`))
+
+	var foo Foo
+	if !assert.NoError(t, dec.Decode(&foo), "Decode succeeds") {
+		return
+	}
+	if !assert.Equal(t, Foo{Bar: "one", Baz: 2}, foo, "Decode produces the expected result") {
+		return
+	}
+
+	dec.Reset(strings.NewReader(`bar=three&qux=four&qux=five`))
+	foo = Foo{}
+	if !assert.NoError(t, dec.Decode(&foo), "Decode after Reset succeeds") {
+		return
+	}
+	if !assert.Equal(t, Foo{Bar: "three", Qux: []string{"four", "five"}}, foo, "Decode after Reset reads the new input") {
+		return
+	}
+}
+
+var errReadFailed = errors.New("read failed")
+
+func TestDecoderReadError(t *testing.T) {
+	var foo Foo
+	err := urlenc.NewDecoder(iotest.ErrReader(errReadFailed)).Decode(&foo)
+	if !assert.True(t, errors.Is(err, errReadFailed), "read errors are reported") {
+		return
+	}
+}
+
+func TestDecoderDisallowUnknownFields(t *testing.T) {
+	dec := urlenc.NewDecoder(strings.NewReader(`bar=one&extra=1&other=2`))
+	dec.DisallowUnknownFields()
+
+	var foo Foo
+	err := dec.Decode(&foo)
+	if !assert.True(t, errors.Is(err, urlenc.ErrUnknownKeys), "unknown keys are reported") {
+		return
+	}
+	if !assert.Contains(t, err.Error(), "extra, other", "error names the keys") {
+		return
+	}
+
+	dec.Reset(strings.NewReader(`bar=one`))
+	if !assert.NoError(t, dec.Decode(&foo), "known keys are accepted") {
+		return
+	}
+}
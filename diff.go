@@ -0,0 +1,66 @@
+package urlenc
+
+import (
+	"fmt"
+	"net/url"
+	"reflect"
+)
+
+// MarshalDiff marshals only the fields of new whose values differ from
+// those in old, which is useful for building PATCH-style requests. old
+// and new must be structs (or pointers to structs) of the same type.
+// Values are compared using reflect.DeepEqual.
+//
+// Changed fields are encoded the same way Marshal would, so a field
+// tagged with omitempty that was changed to its zero value is left out.
+func MarshalDiff(old, new interface{}, options ...Option) ([]byte, error) {
+	orv, err := diffTarget(old)
+	if err != nil {
+		return nil, err
+	}
+	nrv, err := diffTarget(new)
+	if err != nil {
+		return nil, err
+	}
+	if orv.Type() != nrv.Type() {
+		return nil, fmt.Errorf("urlenc.MarshalDiff: can not compare values of different types (%s and %s)", orv.Type(), nrv.Type())
+	}
+
+	opts := newOptions(options)
+	fields, err := t2f.getStructFields(nrv.Type(), opts)
+	if err != nil {
+		return nil, fmt.Errorf("urlenc.MarshalDiff: %w", err)
+	}
+
+	uv := url.Values{}
+	for _, f := range fields {
+		nfv := fieldByIndex(nrv, f.Index, false)
+		if !nfv.IsValid() {
+			// The field is in a nil embedded struct
+			continue
+		}
+		ofv := fieldByIndex(orv, f.Index, false)
+		if ofv.IsValid() && reflect.DeepEqual(ofv.Interface(), nfv.Interface()) {
+			continue
+		}
+		if err := marshalField(&uv, f, nfv, opts); err != nil {
+			return nil, err
+		}
+	}
+	return encodeValues(uv, opts)
+}
+
+func diffTarget(v interface{}) (reflect.Value, error) {
+	rv := reflect.ValueOf(v)
+	if rv == zeroval {
+		return zeroval, fmt.Errorf("urlenc.MarshalDiff: can not marshal a %w", ErrNilValue)
+	}
+	rv = reflect.Indirect(rv)
+	if !rv.IsValid() {
+		return zeroval, fmt.Errorf("urlenc.MarshalDiff: can not marshal a %w (nil pointer)", ErrNilValue)
+	}
+	if rv.Kind() != reflect.Struct {
+		return zeroval, fmt.Errorf("urlenc.MarshalDiff: %w (struct required)", ErrUnsupportedType)
+	}
+	return rv, nil
+}
@@ -0,0 +1,195 @@
+package urlenc
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// encodeValues serializes uv, sorting the values for each key first if
+// WithSortValues is given, and checks the result against the output
+// length limit and WithErrorOnEmptyOutput, if any
+func encodeValues(uv url.Values, opts *options) ([]byte, error) {
+	return appendEncodedValues(nil, uv, opts)
+}
+
+// appendEncodedValues is the same as encodeValues, but appends the result
+// to dst. The output length limit applies to the appended part only. On
+// error, dst is returned with its original length
+func appendEncodedValues(dst []byte, uv url.Values, opts *options) ([]byte, error) {
+	if opts.sortValues {
+		sortValueLists(uv)
+	}
+
+	n := len(dst)
+	dst = appendValues(dst, uv, opts)
+	if opts.errorOnEmptyOutput && len(dst) == n {
+		return dst[:n], fmt.Errorf("urlenc.Marshal: %w", ErrEmptyOutput)
+	}
+	if opts.maxOutputBytes > 0 && len(dst)-n > opts.maxOutputBytes {
+		return dst[:n], fmt.Errorf("urlenc.Marshal: %w (%d bytes, limit is %d)", ErrOutputTooLarge, len(dst)-n, opts.maxOutputBytes)
+	}
+	return dst, nil
+}
+
+// appendValues appends the serialized form of uv to dst. Unless an option
+// requires otherwise, this is the same as uv.Encode()
+func appendValues(dst []byte, uv url.Values, opts *options) []byte {
+	if opts.canonical {
+		return appendCanonicalValues(dst, uv)
+	}
+
+	if len(opts.keyOrder) == 0 && !opts.spaceAsPercent20 && !opts.rfc3986Escaping {
+		return append(dst, uv.Encode()...)
+	}
+
+	escape := queryEscaper(opts)
+	n := len(dst)
+	for _, k := range orderedKeys(uv, opts.keyOrder) {
+		ek := escape(k)
+		for _, v := range uv[k] {
+			if len(dst) > n {
+				dst = append(dst, '&')
+			}
+			dst = append(dst, ek...)
+			dst = append(dst, '=')
+			dst = append(dst, escape(v)...)
+		}
+	}
+	return dst
+}
+
+// queryEscaper returns the function used to escape keys and values,
+// according to the escaping options
+func queryEscaper(opts *options) func(string) string {
+	switch {
+	case opts.rfc3986Escaping:
+		return rfc3986Escape
+	case opts.spaceAsPercent20:
+		// url.QueryEscape encodes a literal '+' as "%2B", so any '+' left
+		// in its output is guaranteed to be an encoded space
+		return func(s string) string {
+			return strings.ReplaceAll(url.QueryEscape(s), "+", "%20")
+		}
+	}
+	return url.QueryEscape
+}
+
+// orderedKeys returns the keys in uv. Keys in order go first, in the
+// order given. Everything else follows in sorted order, just like
+// url.Values.Encode()
+func orderedKeys(uv url.Values, order []string) []string {
+	keys := make([]string, 0, len(uv))
+	for k := range uv {
+		keys = append(keys, k)
+	}
+	return orderKeys(keys, order)
+}
+
+// orderKeys is the same as orderedKeys, but sorts the distinct keys in
+// keys in place
+func orderKeys(keys []string, order []string) []string {
+	if len(order) == 0 {
+		sort.Strings(keys)
+		return keys
+	}
+
+	rank := make(map[string]int, len(order))
+	for i, k := range order {
+		if _, ok := rank[k]; !ok {
+			rank[k] = i
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		ri, iok := rank[keys[i]]
+		rj, jok := rank[keys[j]]
+		switch {
+		case iok && jok:
+			return ri < rj
+		case iok != jok:
+			return iok
+		}
+		return keys[i] < keys[j]
+	})
+	return keys
+}
+
+// rfc3986Escape percent-encodes every byte in s, except for the
+// unreserved characters in RFC 3986 (A-Z, a-z, 0-9, '-', '.', '_', '~')
+func rfc3986Escape(s string) string {
+	const hex = "0123456789ABCDEF"
+
+	var buf strings.Builder
+	buf.Grow(len(s))
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if isUnreserved(c) {
+			buf.WriteByte(c)
+			continue
+		}
+		buf.WriteByte('%')
+		buf.WriteByte(hex[c>>4])
+		buf.WriteByte(hex[c&0xF])
+	}
+	return buf.String()
+}
+
+func isUnreserved(c byte) bool {
+	switch {
+	case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9':
+		return true
+	case c == '-', c == '.', c == '_', c == '~':
+		return true
+	}
+	return false
+}
+
+// MarshalCanonical is the same as MarshalWithOptions, but produces the
+// canonical form of the query, which is suitable for computing request
+// signatures such as HMACs:
+//
+//   - keys and values are escaped as in WithRFC3986Escaping, so spaces
+//     are always encoded as "%20"
+//   - pairs are sorted by their escaped keys, and pairs with the same key
+//     are sorted by their escaped values
+//
+// The output only depends on the value being marshaled and the options,
+// and is byte-for-byte stable across Go versions. WithKeyOrder,
+// WithSpaceAsPercent20, and WithRFC3986Escaping have no effect.
+func MarshalCanonical(v interface{}, options ...Option) ([]byte, error) {
+	// options may have spare capacity that belongs to the caller
+	options = append(options[:len(options):len(options)], withCanonical())
+	return MarshalWithOptions(v, options...)
+}
+
+func appendCanonicalValues(dst []byte, uv url.Values) []byte {
+	type pair struct {
+		key   string
+		value string
+	}
+
+	pairs := make([]pair, 0, len(uv))
+	for k, list := range uv {
+		ek := rfc3986Escape(k)
+		for _, v := range list {
+			pairs = append(pairs, pair{key: ek, value: rfc3986Escape(v)})
+		}
+	}
+	sort.Slice(pairs, func(i, j int) bool {
+		if pairs[i].key != pairs[j].key {
+			return pairs[i].key < pairs[j].key
+		}
+		return pairs[i].value < pairs[j].value
+	})
+
+	for i, p := range pairs {
+		if i > 0 {
+			dst = append(dst, '&')
+		}
+		dst = append(dst, p.key...)
+		dst = append(dst, '=')
+		dst = append(dst, p.value...)
+	}
+	return dst
+}
@@ -0,0 +1,194 @@
+package urlenc
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/url"
+	"reflect"
+	"strconv"
+)
+
+// Encoder encodes values as query strings, and writes them to an output
+// stream.
+type Encoder struct {
+	w io.Writer
+}
+
+// NewEncoder creates a new Encoder that writes to w.
+func NewEncoder(w io.Writer) *Encoder {
+	return &Encoder{w: w}
+}
+
+// Encode writes the query string for v to the underlying writer. See
+// Marshal for details on how v is encoded.
+//
+// For structs, slice fields of strings, integers, and booleans are written
+// one element at a time instead of being collected first, so the memory
+// used does not grow with the number of elements. This does not apply
+// when the default options include WithSortValues or WithMaxOutputBytes,
+// as these need the complete output before anything can be written.
+func (e *Encoder) Encode(v interface{}) error {
+	opts := newOptions(nil)
+	if _, ok := v.(Marshaler); !ok && canStream(opts) {
+		if rv := reflect.Indirect(reflect.ValueOf(v)); rv.Kind() == reflect.Struct {
+			return e.encodeStruct(rv, opts)
+		}
+	}
+
+	buf, err := Marshal(v)
+	if err != nil {
+		return err
+	}
+	if _, err := e.w.Write(buf); err != nil {
+		return fmt.Errorf("urlenc.Encoder: failed to write output: %w", err)
+	}
+	return nil
+}
+
+// Reset makes the Encoder write to w.
+func (e *Encoder) Reset(w io.Writer) {
+	e.w = w
+}
+
+// canStream returns true if the output for opts can be written before
+// all of it is known
+func canStream(opts *options) bool {
+	return !opts.sortValues && opts.maxOutputBytes <= 0
+}
+
+// streamSource holds the values for a key: either values that have
+// already been encoded, or a slice whose elements are encoded as they
+// are written
+type streamSource struct {
+	values []string
+	slice  reflect.Value
+}
+
+func (s streamSource) Len() int {
+	if s.slice.IsValid() {
+		return s.slice.Len()
+	}
+	return len(s.values)
+}
+
+// encodeStruct writes the same output as Marshal would for the struct rv.
+// All fields other than the streamed slices are encoded before anything
+// is written, so errors do not leave partial output behind
+func (e *Encoder) encodeStruct(rv reflect.Value, opts *options) error {
+	fields, err := t2f.getStructFields(rv.Type(), opts)
+	if err != nil {
+		return fmt.Errorf("urlenc.Marshal: %w", err)
+	}
+
+	sources := make(map[string][]streamSource)
+	for _, f := range fields {
+		fv := fieldByIndex(rv, f.Index, false)
+		if !fv.IsValid() {
+			// The field is in a nil embedded struct
+			continue
+		}
+		if isStreamField(f, fv, opts) {
+			if fv.Len() > 0 {
+				sources[f.OutKeyName] = append(sources[f.OutKeyName], streamSource{slice: fv})
+			}
+			continue
+		}
+
+		uv := url.Values{}
+		if err := marshalField(&uv, f, fv, opts); err != nil {
+			return err
+		}
+		for k, v := range uv {
+			sources[k] = append(sources[k], streamSource{values: v})
+		}
+	}
+
+	// Keys are ordered the same way as in Marshal
+	keys := make([]string, 0, len(sources))
+	for k := range sources {
+		keys = append(keys, k)
+	}
+	keys = orderKeys(keys, opts.keyOrder)
+
+	escape := queryEscaper(opts)
+	w := bufio.NewWriter(e.w)
+	var buf []byte
+	var written bool
+	for _, k := range keys {
+		ek := escape(k)
+		for _, src := range sources[k] {
+			for i := 0; i < src.Len(); i++ {
+				buf = buf[:0]
+				if written {
+					buf = append(buf, '&')
+				}
+				written = true
+				buf = append(buf, ek...)
+				buf = append(buf, '=')
+				if src.slice.IsValid() {
+					buf = appendElement(buf, src.slice.Index(i), escape)
+				} else {
+					buf = append(buf, escape(src.values[i])...)
+				}
+				if _, err := w.Write(buf); err != nil {
+					return fmt.Errorf("urlenc.Encoder: failed to write output: %w", err)
+				}
+			}
+		}
+	}
+	if !written && opts.errorOnEmptyOutput {
+		// Nothing has been written, so there is nothing to flush
+		return fmt.Errorf("urlenc.Marshal: %w", ErrEmptyOutput)
+	}
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("urlenc.Encoder: failed to write output: %w", err)
+	}
+	return nil
+}
+
+// isStreamField returns true if the elements of the slice field f, whose
+// value is fv, can be written one by one. This is limited to the types
+// and options for which appendElement produces the same result as addValue
+func isStreamField(f structfield, fv reflect.Value, opts *options) bool {
+	if fv.Kind() != reflect.Slice || fv.Type() != f.Type || !isArrayField(f) {
+		return false
+	}
+	if f.Split != "" || f.CSV || f.Encoding != "" || len(f.Layouts) > 0 || f.ValuesSetter || f.QueryType || f.CatchAll {
+		return false
+	}
+	if opts.arrayFormat != ArrayFormatRepeat || opts.valueCaseMode != ValueCaseNone || opts.numericBooleans || opts.numberFormatter != nil {
+		return false
+	}
+	if !opts.withoutValuerSetter && getValuerMethod(fv) != zeroval {
+		return false
+	}
+
+	et := f.Type.Elem()
+	if isCustomScalar(et) {
+		return false
+	}
+	switch et.Kind() {
+	case reflect.Bool, reflect.String,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return true
+	}
+	return false
+}
+
+// appendElement appends the encoded form of the slice element ev to buf,
+// without allocating for anything but strings that need escaping. Strings
+// are escaped using escape
+func appendElement(buf []byte, ev reflect.Value, escape func(string) string) []byte {
+	switch ev.Kind() {
+	case reflect.Bool:
+		return strconv.AppendBool(buf, ev.Bool())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.AppendInt(buf, ev.Int(), 10)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return strconv.AppendUint(buf, ev.Uint(), 10)
+	default:
+		return append(buf, escape(ev.String())...)
+	}
+}
@@ -0,0 +1,177 @@
+package urlenc_test
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strconv"
+	"testing"
+
+	"github.com/lestrrat-go/urlenc"
+	"github.com/stretchr/testify/assert"
+)
+
+type failingWriter struct{}
+
+var errWriteFailed = errors.New("write failed")
+
+func (failingWriter) Write([]byte) (int, error) {
+	return 0, errWriteFailed
+}
+
+func TestEncoder(t *testing.T) {
+	var buf bytes.Buffer
+	enc := urlenc.NewEncoder(&buf)
+	if !assert.NoError(t, enc.Encode(Foo{Bar: "one", Baz: 2}), "Encode succeeds") {
+		return
+	}
+	if !assert.Equal(t, `bar=one&baz=2&grault=false`, buf.String(), "Encode writes the expected result") {
+		return
+	}
+
+	var other bytes.Buffer
+	enc.Reset(&other)
+	if !assert.NoError(t, enc.Encode(map[string]string{"a": "b"}), "Encode after Reset succeeds") {
+		return
+	}
+	if !assert.Equal(t, `a=b`, other.String(), "Encode after Reset writes to the new output") {
+		return
+	}
+
+	if !assert.True(t, errors.Is(urlenc.NewEncoder(failingWriter{}).Encode(Foo{}), errWriteFailed), "write errors are reported") {
+		return
+	}
+	if !assert.True(t, errors.Is(enc.Encode(nil), urlenc.ErrNilValue), "Marshal errors are reported") {
+		return
+	}
+}
+
+type BulkPayload struct {
+	IDs   []int    `urlenc:"ids"`
+	Names []string `urlenc:"names"`
+	Label string   `urlenc:"label"`
+}
+
+func newBulkPayload(n int) BulkPayload {
+	p := BulkPayload{Label: "bulk", IDs: make([]int, n), Names: []string{"a b", "c&d"}}
+	for i := range p.IDs {
+		p.IDs[i] = i * 1000
+	}
+	return p
+}
+
+func TestEncoderSameAsMarshal(t *testing.T) {
+	values := []interface{}{
+		Foo{Bar: "one", Baz: 2, Qux: []string{"three", "4"}, Corge: []float64{1.5}},
+		&Foo{},
+		newBulkPayload(10),
+		ListPayload{PageToken: PageToken{Token: "abc"}, SortOrder: SortOrder{Sort: "name"}, Limit: 10},
+		CSVPayload{IDs: []int{1, 2}},
+	}
+	for i, v := range values {
+		expected, err := urlenc.Marshal(v)
+		if !assert.NoError(t, err, "Marshal succeeds") {
+			return
+		}
+
+		var buf bytes.Buffer
+		if !assert.NoError(t, urlenc.NewEncoder(&buf).Encode(v), "Encode succeeds") {
+			return
+		}
+		if !assert.Equal(t, string(expected), buf.String(), "Encode produces the same result as Marshal ("+strconv.Itoa(i)+")") {
+			return
+		}
+	}
+}
+
+func TestEncoderWithDefaultOptions(t *testing.T) {
+	defer urlenc.SetDefaultOptions()
+
+	testcases := []struct {
+		Name    string
+		Options []urlenc.Option
+	}{
+		{Name: "space as %20", Options: []urlenc.Option{urlenc.WithSpaceAsPercent20()}},
+		{Name: "RFC 3986 escaping", Options: []urlenc.Option{urlenc.WithRFC3986Escaping()}},
+		{Name: "key order", Options: []urlenc.Option{urlenc.WithKeyOrder([]string{"names", "label"})}},
+		{Name: "float precision", Options: []urlenc.Option{urlenc.WithFloatPrecision(2)}},
+		{Name: "value case", Options: []urlenc.Option{urlenc.WithValueCaseMode(urlenc.ValueCaseUpper)}},
+		{Name: "tag name", Options: []urlenc.Option{urlenc.WithTagName("query")}},
+		{Name: "brackets array format", Options: []urlenc.Option{urlenc.WithArrayFormat(urlenc.ArrayFormatBrackets)}},
+		{Name: "indices array format", Options: []urlenc.Option{urlenc.WithArrayFormat(urlenc.ArrayFormatIndices)}},
+		{Name: "comma array format", Options: []urlenc.Option{urlenc.WithArrayFormat(urlenc.ArrayFormatComma)}},
+		{Name: "number formatter", Options: []urlenc.Option{urlenc.WithNumberFormatter(func(rv reflect.Value) (string, error) {
+			return fmt.Sprintf("n%v", rv.Interface()), nil
+		})}},
+		{Name: "numeric booleans", Options: []urlenc.Option{urlenc.WithNumericBooleans()}},
+		{Name: "without valuer setter", Options: []urlenc.Option{urlenc.WithoutValuerSetter()}},
+		{Name: "valuer omitempty", Options: []urlenc.Option{urlenc.WithValuerOmitEmpty()}},
+		{Name: "sorted values", Options: []urlenc.Option{urlenc.WithSortValues()}},
+		{Name: "output limit", Options: []urlenc.Option{urlenc.WithMaxOutputBytes(10)}},
+		{Name: "error on empty output", Options: []urlenc.Option{urlenc.WithErrorOnEmptyOutput()}},
+	}
+	values := []interface{}{
+		newBulkPayload(3),
+		BulkPayload{Names: []string{"z~y", "a b"}},
+		Foo{Bar: "one two", Baz: 2, Qux: []string{"three", "4"}, Corge: []float64{1.555}, Garply: []bool{true, false}},
+		struct{}{},
+	}
+	for _, tc := range testcases {
+		tc := tc
+		t.Run(tc.Name, func(t *testing.T) {
+			urlenc.SetDefaultOptions(tc.Options...)
+			for i, v := range values {
+				expected, merr := urlenc.Marshal(v)
+
+				var buf bytes.Buffer
+				err := urlenc.NewEncoder(&buf).Encode(v)
+				if merr != nil {
+					if !assert.Error(t, err, "Encode fails like Marshal ("+strconv.Itoa(i)+")") {
+						return
+					}
+					if !assert.Equal(t, merr.Error(), err.Error(), "Encode returns the same error as Marshal ("+strconv.Itoa(i)+")") {
+						return
+					}
+					continue
+				}
+				if !assert.NoError(t, err, "Encode succeeds ("+strconv.Itoa(i)+")") {
+					return
+				}
+				if !assert.Equal(t, string(expected), buf.String(), "Encode produces the same result as Marshal ("+strconv.Itoa(i)+")") {
+					return
+				}
+			}
+		})
+	}
+}
+
+func TestEncoderLargeSlice(t *testing.T) {
+	enc := urlenc.NewEncoder(io.Discard)
+	allocs := func(n int) float64 {
+		p := newBulkPayload(n)
+		return testing.AllocsPerRun(5, func() {
+			if err := enc.Encode(p); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+
+	small, large := allocs(1000), allocs(100000)
+	if !assert.Equal(t, small, large, "allocations do not grow with the number of elements") {
+		return
+	}
+}
+
+func BenchmarkEncoderLargeSlice(b *testing.B) {
+	p := newBulkPayload(100000)
+	enc := urlenc.NewEncoder(io.Discard)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := enc.Encode(p); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package urlenc
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+)
+
+var enums = enumRegistry{
+	types: make(map[reflect.Type]*enum),
+}
+
+type enumRegistry struct {
+	lock  sync.RWMutex
+	types map[reflect.Type]*enum
+}
+
+type enum struct {
+	typ    reflect.Type
+	values map[string]reflect.Value
+	names  map[interface{}]string
+}
+
+// RegisterEnum registers the names for the values of an enum type, such
+// as a set of constants declared using iota. sample is any value of the
+// enum type, and names maps each name to its value.
+//
+// Once registered, fields of the enum type (and slices of it) are
+// marshaled as their names, and names are mapped back to values when
+// unmarshaling. Values or names that are not registered result in an
+// error.
+//
+// RegisterEnum is safe to call concurrently with Marshal/Unmarshal, but
+// it is usually called once during initialization. Registering the same
+// type again replaces the previous names.
+func RegisterEnum(sample interface{}, names map[string]interface{}) error {
+	if sample == nil {
+		return fmt.Errorf("urlenc.RegisterEnum: %w", ErrNilValue)
+	}
+
+	t := reflect.TypeOf(sample)
+	if !isStringOrNumeric(t.Kind()) {
+		return fmt.Errorf("urlenc.RegisterEnum: %w (%s)", ErrUnsupportedType, t)
+	}
+
+	e := &enum{
+		typ:    t,
+		values: make(map[string]reflect.Value, len(names)),
+		names:  make(map[interface{}]string, len(names)),
+	}
+	for name, v := range names {
+		rv := reflect.ValueOf(v)
+		if !rv.IsValid() || rv.Type() != t {
+			return fmt.Errorf("urlenc.RegisterEnum: value for %q is not of type %s", name, t)
+		}
+		if prev, ok := e.names[v]; ok {
+			return fmt.Errorf("urlenc.RegisterEnum: value for %q is already registered as %q", name, prev)
+		}
+		e.values[name] = rv
+		e.names[v] = name
+	}
+
+	enums.lock.Lock()
+	defer enums.lock.Unlock()
+	enums.types[t] = e
+	return nil
+}
+
+func (r *enumRegistry) Lookup(t reflect.Type) (*enum, bool) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	e, ok := r.types[t]
+	return e, ok
+}
+
+func (e *enum) ToName(rv reflect.Value) (string, error) {
+	if !rv.CanInterface() {
+		return "", errors.New("urlenc: can not access value of enum " + e.typ.String())
+	}
+	name, ok := e.names[rv.Interface()]
+	if !ok {
+		return "", fmt.Errorf("urlenc: %v is not a registered value of enum %s", rv.Interface(), e.typ)
+	}
+	return name, nil
+}
+
+func (e *enum) FromName(name string) (reflect.Value, error) {
+	v, ok := e.values[name]
+	if !ok {
+		return zeroval, fmt.Errorf("urlenc: %q is not a registered name of enum %s", name, e.typ)
+	}
+	return v, nil
+}
@@ -0,0 +1,90 @@
+package urlenc
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Sentinel errors returned (wrapped) by Marshal and Unmarshal. Use
+// errors.Is to check for them.
+var (
+	// ErrNilValue is returned when a nil value is given as the source or
+	// the target.
+	ErrNilValue = errors.New("nil value")
+	// ErrNotPointer is returned when Unmarshal is given a non-pointer target.
+	ErrNotPointer = errors.New("pointer value required")
+	// ErrUnsupportedType is returned when a value, field, or map element is
+	// of a type that this package can not handle.
+	ErrUnsupportedType = errors.New("unsupported type")
+	// ErrNonStringMapKey is returned when a map whose key is not a string
+	// type is given. Marshal also accepts keys that implement fmt.Stringer.
+	ErrNonStringMapKey = errors.New("map key must be string type")
+	// ErrMissingFields is returned when keys for required fields are not
+	// present in the query.
+	ErrMissingFields = errors.New("missing keys for required fields")
+	// ErrOutputTooLarge is returned when the marshaled query exceeds the
+	// limit given by WithMaxOutputBytes.
+	ErrOutputTooLarge = errors.New("output too large")
+	// ErrEmptyOutput is returned when there are no values to encode, and
+	// WithErrorOnEmptyOutput is given.
+	ErrEmptyOutput = errors.New("no values to encode")
+	// ErrUnknownKeys is returned when the query contains keys that do not
+	// map to any of the fields, and WithDisallowUnknownKeys is given.
+	ErrUnknownKeys = errors.New("unknown keys")
+	// ErrStrictType is returned when a value is not in the exact form that
+	// Marshal would produce, and WithStrictTypes is given.
+	ErrStrictType = errors.New("value is not in strict form")
+	// ErrArrayLength is returned when the number of values for an array
+	// field does not match the length of the array, as allowed by the
+	// policy given by WithArrayMismatchPolicy.
+	ErrArrayLength = errors.New("number of values does not match array length")
+	// ErrIndexGap is returned when the indices given for a slice or array
+	// field have gaps, and WithIndexGapPolicy(IndexGapError) is given.
+	ErrIndexGap = errors.New("missing index")
+	// ErrUnsettableField is returned when the value for a struct field is
+	// present in the query, but the field can not be set (e.g. the struct
+	// is not addressable), and WithSkipUnsettableFields is not given.
+	ErrUnsettableField = errors.New("field can not be set")
+)
+
+// FieldError is returned by Unmarshal when the value for a struct field
+// can not be decoded. Use errors.As to find out which field failed.
+type FieldError struct {
+	// Field is the name of the struct field
+	Field string
+	// Key is the query key that the value was taken from
+	Key string
+	// Err is the underlying error
+	Err error
+}
+
+func (e *FieldError) Error() string {
+	return fmt.Sprintf("urlenc.Unmarshal: failed to decode field %s (key %s): %s", e.Field, e.Key, e.Err)
+}
+
+func (e *FieldError) Unwrap() error {
+	return e.Err
+}
+
+// MultiError is returned when there are multiple errors to report, or
+// when WithCollectErrors is given. With Go 1.20 or later, errors.Is and
+// errors.As look into each of the errors
+type MultiError []error
+
+func (l MultiError) Error() string {
+	list := make([]string, len(l))
+	for i, err := range l {
+		list[i] = err.Error()
+	}
+	return strings.Join(list, "; ")
+}
+
+// Errors returns each of the errors
+func (l MultiError) Errors() []error {
+	return l
+}
+
+func (l MultiError) Unwrap() []error {
+	return l
+}
@@ -0,0 +1,13 @@
+package urlenc
+
+import (
+	"net/url"
+	"reflect"
+)
+
+// UnmarshalStructValue decodes q into the struct value rv. It allows tests
+// to pass values that Unmarshal never produces, such as ones that are not
+// addressable
+func UnmarshalStructValue(q url.Values, rv reflect.Value, options ...Option) error {
+	return unmarshalStruct(q, rv, newOptions(options))
+}
@@ -0,0 +1,89 @@
+package urlenc
+
+import (
+	"net/url"
+	"reflect"
+)
+
+var (
+	plainStringType  = reflect.TypeOf("")
+	plainStringsType = reflect.TypeOf([]string(nil))
+)
+
+// isPlainString returns true if the struct field sf, described by f, is a
+// string or a []string that is encoded as-is. For these fields, none of
+// the conversions, Valuers, or Setters apply, so their values can be
+// copied directly
+func isPlainString(sf reflect.StructField, f structfield) bool {
+	if sf.Type != f.Type || (f.Type != plainStringType && f.Type != plainStringsType) {
+		return false
+	}
+	return f.Split == "" && !f.CSV && f.Encoding == "" && len(f.Layouts) == 0 && !f.Batch
+}
+
+// plainStringsEnabled returns true if PlainString fields can take the
+// fast path for the given options. This is checked once per struct, as
+// converters and enums may be registered for string types at any time
+func plainStringsEnabled(opts *options, marshal bool) bool {
+	if marshal {
+		if opts.valueCaseMode != ValueCaseNone || opts.arrayFormat != ArrayFormatRepeat {
+			return false
+		}
+	} else if opts.arrayFormat == ArrayFormatComma {
+		return false
+	}
+
+	for _, t := range []reflect.Type{plainStringType, plainStringsType} {
+		if _, ok := lookupConverter(t); ok {
+			return false
+		}
+		if _, ok := enums.Lookup(t); ok {
+			return false
+		}
+	}
+	return true
+}
+
+// marshalPlainString is the same as marshalField for PlainString fields
+func marshalPlainString(uv url.Values, f structfield, fv reflect.Value) {
+	if fv.Kind() == reflect.String {
+		if f.OmitEmpty && fv.Len() == 0 {
+			return
+		}
+		uv[f.OutKeyName] = append(uv[f.OutKeyName], fv.String())
+		return
+	}
+
+	if fv.Len() == 0 {
+		return
+	}
+	uv[f.OutKeyName] = append(uv[f.OutKeyName], fv.Interface().([]string)...)
+}
+
+// unmarshalPlainString is the same as unmarshalField for PlainString
+// fields. Placeholders for missing indices are already empty strings,
+// which is the zero value
+func unmarshalPlainString(rv reflect.Value, f structfield, values []string, opts *options) error {
+	fv := fieldByIndex(rv, f.Index, true)
+	if !fv.IsValid() || !fv.CanSet() {
+		if opts.skipUnsettableFields {
+			return nil
+		}
+		return fieldError(f, ErrUnsettableField)
+	}
+
+	if fv.Kind() == reflect.String {
+		fv.SetString(values[0])
+		return nil
+	}
+
+	list := fv.Interface().([]string)
+	if opts.reuseSlices && cap(list) >= len(values) {
+		list = list[:len(values)]
+	} else {
+		list = make([]string, len(values))
+	}
+	copy(list, values)
+	fv.Set(reflect.ValueOf(list))
+	return nil
+}
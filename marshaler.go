@@ -0,0 +1,66 @@
+package urlenc
+
+import (
+	"fmt"
+	"net/url"
+	"reflect"
+)
+
+var (
+	marshalerif   = reflect.TypeOf((*Marshaler)(nil)).Elem()
+	unmarshalerif = reflect.TypeOf((*Unmarshaler)(nil)).Elem()
+)
+
+// isQueryType returns true if t is a struct (or a pointer to one) that
+// encodes its own part of the query, by implementing Marshaler and/or
+// Unmarshaler. Text types are encoded as a single value instead
+func isQueryType(t reflect.Type) bool {
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct || isScalar(t) {
+		return false
+	}
+	pt := reflect.PtrTo(t)
+	return pt.Implements(marshalerif) || pt.Implements(unmarshalerif)
+}
+
+// marshalNested encodes the struct value rv, which is nested in the
+// query. If rv implements Marshaler, the result of MarshalURL is used.
+// Otherwise the fields of rv are encoded as usual
+func marshalNested(rv reflect.Value, opts *options) (url.Values, error) {
+	if !reflect.PtrTo(rv.Type()).Implements(marshalerif) {
+		return marshalStruct(rv, opts)
+	}
+
+	if !rv.CanAddr() {
+		// MarshalURL may have a pointer receiver. Values that are not
+		// addressable (e.g. map elements) are copied
+		cp := reflect.New(rv.Type())
+		cp.Elem().Set(rv)
+		rv = cp.Elem()
+	}
+	buf, err := rv.Addr().Interface().(Marshaler).MarshalURL()
+	if err != nil {
+		return nil, err
+	}
+	uv, err := url.ParseQuery(string(buf))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse result of MarshalURL: %w", err)
+	}
+	return uv, nil
+}
+
+// unmarshalNested decodes values into the struct value rv, which is
+// nested in the query. If rv implements Unmarshaler, values are given to
+// UnmarshalURL. Otherwise the fields of rv are decoded as usual
+func unmarshalNested(values url.Values, rv reflect.Value, opts *options) error {
+	if rv.CanAddr() && rv.Addr().Type().Implements(unmarshalerif) {
+		return rv.Addr().Interface().(Unmarshaler).UnmarshalURL([]byte(values.Encode()))
+	}
+
+	// Field splitters are meant for the top-level struct
+	sub := *opts
+	sub.fieldSplitters = nil
+	return unmarshalStruct(values, rv, &sub)
+}
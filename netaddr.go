@@ -0,0 +1,88 @@
+package urlenc
+
+import (
+	"net"
+	"reflect"
+)
+
+// converter encodes and decodes a type that is not a string or a number,
+// but still has a natural single-value textual representation
+type converter struct {
+	encode func(reflect.Value) (string, error)
+	decode func(string) (reflect.Value, error)
+}
+
+var (
+	hardwareAddrType = reflect.TypeOf(net.HardwareAddr(nil))
+	ipNetType        = reflect.TypeOf(net.IPNet{})
+	ipNetPtrType     = reflect.PtrTo(ipNetType)
+)
+
+var converters = map[reflect.Type]converter{
+	hardwareAddrType: {
+		encode: func(rv reflect.Value) (string, error) {
+			return rv.Interface().(net.HardwareAddr).String(), nil
+		},
+		decode: func(s string) (reflect.Value, error) {
+			hw, err := net.ParseMAC(s)
+			if err != nil {
+				return zeroval, err
+			}
+			return reflect.ValueOf(hw), nil
+		},
+	},
+	ipNetType: {
+		encode: func(rv reflect.Value) (string, error) {
+			n := rv.Interface().(net.IPNet)
+			return n.String(), nil
+		},
+		decode: func(s string) (reflect.Value, error) {
+			n, err := parseIPNet(s)
+			if err != nil {
+				return zeroval, err
+			}
+			return reflect.ValueOf(*n), nil
+		},
+	},
+	ipNetPtrType: {
+		encode: func(rv reflect.Value) (string, error) {
+			if rv.IsNil() {
+				return "", errSkipValue
+			}
+			return rv.Interface().(*net.IPNet).String(), nil
+		},
+		decode: func(s string) (reflect.Value, error) {
+			n, err := parseIPNet(s)
+			if err != nil {
+				return zeroval, err
+			}
+			return reflect.ValueOf(n), nil
+		},
+	},
+}
+
+// parseIPNet parses a CIDR notation string. Unlike net.ParseCIDR, the
+// address is kept as given (e.g. 192.0.2.1/24 is not masked down to
+// 192.0.2.0/24) so that the value round-trips
+func parseIPNet(s string) (*net.IPNet, error) {
+	ip, n, err := net.ParseCIDR(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(n.IP) == net.IPv4len {
+		ip = ip.To4()
+	}
+	n.IP = ip
+	return n, nil
+}
+
+// isScalar returns true if values of type t are encoded as a single value
+func isScalar(t reflect.Type) bool {
+	if _, ok := lookupConverter(t); ok {
+		return true
+	}
+	if isTextType(t) {
+		return true
+	}
+	return isStringOrNumeric(t.Kind())
+}
@@ -0,0 +1,56 @@
+package urlenc
+
+import (
+	"net/url"
+	"strings"
+	"unicode"
+)
+
+// normalizeKey returns the form of key used for matching under
+// WithUnicodeKeyNormalization
+func normalizeKey(key string) string {
+	decomposed := decompose(key)
+	var b strings.Builder
+	b.Grow(len(decomposed))
+	for _, r := range decomposed {
+		if unicode.Is(unicode.Mn, r) {
+			continue
+		}
+		b.WriteRune(unicode.ToLower(r))
+	}
+	return b.String()
+}
+
+// unescapedPlusKey returns key as it is decoded by url.ParseQuery when
+// the '+' characters in it are not percent-encoded by the client, as
+// '+' stands for a space in query strings
+func unescapedPlusKey(key string) string {
+	return strings.ReplaceAll(key, "+", " ")
+}
+
+// stripBracketSuffixes returns a copy of q where the "[]" array marker is
+// removed from plain keys, as used under WithStripBracketSuffix. Keys
+// that are nested, such as "a[b][]", are left alone. Values for "key"
+// and "key[]" are merged, in that order
+func stripBracketSuffixes(q url.Values) url.Values {
+	nq := make(url.Values, len(q))
+	for _, k := range orderedKeys(q, nil) {
+		nk := k
+		if trimmed := strings.TrimSuffix(k, "[]"); trimmed != k && !strings.HasSuffix(trimmed, "]") {
+			nk = trimmed
+		}
+		nq[nk] = append(nq[nk], q[k]...)
+	}
+	return nq
+}
+
+// normalizeKeys returns a copy of q with all keys normalized. Values for
+// keys that normalize to the same form are merged, in sorted key order
+func normalizeKeys(q url.Values) url.Values {
+	nq := make(url.Values, len(q))
+	for _, k := range orderedKeys(q, nil) {
+		nk := normalizeKey(k)
+		nq[nk] = append(nq[nk], q[k]...)
+	}
+	return nq
+}
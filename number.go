@@ -0,0 +1,83 @@
+package urlenc
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+)
+
+var jsonNumberType = reflect.TypeOf(json.Number(""))
+
+func init() {
+	// json.Number is a string, but only numbers in JSON syntax are
+	// accepted, so that the value can be passed on as-is
+	converters[jsonNumberType] = converter{
+		encode: func(rv reflect.Value) (string, error) {
+			return rv.String(), nil
+		},
+		decode: func(s string) (reflect.Value, error) {
+			if !isJSONNumber(s) {
+				return zeroval, fmt.Errorf("invalid number %q", s)
+			}
+			return reflect.ValueOf(json.Number(s)), nil
+		},
+	}
+}
+
+// isJSONNumber returns true if s is a number as defined by the JSON
+// grammar, e.g. "-1", "0.5", or "1e10"
+func isJSONNumber(s string) bool {
+	if s == "" {
+		return false
+	}
+
+	// Optional sign
+	if s[0] == '-' {
+		s = s[1:]
+		if s == "" {
+			return false
+		}
+	}
+
+	// Integer part, without leading zeros
+	switch {
+	case s[0] == '0':
+		s = s[1:]
+	case '1' <= s[0] && s[0] <= '9':
+		s = skipDigits(s[1:])
+	default:
+		return false
+	}
+
+	// Optional fraction
+	if len(s) >= 2 && s[0] == '.' && isDigit(s[1]) {
+		s = skipDigits(s[2:])
+	}
+
+	// Optional exponent
+	if len(s) >= 2 && (s[0] == 'e' || s[0] == 'E') {
+		s = s[1:]
+		if s[0] == '+' || s[0] == '-' {
+			s = s[1:]
+			if s == "" {
+				return false
+			}
+		}
+		if !isDigit(s[0]) {
+			return false
+		}
+		s = skipDigits(s[1:])
+	}
+	return s == ""
+}
+
+func isDigit(c byte) bool {
+	return '0' <= c && c <= '9'
+}
+
+func skipDigits(s string) string {
+	for len(s) > 0 && isDigit(s[0]) {
+		s = s[1:]
+	}
+	return s
+}
@@ -0,0 +1,638 @@
+package urlenc
+
+import (
+	"reflect"
+	"sync"
+)
+
+// Option configures the behavior of the *WithOptions variants of
+// Marshal and Unmarshal. Options that do not apply to the operation
+// being performed are silently ignored.
+type Option func(*options)
+
+// MapMultiPolicy controls how keys with multiple values are stored when
+// unmarshaling into a map.
+type MapMultiPolicy int
+
+const (
+	// MapMultiSlice stores all of the values as a []string. This is the default
+	MapMultiSlice MapMultiPolicy = iota
+	// MapMultiFirst stores only the first value as a string
+	MapMultiFirst
+	// MapMultiLast stores only the last value as a string
+	MapMultiLast
+)
+
+// MapKeyStyle controls how the keys of the elements of map fields are
+// formed from the key of the field itself.
+type MapKeyStyle int
+
+const (
+	// MapKeyBracket gives the elements as key[subkey]=value. This is the
+	// default
+	MapKeyBracket MapKeyStyle = iota
+	// MapKeyDot gives the elements as key.subkey=value
+	MapKeyDot
+)
+
+// NonFinitePolicy controls how NaN and infinite float values are marshaled.
+type NonFinitePolicy int
+
+const (
+	// NonFiniteAllow emits the values as-is, e.g. "NaN" or "+Inf". This is
+	// the default
+	NonFiniteAllow NonFinitePolicy = iota
+	// NonFiniteError makes Marshal return an error
+	NonFiniteError
+	// NonFiniteSkip leaves the value out of the query
+	NonFiniteSkip
+	// NonFiniteEmpty emits an empty value
+	NonFiniteEmpty
+)
+
+// ValueCaseMode controls whether string values are converted to lower or
+// upper case when marshaled.
+type ValueCaseMode int
+
+const (
+	// ValueCaseNone leaves string values as they are. This is the default
+	ValueCaseNone ValueCaseMode = iota
+	// ValueCaseLower converts string values to lower case
+	ValueCaseLower
+	// ValueCaseUpper converts string values to upper case
+	ValueCaseUpper
+)
+
+// ArrayFormat controls how the elements of slice and array fields are
+// given when marshaled.
+type ArrayFormat int
+
+const (
+	// ArrayFormatRepeat repeats the key for each element, as in
+	// key=1&key=2. This is the default
+	ArrayFormatRepeat ArrayFormat = iota
+	// ArrayFormatBrackets appends the "[]" array marker to the key, as in
+	// key[]=1&key[]=2
+	ArrayFormatBrackets
+	// ArrayFormatIndices appends the index of each element to the key, as
+	// in key[0]=1&key[1]=2
+	ArrayFormatIndices
+	// ArrayFormatComma joins the elements into a single value, as in
+	// key=1,2
+	ArrayFormatComma
+)
+
+// ArrayMismatchPolicy controls how Unmarshal handles array fields when
+// the number of values differs from the length of the array.
+type ArrayMismatchPolicy int
+
+const (
+	// ArrayMismatchError makes Unmarshal return an error. This is the
+	// default
+	ArrayMismatchError ArrayMismatchPolicy = iota
+	// ArrayMismatchTruncate fills as many elements as there are values.
+	// Values that do not fit are dropped, and missing elements are left
+	// as zero values
+	ArrayMismatchTruncate
+	// ArrayMismatchZeroFill leaves missing elements as zero values, but
+	// still makes Unmarshal return an error for values that do not fit
+	ArrayMismatchZeroFill
+)
+
+// IndexGapPolicy controls how Unmarshal handles slice and array fields
+// given as key[index]=value, when some of the indices are missing.
+type IndexGapPolicy int
+
+const (
+	// IndexGapCompact drops the gaps, so that items[0]=a&items[2]=c
+	// becomes [a c]. This is the default
+	IndexGapCompact IndexGapPolicy = iota
+	// IndexGapError makes Unmarshal return an error
+	IndexGapError
+	// IndexGapFill leaves zero values in place of the missing indices, so
+	// that items[0]=a&items[2]=c becomes [a "" c]. At most 1000 missing
+	// indices are filled per field, and Unmarshal returns ErrIndexGap
+	// beyond that
+	IndexGapFill
+)
+
+// NumberParser parses the string s into a number for a value of the given
+// kind, which is one of the integer or float kinds. The result may be of
+// any numeric type that can be converted to the kind.
+type NumberParser func(kind reflect.Kind, s string) (interface{}, error)
+
+// NumberFormatter formats rv, whose kind is one of the integer or float
+// kinds, into a string.
+type NumberFormatter func(rv reflect.Value) (string, error)
+
+// FieldSplitter decodes the value for a single query key into one or
+// more fields of the struct being unmarshaled. rv is the struct value,
+// and its exported fields can be set directly.
+type FieldSplitter func(value string, rv reflect.Value) error
+
+type options struct {
+	arrayFormat             ArrayFormat
+	arrayMismatchPolicy     ArrayMismatchPolicy
+	canonical               bool
+	collectErrors           bool
+	disallowUnknownKeys     bool
+	errorOnEmptyOutput      bool
+	fieldSplitters          map[string]FieldSplitter
+	flagBooleans            bool
+	floatPrecision          int
+	floatRoundTripCheck     bool
+	ignoreUnsupportedKinds  bool
+	indexGapPolicy          IndexGapPolicy
+	keyOrder                []string
+	mapKeyPrefix            string
+	mapKeyStyle             MapKeyStyle
+	mapMultiPolicy          MapMultiPolicy
+	mapOmitEmpty            bool
+	maxOutputBytes          int
+	nonFinitePolicy         NonFinitePolicy
+	nullMarker              string
+	numberFormatter         NumberFormatter
+	numberParser            NumberParser
+	numericBooleans         bool
+	rejectControlChars      bool
+	rfc3986Escaping         bool
+	requireAllFields        bool
+	reuseSlices             bool
+	skipUnsettableFields    bool
+	sortValues              bool
+	skipUnsupportedFields   bool
+	spaceAsPercent20        bool
+	stripBracketSuffix      bool
+	strictTypes             bool
+	tagName                 string
+	timeLayouts             []string // set per struct field, from the "layouts=" tag option
+	unicodeKeyNormalization bool
+	valueCaseMode           ValueCaseMode
+	valuerOmitEmpty         bool
+	withoutValuerSetter     bool
+}
+
+var defaultOptions struct {
+	lock sync.RWMutex
+	list []Option
+}
+
+// SetDefaultOptions sets the options that are applied to all calls to
+// Marshal, Unmarshal, and their variants. Options given to each call are
+// applied after the defaults, so they take precedence. Calling
+// SetDefaultOptions again replaces the previous defaults, and calling it
+// without any options clears them.
+//
+// SetDefaultOptions is safe to call concurrently with Marshal/Unmarshal,
+// but it is usually called once during initialization.
+func SetDefaultOptions(options ...Option) {
+	list := make([]Option, len(options))
+	copy(list, options)
+
+	defaultOptions.lock.Lock()
+	defer defaultOptions.lock.Unlock()
+	defaultOptions.list = list
+}
+
+func newOptions(list []Option) *options {
+	o := options{
+		floatPrecision: -1,
+	}
+
+	defaultOptions.lock.RLock()
+	for _, option := range defaultOptions.list {
+		option(&o)
+	}
+	defaultOptions.lock.RUnlock()
+
+	for _, option := range list {
+		option(&o)
+	}
+	return &o
+}
+
+// WithReuseSlices specifies that when unmarshaling into a slice field
+// that already has enough capacity to hold the incoming values, its
+// backing array is reused instead of allocating a new slice. The
+// field's length is always set to the number of incoming values.
+//
+// Note that the elements are written directly into the existing
+// backing array, so any other slice sharing it will observe the change.
+// This only happens once all of the incoming values have been decoded,
+// so a decoding error leaves the existing elements untouched.
+func WithReuseSlices() Option {
+	return func(o *options) {
+		o.reuseSlices = true
+	}
+}
+
+// WithRejectControlChars specifies that Unmarshal should fail if any of
+// the decoded keys or values contain control characters (such as NUL or
+// newlines). This is useful for sanitizing untrusted input.
+func WithRejectControlChars() Option {
+	return func(o *options) {
+		o.rejectControlChars = true
+	}
+}
+
+// WithSortValues specifies that Marshal should sort the values for each
+// key, so that the output does not depend on the order in which they were
+// produced (e.g. map iteration order). Keys are always sorted, so with
+// this option the output is fully deterministic, which is useful for
+// snapshot tests.
+//
+// Note that this changes the order of repeated keys, and therefore the
+// order of the elements of slices when they are unmarshaled again. Values
+// are compared as strings, so "10" sorts before "9", and values that were
+// joined into one (e.g. with ArrayFormatComma) are sorted as a whole.
+func WithSortValues() Option {
+	return func(o *options) {
+		o.sortValues = true
+	}
+}
+
+// WithKeyOrder specifies the order in which keys are emitted by Marshal.
+// Keys in the list are emitted first, in the given order, and the rest
+// follow in sorted order. Keys in the list that are not present in the
+// output are skipped.
+//
+// This is useful for protocols that require parameters in a specific
+// order, such as some request signing schemes.
+func WithKeyOrder(keys []string) Option {
+	return func(o *options) {
+		o.keyOrder = keys
+	}
+}
+
+// WithSpaceAsPercent20 specifies that Marshal should encode spaces as
+// "%20" instead of "+". Literal plus signs are always encoded as "%2B".
+func WithSpaceAsPercent20() Option {
+	return func(o *options) {
+		o.spaceAsPercent20 = true
+	}
+}
+
+// WithFloatPrecision specifies the number of digits after the decimal
+// point used when marshaling floating point values. The default is -1,
+// which uses the smallest number of digits necessary to represent the
+// value exactly.
+func WithFloatPrecision(prec int) Option {
+	return func(o *options) {
+		o.floatPrecision = prec
+	}
+}
+
+// WithFloatRoundTripCheck specifies that Marshal should re-parse every
+// formatted floating point value, and return an error if the result is
+// not equal to the original value. Use this as a safety net against
+// losing precision in money or other precision sensitive values.
+func WithFloatRoundTripCheck() Option {
+	return func(o *options) {
+		o.floatRoundTripCheck = true
+	}
+}
+
+// WithRequireAllFields specifies that Unmarshal should fail if the keys
+// for any of the fields in the target struct are not present in the
+// query. The returned error wraps ErrMissingFields, and lists all of the
+// missing keys. Fields tagged with omitempty are treated as optional.
+// Only the presence of the keys is looked at, so a key given with a zero
+// value such as "count=0" or "name=" satisfies the requirement.
+func WithRequireAllFields() Option {
+	return func(o *options) {
+		o.requireAllFields = true
+	}
+}
+
+// withMapKeyPrefix is used by MarshalMapPrefixed/UnmarshalMapPrefixed
+func withMapKeyPrefix(prefix string) Option {
+	return func(o *options) {
+		o.mapKeyPrefix = prefix
+	}
+}
+
+// withCanonical is used by MarshalCanonical
+func withCanonical() Option {
+	return func(o *options) {
+		o.canonical = true
+	}
+}
+
+// WithMapMultiPolicy specifies how Unmarshal stores keys with multiple
+// values when the target is a map[string]interface{}. Keys with a single
+// value are always stored as a string. For maps with other element types,
+// slices receive all of the values, and other types receive the first
+// value (MapMultiSlice, MapMultiFirst) or the last one (MapMultiLast).
+func WithMapMultiPolicy(policy MapMultiPolicy) Option {
+	return func(o *options) {
+		o.mapMultiPolicy = policy
+	}
+}
+
+// WithStripBracketSuffix specifies that Unmarshal should remove the "[]"
+// array marker from query keys before matching them, so that "names[]=a"
+// is decoded into a field tagged as "names", even if the field is not a
+// slice. This also applies when unmarshaling into a map.
+func WithStripBracketSuffix() Option {
+	return func(o *options) {
+		o.stripBracketSuffix = true
+	}
+}
+
+// WithUnicodeKeyNormalization specifies that Unmarshal should match
+// query keys against struct field keys after normalizing both: the keys
+// are decomposed (NFKD), stripped of combining marks such as accents,
+// and case-folded. This helps when clients send composed and decomposed
+// forms of the same unicode key. The keys themselves are not modified.
+//
+// Decomposition covers the Latin, Greek, and Cyrillic scripts, as well as
+// fullwidth forms, so that no normalization package is needed.
+func WithUnicodeKeyNormalization() Option {
+	return func(o *options) {
+		o.unicodeKeyNormalization = true
+	}
+}
+
+// WithMapOmitEmpty specifies whether Marshal should drop map elements
+// whose values are equal to the zero value of their type, similar to
+// what omitempty does for struct fields. By default, maps never omit
+// any elements. This option does not affect struct fields, which are
+// controlled by their struct tags.
+func WithMapOmitEmpty(v bool) Option {
+	return func(o *options) {
+		o.mapOmitEmpty = v
+	}
+}
+
+// WithFlagBooleans specifies that Unmarshal should treat a key that is
+// present without a value (e.g. "active" in "active&other=1") as true
+// when decoding into a bool field. Without this option, the empty value
+// fails to parse as a bool.
+func WithFlagBooleans() Option {
+	return func(o *options) {
+		o.flagBooleans = true
+	}
+}
+
+// WithValueCaseMode specifies whether Marshal converts the values of string
+// fields (including the elements of string slices and maps) to lower or
+// upper case, which is useful for case-insensitive backends. Keys and
+// non-string values are left untouched.
+func WithValueCaseMode(mode ValueCaseMode) Option {
+	return func(o *options) {
+		o.valueCaseMode = mode
+	}
+}
+
+// WithTagName specifies the name of the struct tag to read the field
+// options from, instead of "urlenc" falling back to "json". Fields without
+// the tag use the name of the field as the key.
+func WithTagName(name string) Option {
+	return func(o *options) {
+		o.tagName = name
+	}
+}
+
+// WithArrayFormat specifies how Marshal gives the elements of slice and
+// array fields. Fields with the "csv" or "split=" tag options keep joining
+// their elements using their own separator.
+//
+// Unmarshal always accepts the repeated, bracketed, and indexed forms.
+// Values are only split on commas with ArrayFormatComma (or the "csv" tag
+// option), as commas may be a legitimate part of the values.
+func WithArrayFormat(format ArrayFormat) Option {
+	return func(o *options) {
+		o.arrayFormat = format
+	}
+}
+
+// WithArrayMismatchPolicy specifies how Unmarshal handles array fields
+// (e.g. [3]int) when the number of values in the query differs from the
+// length of the array.
+func WithArrayMismatchPolicy(policy ArrayMismatchPolicy) Option {
+	return func(o *options) {
+		o.arrayMismatchPolicy = policy
+	}
+}
+
+// WithIndexGapPolicy specifies how Unmarshal handles slice and array
+// fields given as key[index]=value, when some of the indices are missing
+// (e.g. items[0]=a&items[2]=c). Gaps are not filled for fields whose
+// values are split (see the csv and split= tag options).
+func WithIndexGapPolicy(policy IndexGapPolicy) Option {
+	return func(o *options) {
+		o.indexGapPolicy = policy
+	}
+}
+
+// WithNullMarker specifies a value that stands for a nil pointer, for
+// APIs that distinguish null from absent values. Marshal gives nil pointer
+// fields without "omitempty" as key=marker (e.g. "count=null") instead of
+// leaving them out, and Unmarshal sets pointer fields whose value is the
+// marker to nil. This applies to pointers to single values, such as *int
+// or *time.Time.
+//
+// Note that a pointer to a string whose value is the same as the marker
+// can not be told apart from a nil pointer.
+func WithNullMarker(marker string) Option {
+	return func(o *options) {
+		o.nullMarker = marker
+	}
+}
+
+// WithNumberFormatter specifies a function that Marshal uses to format all
+// integer and float values, instead of the strconv package. This is the
+// counterpart of WithNumberParser, and allows locale specific formatting.
+// Values of registered enums, or of types that encode themselves are not
+// affected, and neither WithFloatPrecision nor WithNonFinitePolicy apply
+// to the values formatted by fn.
+func WithNumberFormatter(fn NumberFormatter) Option {
+	return func(o *options) {
+		o.numberFormatter = fn
+	}
+}
+
+// WithNumberParser specifies a function that Unmarshal uses to parse all
+// integer and float values, instead of the strconv package. This allows,
+// for example, decimal commas or thousands separators used by some
+// locales. Values of registered enums, or of types that decode themselves
+// are not affected. WithStrictTypes does not apply to the values parsed
+// by fn.
+//
+// Results that do not fit into the field, such as 300 for an int8 or 1.5
+// for an int, are rejected instead of being truncated.
+func WithNumberParser(fn NumberParser) Option {
+	return func(o *options) {
+		o.numberParser = fn
+	}
+}
+
+// WithNonFinitePolicy specifies how Marshal handles NaN and infinite float
+// values. The policy applies to each element of a slice individually.
+func WithNonFinitePolicy(policy NonFinitePolicy) Option {
+	return func(o *options) {
+		o.nonFinitePolicy = policy
+	}
+}
+
+// WithFieldSplitter specifies that when unmarshaling into a struct, the
+// value for key should be passed to fn instead of being assigned to a
+// single field. This allows compact values such as "range=10-20" to be
+// spread across multiple fields. fn is called after all regular fields
+// have been decoded, and only if key is present in the query.
+//
+// The option may be given multiple times for different keys, and a later
+// option for the same key replaces the earlier one. Splitters are called
+// in the sorted order of their keys, so if the splitters for two keys set
+// the same field, the one for the key that sorts last wins.
+func WithFieldSplitter(key string, fn FieldSplitter) Option {
+	return func(o *options) {
+		if o.fieldSplitters == nil {
+			o.fieldSplitters = make(map[string]FieldSplitter)
+		}
+		o.fieldSplitters[key] = fn
+	}
+}
+
+// WithRFC3986Escaping specifies that Marshal should percent-encode every
+// character in keys and values, except for the unreserved characters
+// defined in RFC 3986 (A-Z, a-z, 0-9, '-', '.', '_', '~'). Spaces are
+// encoded as "%20". This is the encoding required by signing schemes
+// such as OAuth 1.0. This option takes precedence over
+// WithSpaceAsPercent20.
+func WithRFC3986Escaping() Option {
+	return func(o *options) {
+		o.rfc3986Escaping = true
+	}
+}
+
+// WithNumericBooleans specifies that Marshal should encode boolean values
+// as "1" and "0" instead of "true" and "false", for backends that only
+// accept the numeric form. Unmarshal always accepts both forms.
+func WithNumericBooleans() Option {
+	return func(o *options) {
+		o.numericBooleans = true
+	}
+}
+
+// WithMapKeyStyle specifies how the elements of map fields (including
+// url.Values fields) are keyed when marshaling and unmarshaling. For
+// slices of maps, only the subkey is affected, and the index is always
+// given in brackets.
+func WithMapKeyStyle(style MapKeyStyle) Option {
+	return func(o *options) {
+		o.mapKeyStyle = style
+	}
+}
+
+// WithErrorOnEmptyOutput specifies that Marshal should fail if there are
+// no values to encode, such as for a struct whose fields are all omitempty
+// and zero. The returned error wraps ErrEmptyOutput. By default, an empty
+// query string is returned.
+func WithErrorOnEmptyOutput() Option {
+	return func(o *options) {
+		o.errorOnEmptyOutput = true
+	}
+}
+
+// WithMaxOutputBytes specifies that Marshal should fail if the encoded
+// query is longer than n bytes, to protect downstream systems with URL
+// length limits. The returned error wraps ErrOutputTooLarge. For
+// MarshalBatch, the limit applies to each of the query strings. A value
+// of 0 or less means that there is no limit, which is the default.
+func WithMaxOutputBytes(n int) Option {
+	return func(o *options) {
+		o.maxOutputBytes = n
+	}
+}
+
+// WithoutValuerSetter specifies that the Valuer, ErrorValuer, Setter, and
+// SetterFactory interfaces should be ignored, and that values should only
+// be converted using the built-in rules. This is useful when a type
+// implements those methods for unrelated purposes. ValuesSetter is not
+// affected by this option.
+func WithoutValuerSetter() Option {
+	return func(o *options) {
+		o.withoutValuerSetter = true
+	}
+}
+
+// WithSkipUnsupportedFields specifies that struct fields of types that
+// this package can not handle should be silently left out, instead of
+// making Marshal/Unmarshal fail. This is useful when binding against
+// large structs that are shared with other parts of a program.
+func WithSkipUnsupportedFields() Option {
+	return func(o *options) {
+		o.skipUnsupportedFields = true
+	}
+}
+
+// WithSkipUnsettableFields specifies that struct fields that can not be
+// set should be silently left alone by Unmarshal, instead of making it
+// fail with ErrUnsettableField.
+func WithSkipUnsettableFields() Option {
+	return func(o *options) {
+		o.skipUnsettableFields = true
+	}
+}
+
+// WithIgnoreUnsupportedKinds specifies that struct fields of kinds that
+// can never be represented in a query, namely channels, functions, and
+// unsafe pointers, should be silently left out. Unlike
+// WithSkipUnsupportedFields, fields of other unsupported types (e.g.
+// slices of structs) still make Marshal/Unmarshal fail, as those usually
+// point to a mistake in the struct definition.
+func WithIgnoreUnsupportedKinds() Option {
+	return func(o *options) {
+		o.ignoreUnsupportedKinds = true
+	}
+}
+
+// WithValuerOmitEmpty specifies that for omitempty fields that implement
+// Valuer or ErrorValuer, Marshal should decide whether the field is empty
+// based on the value returned by Value, instead of the field itself. For
+// example, a wrapper that is non-zero but whose Value returns "" is left
+// out. Note that Value may be called more than once for such fields.
+func WithValuerOmitEmpty() Option {
+	return func(o *options) {
+		o.valuerOmitEmpty = true
+	}
+}
+
+// WithDisallowUnknownKeys specifies that Unmarshal should fail if the query
+// contains keys that do not map to any of the fields of the target struct.
+// The returned error wraps ErrUnknownKeys, and lists all of the unknown
+// keys. Structs with an embedded map that captures unmatched keys never
+// have unknown keys.
+func WithDisallowUnknownKeys() Option {
+	return func(o *options) {
+		o.disallowUnknownKeys = true
+	}
+}
+
+// WithDisallowUnknownFields is the same as WithDisallowUnknownKeys. It is
+// named after json.Decoder.DisallowUnknownFields for those who look for it
+func WithDisallowUnknownFields() Option {
+	return WithDisallowUnknownKeys()
+}
+
+// WithStrictTypes specifies that Unmarshal should only accept values in
+// the exact form that Marshal would produce. Booleans must be "true" or
+// "false" ("1" or "0" with WithNumericBooleans), integers must not have
+// signs or leading zeros that Marshal would not emit, and floats must be
+// finite decimal numbers. The returned error wraps ErrStrictType.
+func WithStrictTypes() Option {
+	return func(o *options) {
+		o.strictTypes = true
+	}
+}
+
+// WithCollectErrors specifies that Unmarshal should not stop at the first
+// field that fails to decode. Instead, all fields are looked at, and if
+// any of them fail, a MultiError holding all of the errors is returned.
+// This is useful for reporting every problem in a form at once.
+func WithCollectErrors() Option {
+	return func(o *options) {
+		o.collectErrors = true
+	}
+}
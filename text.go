@@ -0,0 +1,64 @@
+package urlenc
+
+import (
+	"encoding"
+	"reflect"
+)
+
+var (
+	textmarshalerif   = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+	textunmarshalerif = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+)
+
+// isTextType returns true if values of type t can be encoded using
+// encoding.TextMarshaler, or decoded using encoding.TextUnmarshaler.
+// Pointer types are not included, as pointers are followed before the
+// values are looked at
+func isTextType(t reflect.Type) bool {
+	if t.Kind() == reflect.Ptr {
+		return false
+	}
+	pt := reflect.PtrTo(t)
+	return t.Implements(textmarshalerif) || pt.Implements(textmarshalerif) || pt.Implements(textunmarshalerif)
+}
+
+// marshalText returns the result of MarshalText on rv. The second return
+// value is false if rv does not implement encoding.TextMarshaler
+func marshalText(rv reflect.Value) (string, bool, error) {
+	var m encoding.TextMarshaler
+	switch {
+	case rv.Type().Implements(textmarshalerif):
+		m = rv.Interface().(encoding.TextMarshaler)
+	case reflect.PtrTo(rv.Type()).Implements(textmarshalerif):
+		// MarshalText has a pointer receiver. Values that are not
+		// addressable (e.g. map elements) are copied
+		if !rv.CanAddr() {
+			cp := reflect.New(rv.Type())
+			cp.Elem().Set(rv)
+			rv = cp.Elem()
+		}
+		m = rv.Addr().Interface().(encoding.TextMarshaler)
+	default:
+		return "", false, nil
+	}
+
+	buf, err := m.MarshalText()
+	if err != nil {
+		return "", true, err
+	}
+	return string(buf), true, nil
+}
+
+// unmarshalText creates a value of type t using UnmarshalText. The second
+// return value is false if t does not implement encoding.TextUnmarshaler
+func unmarshalText(t reflect.Type, s string) (reflect.Value, bool, error) {
+	if t.Kind() == reflect.Ptr || !reflect.PtrTo(t).Implements(textunmarshalerif) {
+		return zeroval, false, nil
+	}
+
+	pv := reflect.New(t)
+	if err := pv.Interface().(encoding.TextUnmarshaler).UnmarshalText([]byte(s)); err != nil {
+		return zeroval, true, err
+	}
+	return pv.Elem(), true, nil
+}
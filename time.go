@@ -0,0 +1,120 @@
+package urlenc
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+)
+
+var (
+	timeType     = reflect.TypeOf(time.Time{})
+	durationType = reflect.TypeOf(time.Duration(0))
+)
+
+func init() {
+	// Without any layouts, times are given in RFC3339 format
+	converters[timeType] = converter{
+		encode: func(rv reflect.Value) (string, error) {
+			return rv.Interface().(time.Time).Format(time.RFC3339Nano), nil
+		},
+		decode: func(s string) (reflect.Value, error) {
+			t, err := time.Parse(time.RFC3339Nano, s)
+			if err != nil {
+				return zeroval, err
+			}
+			return reflect.ValueOf(t), nil
+		},
+	}
+
+	// Durations are int64s, but are given as "5m0s" instead of the
+	// number of nanoseconds
+	converters[durationType] = converter{
+		encode: func(rv reflect.Value) (string, error) {
+			return rv.Interface().(time.Duration).String(), nil
+		},
+		decode: func(s string) (reflect.Value, error) {
+			d, err := time.ParseDuration(s)
+			if err != nil {
+				return zeroval, err
+			}
+			return reflect.ValueOf(d), nil
+		},
+	}
+}
+
+// namedLayouts are the layouts that can be referred to by name in the
+// "layouts=" tag option
+var namedLayouts = map[string]string{
+	"ANSIC":       time.ANSIC,
+	"UnixDate":    time.UnixDate,
+	"RubyDate":    time.RubyDate,
+	"RFC822":      time.RFC822,
+	"RFC822Z":     time.RFC822Z,
+	"RFC850":      time.RFC850,
+	"RFC1123":     time.RFC1123,
+	"RFC1123Z":    time.RFC1123Z,
+	"RFC3339":     time.RFC3339,
+	"RFC3339Nano": time.RFC3339Nano,
+	"Kitchen":     time.Kitchen,
+}
+
+// parseLayouts parses the value of the "layouts=" tag option, which is a
+// list of layouts separated by '|'. Each layout is either the name of one
+// of the layouts defined in the time package, or a layout string
+func parseLayouts(s string) []string {
+	list := strings.Split(s, "|")
+	for i, layout := range list {
+		if named, ok := namedLayouts[layout]; ok {
+			list[i] = named
+		}
+	}
+	return list
+}
+
+// isTimeType returns true if t is time.Time, or a slice or an array of
+// time.Time, which are the types that the "layouts=" tag option applies to
+func isTimeType(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.Slice, reflect.Array:
+		t = t.Elem()
+	}
+	return t == timeType
+}
+
+// layoutSample is formatted and parsed back to check layouts. None of its
+// elements are equal to those of the reference time
+var layoutSample = time.Date(2001, time.February, 3, 16, 5, 6, 789000000, time.UTC)
+
+// checkLayouts verifies that each of the layouts contains at least one
+// element of the reference time, and that times formatted using it can
+// be parsed back. Otherwise time.Format would silently produce the same
+// string for every value
+func checkLayouts(layouts []string) error {
+	for _, layout := range layouts {
+		s := layoutSample.Format(layout)
+		if s == layout {
+			return fmt.Errorf("layout %q does not contain any elements of the reference time", layout)
+		}
+		if _, err := time.Parse(layout, s); err != nil {
+			return fmt.Errorf("layout %q can not be parsed back: %w", layout, err)
+		}
+	}
+	return nil
+}
+
+// formatTime formats the time.Time in rv using the first layout
+func formatTime(rv reflect.Value, layouts []string) string {
+	return rv.Interface().(time.Time).Format(layouts[0])
+}
+
+// parseTime parses s using each of the layouts in order, and returns the
+// first successful result
+func parseTime(s string, layouts []string) (reflect.Value, error) {
+	for _, layout := range layouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return reflect.ValueOf(t), nil
+		}
+	}
+	return zeroval, fmt.Errorf("%q does not match any of the layouts %q", s, layouts)
+}
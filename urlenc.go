@@ -5,12 +5,16 @@ package urlenc
 
 import (
 	"errors"
+	"fmt"
+	"math"
 	"net/url"
 	"reflect"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"unicode"
 )
 
 const (
@@ -21,27 +25,84 @@ const (
 )
 
 type structfield struct {
-	// FieldName is the name of the field, so we can use FieldByName to
-	// index into the struct. This is better (albeit less efficient) than
-	// using numeric indices, because then we can work directly with
-	// embedded structs
+	// FieldName is the name of the field. For fields promoted from
+	// embedded structs, this is the name of the field in the embedded struct
 	FieldName string
+	// Index is the index sequence used to reach the field from the
+	// outermost struct, as in reflect.StructField.Index, but spanning
+	// through embedded structs
+	Index []int
 	// KeyName is the name that is used in the resulting query for this field
 	KeyName string
+	// InKeyName is the name that is looked up in the query when
+	// unmarshaling. Unless specified via the "in=" tag option, it is the
+	// same as KeyName
+	InKeyName string
+	// OutKeyName is the name that is used in the query when marshaling.
+	// Unless specified via the "out=" tag option, it is the same as KeyName
+	OutKeyName string
 	// If true, the field is not included in the query if its value is
 	// equal to the zero value of the field type
 	OmitEmpty bool
+	// If true, the field is a pointer to a single value without an
+	// explicit "omitempty", so a nil pointer is given as the null marker
+	// when WithNullMarker is used
+	Nullable bool
+	// If true, the values for a slice field are given as a single
+	// comma-separated value instead of repeated keys
+	CSV bool
+	// Encoding is the name of the encoding used to represent a byte
+	// slice or array as a single value, as specified by the "encoding="
+	// tag option. Fields of type []byte default to "base64"
+	Encoding string
+	// Split is the separator used to join the elements of a slice field
+	// into a single value, as specified by the "split=" tag option
+	Split string
+	// Layouts are the layouts used for a time.Time field, as specified by
+	// the "layouts=" tag option. The first one is used when marshaling,
+	// and all of them are tried in order when unmarshaling
+	Layouts []string
+	// If true, this slice field is split into chunks by MarshalBatch
+	Batch bool
+	// If true, the field implements ValuesSetter
+	ValuesSetter bool
+	// If true, the field is a struct that implements Marshaler and/or
+	// Unmarshaler, and encodes its own part of the query. See Embedded
+	QueryType bool
+	// If true, the field is an embedded QueryType field. Embedded fields
+	// are given the whole query, and other fields are given the keys
+	// under their own key, as key.subkey=value
+	Embedded bool
+	// If true, the field is an embedded map without a struct tag, which
+	// captures all of the keys that are not matched by other fields
+	CatchAll bool
+	// If true, the field is a string or a []string whose values are
+	// copied as-is. See isPlainString
+	PlainString bool
+	// If true, the type of the field is not supported
+	Unsupported bool
+	// If true, another promoted field at the same depth has the same key,
+	// so neither of them is used. The field is kept while the fields are
+	// being built, so that it still shadows deeper promoted fields
+	Ambiguous bool
 	// Type is the type of this struct field
 	Type reflect.Type
 }
 
 var t2f = type2fields{
-	types: make(map[reflect.Type][]structfield),
+	types: make(map[fieldsKey][]structfield),
 }
 
 type type2fields struct {
 	lock  sync.RWMutex
-	types map[reflect.Type][]structfield
+	types map[fieldsKey][]structfield
+}
+
+// fieldsKey identifies a set of fields in the cache. The same struct
+// type has different fields depending on the struct tag that is used
+type fieldsKey struct {
+	Type    reflect.Type
+	TagName string
 }
 
 func isStringOrNumeric(rk reflect.Kind) bool {
@@ -55,11 +116,36 @@ func isStringOrNumeric(rk reflect.Kind) bool {
 }
 
 func isSupportedType(rt reflect.Type, recurse bool) bool {
+	if _, ok := lookupConverter(rt); ok {
+		return true
+	}
+	if isTextType(rt) {
+		return true
+	}
+
 	switch rk := rt.Kind(); rk {
+	case reflect.Map:
+		// maps with string keys, whose values are either strings, numbers,
+		// slices of those, or structs
+		if !recurse || rt.Key().Kind() != reflect.String {
+			return false
+		}
+		if isFlattenedStruct(rt.Elem()) {
+			return true
+		}
+		return isSupportedType(rt.Elem(), true)
 	case reflect.Slice, reflect.Array:
 		if !recurse {
 			return false
 		}
+		if rk == reflect.Slice && rt.Elem().Kind() == reflect.Map {
+			// slices of maps, given as key[index][subkey]=value
+			return isSupportedType(rt.Elem(), true)
+		}
+		if isSliceOfSlices(rt) {
+			// slices of slices, given as key[index][]=value
+			return isSupportedType(rt.Elem().Elem(), false)
+		}
 		ok := isSupportedType(rt.Elem(), false)
 		if !ok {
 			return false
@@ -74,41 +160,139 @@ type Valuer interface {
 	Value() interface{}
 }
 
+// ErrorValuer is the same as Valuer, but may report a failure to produce
+// the value. The error is propagated to the caller of Marshal.
+type ErrorValuer interface {
+	Value() (interface{}, error)
+}
+
 var valuerif = reflect.TypeOf((*Valuer)(nil)).Elem()
+var errvaluerif = reflect.TypeOf((*ErrorValuer)(nil)).Elem()
 
+// getValuerMethod returns the Value method for either a Valuer or an
+// ErrorValuer. Callers can tell them apart by the number of return values
 func getValuerMethod(fv reflect.Value) reflect.Value {
 	const methodName = "Value"
 	var mv reflect.Value
-	if fv.Type().Implements(valuerif) {
+	if t := fv.Type(); t.Implements(valuerif) || t.Implements(errvaluerif) {
 		mv = fv.MethodByName(methodName)
-	} else if fv.CanAddr() && fv.Addr().Type().Implements(valuerif) {
-		mv = fv.Addr().MethodByName(methodName)
+	} else if fv.CanAddr() {
+		if pt := fv.Addr().Type(); pt.Implements(valuerif) || pt.Implements(errvaluerif) {
+			mv = fv.Addr().MethodByName(methodName)
+		}
 	}
 	return mv
 }
 
-func convertToString(rv reflect.Value) (string, error) {
+func convertToString(rv reflect.Value, opts *options) (string, error) {
+	if len(opts.timeLayouts) > 0 && rv.Type() == timeType {
+		return formatTime(rv, opts.timeLayouts), nil
+	}
+	if c, ok := lookupConverter(rv.Type()); ok {
+		return c.encode(rv)
+	}
+	if e, ok := enums.Lookup(rv.Type()); ok {
+		return e.ToName(rv)
+	}
+	if s, ok, err := marshalText(rv); ok {
+		return s, err
+	}
+	if opts.numberFormatter != nil && isNumberKind(rv.Kind()) {
+		return opts.numberFormatter(rv)
+	}
+	if s, ok := stringerValue(rv); ok {
+		return s, nil
+	}
+
 	switch rv.Kind() {
 	case reflect.Bool:
-		if rv.Bool() {
-			return "true", nil
+		if opts.numericBooleans {
+			if rv.Bool() {
+				return "1", nil
+			}
+			return "0", nil
 		}
-		return "false", nil
+		return strconv.FormatBool(rv.Bool()), nil
 	case reflect.String:
+		switch opts.valueCaseMode {
+		case ValueCaseLower:
+			return strings.ToLower(rv.String()), nil
+		case ValueCaseUpper:
+			return strings.ToUpper(rv.String()), nil
+		}
 		return rv.String(), nil
 	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
 		return strconv.FormatInt(rv.Int(), 10), nil
 	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
 		return strconv.FormatUint(rv.Uint(), 10), nil
 	case reflect.Float32, reflect.Float64:
-		return strconv.FormatFloat(rv.Float(), 'f', -1, 64), nil
+		return formatFloat(rv.Float(), opts)
 	}
 
-	return "", errors.New("urlenc: unsupported type to convert: " + rv.Type().String())
+	return "", fmt.Errorf("urlenc: %w to convert: %s", ErrUnsupportedType, rv.Type())
 }
 
-func convertFromString(k reflect.Kind, v string) (reflect.Value, error) {
-	switch k {
+// stringerValue returns the result of String() if rv implements
+// fmt.Stringer, as a last resort for values that could not be converted
+// otherwise. Booleans, strings, and numbers keep their built-in form even
+// if they implement fmt.Stringer, so that they can be decoded again
+func stringerValue(rv reflect.Value) (string, bool) {
+	if isStringOrNumeric(rv.Kind()) {
+		return "", false
+	}
+	if rv.Type().Implements(stringerif) {
+		if rv.Kind() == reflect.Ptr && rv.IsNil() {
+			return "", false
+		}
+		return rv.Interface().(fmt.Stringer).String(), true
+	}
+	if rv.CanAddr() && rv.Addr().Type().Implements(stringerif) {
+		return rv.Addr().Interface().(fmt.Stringer).String(), true
+	}
+	return "", false
+}
+
+// errSkipValue is returned by convertToString when the value should not
+// be added to the query at all
+var errSkipValue = errors.New("skip value")
+
+func formatFloat(f float64, opts *options) (string, error) {
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		switch opts.nonFinitePolicy {
+		case NonFiniteError:
+			return "", fmt.Errorf("urlenc: non-finite float value %v", f)
+		case NonFiniteSkip:
+			return "", errSkipValue
+		case NonFiniteEmpty:
+			return "", nil
+		}
+	}
+
+	s := strconv.FormatFloat(f, 'f', opts.floatPrecision, 64)
+	if opts.floatRoundTripCheck {
+		parsed, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return "", fmt.Errorf("urlenc: failed to re-parse formatted float %q: %w", s, err)
+		}
+		if parsed != f && !(math.IsNaN(parsed) && math.IsNaN(f)) {
+			return "", fmt.Errorf("urlenc: float value %v does not round-trip when formatted as %q", f, s)
+		}
+	}
+	return s, nil
+}
+
+func convertFromString(t reflect.Type, v string) (reflect.Value, error) {
+	if c, ok := lookupConverter(t); ok {
+		return c.decode(v)
+	}
+	if e, ok := enums.Lookup(t); ok {
+		return e.FromName(v)
+	}
+	if tv, ok, err := unmarshalText(t, v); ok {
+		return tv, err
+	}
+
+	switch k := t.Kind(); k {
 	case reflect.Bool:
 		bv, err := strconv.ParseBool(v)
 		if err != nil {
@@ -190,8 +374,151 @@ func convertFromString(k reflect.Kind, v string) (reflect.Value, error) {
 		}
 		return reflect.ValueOf(float32(nv)), nil
 	default:
-		return zeroval, errors.New("unsupported type")
+		return zeroval, fmt.Errorf("urlenc: %w to convert to: %s", ErrUnsupportedType, k)
+	}
+}
+
+// decodeString is the same as convertFromString, but allows options to
+// tweak how the value is interpreted
+func decodeString(t reflect.Type, v string, opts *options) (reflect.Value, error) {
+	if len(opts.timeLayouts) > 0 && t == timeType {
+		return parseTime(v, opts.timeLayouts)
+	}
+	if opts.flagBooleans && v == "" && t.Kind() == reflect.Bool {
+		// The key is present without a value, like "?active"
+		return reflect.ValueOf(true), nil
+	}
+	if opts.numberParser != nil && isNumberKind(t.Kind()) && !isCustomScalar(t) {
+		return parseNumber(t.Kind(), v, opts.numberParser)
+	}
+
+	rv, err := convertFromString(t, v)
+	if err != nil {
+		return zeroval, err
+	}
+	if opts.strictTypes {
+		if err := checkStrict(t, v, opts); err != nil {
+			return zeroval, err
+		}
+	}
+	return rv, nil
+}
+
+// parseNumber parses v using fn, and converts the result to the built-in
+// type for kind
+func parseNumber(kind reflect.Kind, v string, fn NumberParser) (reflect.Value, error) {
+	n, err := fn(kind, v)
+	if err != nil {
+		return zeroval, err
+	}
+
+	rv := reflect.ValueOf(n)
+	bt := _nameToType[kind.String()]
+	if !rv.IsValid() || !isNumberKind(rv.Kind()) || !rv.Type().ConvertibleTo(bt) {
+		return zeroval, fmt.Errorf("urlenc: number parser returned %T for %s", n, kind)
+	}
+	// Convert silently truncates and wraps around, so check first
+	if err := checkNumberRange(rv, bt); err != nil {
+		return zeroval, fmt.Errorf("urlenc: number parser returned %v for %s: %w", n, kind, err)
+	}
+	return rv.Convert(bt), nil
+}
+
+// checkNumberRange returns an error if the number rv can not be converted
+// to the number type bt without losing information
+func checkNumberRange(rv reflect.Value, bt reflect.Type) error {
+	out := reflect.New(bt).Elem()
+	var overflow bool
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n := rv.Int()
+		switch out.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			overflow = out.OverflowInt(n)
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			overflow = n < 0 || out.OverflowUint(uint64(n))
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n := rv.Uint()
+		switch out.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			overflow = n > math.MaxInt64 || out.OverflowInt(int64(n))
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			overflow = out.OverflowUint(n)
+		}
+	case reflect.Float32, reflect.Float64:
+		f := rv.Float()
+		switch out.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			if f != math.Trunc(f) {
+				return errNotIntegral
+			}
+			// -2^63 <= f < 2^63 is the range of int64
+			overflow = f < -(1<<63) || f >= 1<<63 || out.OverflowInt(int64(f))
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			if f != math.Trunc(f) {
+				return errNotIntegral
+			}
+			overflow = f < 0 || f >= 1<<64 || out.OverflowUint(uint64(f))
+		case reflect.Float32, reflect.Float64:
+			overflow = out.OverflowFloat(f)
+		}
+	}
+	if overflow {
+		return strconv.ErrRange
+	}
+	return nil
+}
+
+var errNotIntegral = errors.New("value is not an integer")
+
+func isNumberKind(k reflect.Kind) bool {
+	return k != reflect.String && k != reflect.Bool && isStringOrNumeric(k)
+}
+
+// isCustomScalar returns true if values of type t are not converted
+// based on their kind, but by a converter, an enum, or the type itself
+func isCustomScalar(t reflect.Type) bool {
+	if _, ok := lookupConverter(t); ok {
+		return true
+	}
+	if _, ok := enums.Lookup(t); ok {
+		return true
+	}
+	return isTextType(t)
+}
+
+// checkStrict verifies that v, which has already been successfully
+// converted to type t, is in the form that Marshal would produce
+func checkStrict(t reflect.Type, v string, opts *options) error {
+	if isCustomScalar(t) {
+		return nil
+	}
+
+	var ok bool
+	switch t.Kind() {
+	case reflect.Bool:
+		if opts.numericBooleans {
+			ok = v == "1" || v == "0"
+		} else {
+			ok = v == "true" || v == "false"
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, _ := strconv.ParseInt(v, 10, 64)
+		ok = strconv.FormatInt(n, 10) == v
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, _ := strconv.ParseUint(v, 10, 64)
+		ok = strconv.FormatUint(n, 10) == v
+	case reflect.Float32, reflect.Float64:
+		f, _ := strconv.ParseFloat(v, 64)
+		ok = !math.IsNaN(f) && !math.IsInf(f, 0) && !strings.ContainsAny(v, "xXpP_")
+	default:
+		ok = true
+	}
+	if !ok {
+		return fmt.Errorf("urlenc: %w: %q for %s", ErrStrictType, v, t)
 	}
+	return nil
 }
 
 var _nameToType map[string]reflect.Type
@@ -211,6 +538,7 @@ func init() {
 	_nameToType["uint64"] = reflect.TypeOf(uint64(0))
 	_nameToType["float32"] = reflect.TypeOf(float32(0))
 	_nameToType["float64"] = reflect.TypeOf(float64(0))
+	_nameToType["time"] = timeType
 }
 func nameToType(s string, recurse bool) reflect.Type {
 	if strings.HasPrefix(s, "[]") {
@@ -228,30 +556,197 @@ func nameToType(s string, recurse bool) reflect.Type {
 
 var wssplitRx = regexp.MustCompile(`\s+`)
 
-func (tkm type2fields) getStructFields(t reflect.Type) ([]structfield, error) {
+// getStructFields returns the fields for struct type t. Fields of
+// unsupported types result in an error, unless WithSkipUnsupportedFields
+// is given, in which case they are left out
+func (tkm *type2fields) getStructFields(t reflect.Type, opts *options) ([]structfield, error) {
+	km, err := tkm.lookup(t, opts.tagName)
+	if err != nil {
+		return nil, err
+	}
+
+	var supported []structfield
+	for i, f := range km {
+		if !f.Unsupported {
+			if supported != nil {
+				supported = append(supported, f)
+			}
+			continue
+		}
+		if !opts.skipUnsupportedFields && !(opts.ignoreUnsupportedKinds && isIgnorableKind(f.Type.Kind())) {
+			return nil, fmt.Errorf("urlenc: %w on struct field %s: %s", ErrUnsupportedType, f.FieldName, f.Type)
+		}
+		if supported == nil {
+			supported = make([]structfield, i, len(km))
+			copy(supported, km[:i])
+		}
+	}
+	if supported != nil {
+		return supported, nil
+	}
+	return km, nil
+}
+
+// isIgnorableKind returns true for kinds that can never be represented in
+// a query, and are skipped by WithIgnoreUnsupportedKinds
+func isIgnorableKind(k reflect.Kind) bool {
+	switch k {
+	case reflect.Chan, reflect.Func, reflect.UnsafePointer:
+		return true
+	}
+	return false
+}
+
+// lookup returns the fields for struct type t from the cache, computing
+// them if necessary. tagName is the struct tag to use, with an empty
+// string meaning the default of "urlenc" falling back to "json"
+func (tkm *type2fields) lookup(t reflect.Type, tagName string) ([]structfield, error) {
 	if t.Kind() != reflect.Struct {
 		return nil, errors.New("target is not a struct (Kind: " + t.Kind().String() + ")")
 	}
 
+	key := fieldsKey{Type: t, TagName: tagName}
 	tkm.lock.RLock()
-
-	km, ok := tkm.types[t]
+	km, ok := tkm.types[key]
+	tkm.lock.RUnlock()
 	if ok {
-		tkm.lock.RUnlock()
 		return km, nil
 	}
 
 	// the fields did not exist in the registry. create and register
-	km = make([]structfield, 0, t.NumField())
+	km, err := buildStructFields(t, nil, tagName)
+	if err != nil {
+		return nil, err
+	}
+	km = removeAmbiguousFields(km)
+
+	tkm.lock.Lock()
+	defer tkm.lock.Unlock()
+
+	// Another goroutine may have registered the fields while we were
+	// building them. Use theirs, so that all callers see the same slice
+	if existing, ok := tkm.types[key]; ok {
+		return existing, nil
+	}
+	tkm.types[key] = km
+	return km, nil
+}
+
+// embeddedStruct returns the struct type of f, if f is an embedded struct
+// (or a pointer to one) whose fields should be promoted
+func embeddedStruct(f reflect.StructField) (reflect.Type, bool) {
+	if !f.Anonymous || f.Tag != "" {
+		return nil, false
+	}
+	if _, ok := lookupConverter(f.Type); ok || isValuesSetter(f.Type) || isTextType(f.Type) || isQueryType(f.Type) {
+		return nil, false
+	}
+
+	t := f.Type
+	if t.Kind() == reflect.Ptr {
+		if f.PkgPath != "" {
+			// We can not allocate unexported pointers
+			return nil, false
+		}
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		return nil, false
+	}
+	return t, true
+}
+
+// nestedStruct returns the struct type of a field of type ft (or a
+// pointer to one), if its fields should be flattened. fieldtype is the
+// type of the field as given in the struct tag. Structs that encode
+// themselves, or that were given a different type, are left alone
+func nestedStruct(ft, fieldtype reflect.Type) (reflect.Type, bool) {
+	if ft != fieldtype || isScalar(ft) || isValuesSetter(ft) || isQueryType(ft) {
+		return nil, false
+	}
+
+	t := ft
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct || isScalar(t) {
+		return nil, false
+	}
+	if pt := reflect.PtrTo(t); pt.Implements(valuerif) || pt.Implements(errvaluerif) || pt.Implements(setterif) {
+		return nil, false
+	}
+	return t, true
+}
+
+// isScalarPointer returns true if t is a pointer to a scalar type, such as
+// *int, that is not handled by a converter as a whole
+func isScalarPointer(t reflect.Type) bool {
+	return t.Kind() == reflect.Ptr && isScalar(t.Elem()) && !isScalar(t)
+}
+
+func containsType(list []reflect.Type, t reflect.Type) bool {
+	for _, v := range list {
+		if v == t {
+			return true
+		}
+	}
+	return false
+}
+
+// buildStructFields computes the fields for struct type t. Fields of
+// embedded structs are promoted, unless a field with the same key name
+// exists in t itself. parents holds the embedding structs, and is used
+// to stop recursive embedding. tagName is the same as in lookup
+func buildStructFields(t reflect.Type, parents []reflect.Type, tagName string) ([]structfield, error) {
+	candidates := []string{"urlenc", "json"}
+	if tagName != "" {
+		candidates = []string{tagName}
+	}
+
+	km := make([]structfield, 0, t.NumField())
+	var promoted []structfield
+	var hasCatchAll bool
 	for i := 0; i < t.NumField(); i++ {
 		f := t.Field(i)
+		if et, ok := embeddedStruct(f); ok {
+			if containsType(append(parents, t), et) {
+				continue
+			}
+
+			fields, err := buildStructFields(et, append(parents, t), tagName)
+			if err != nil {
+				return nil, err
+			}
+			for _, sf := range fields {
+				sf.Index = append([]int{i}, sf.Index...)
+				promoted = append(promoted, sf)
+			}
+			continue
+		}
+
 		if f.PkgPath != "" {
 			// If PkgPath is non empty, then it's an unexported field
 			continue
 		}
 
+		// An embedded map without a tag collects the keys that no other
+		// field claims, e.g. `type Extras map[string][]string`
+		catchall := f.Anonymous && f.Tag == "" && f.Type.Kind() == reflect.Map
+		if catchall {
+			if hasCatchAll {
+				return nil, fmt.Errorf("urlenc: multiple embedded maps in %s", t)
+			}
+			hasCatchAll = true
+		}
+
 		var keyname string
+		var inkeyname, outkeyname string
 		var omitempty bool
+		var csv bool
+		var batch bool
+		var encoding string
+		var split string
+		var layouts []string
 		fieldtype := f.Type
 		if f.Tag == "" {
 			// no tag at all. Use the name of the field as-is
@@ -272,7 +767,7 @@ func (tkm type2fields) getStructFields(t reflect.Type) ([]structfield, error) {
 			var tagname string
 			possibletags := wssplitRx.Split(string(f.Tag), -1)
 		OUTER:
-			for _, candidate := range []string{"urlenc", "json"} {
+			for _, candidate := range candidates {
 				for _, target := range possibletags {
 					if strings.HasPrefix(target, candidate+":") {
 						tagname = candidate
@@ -282,57 +777,240 @@ func (tkm type2fields) getStructFields(t reflect.Type) ([]structfield, error) {
 			}
 
 			st := f.Tag.Get(tagname)
+			if st == "-" {
+				// ignore this field
+				continue
+			}
+
 			if st == "" {
 				// tag exists, but is empty. Use the name of the field as-is
 				keyname = f.Name
+			} else {
+				// urlenc:"foo,omitempty,<type>"
+				//
+				// Options in the form of key=value may appear anywhere, and
+				// are taken out before the positional parts are looked at.
+				// An option in the first position takes the place of the name
+				var parts []string
+				for i, part := range strings.Split(st, ",") {
+					part = strings.TrimSpace(part)
+					eq := strings.IndexByte(part, '=')
+					if eq < 0 {
+						parts = append(parts, part)
+						continue
+					}
+
+					if i == 0 {
+						parts = append(parts, f.Name)
+					}
+					switch k, v := part[:eq], part[eq+1:]; k {
+					case "in":
+						inkeyname = v
+					case "out":
+						outkeyname = v
+					case "encoding":
+						encoding = v
+					case "split":
+						split = v
+					case "layout", "layouts":
+						layouts = parseLayouts(v)
+					}
+				}
+
+				for i := 1; i < len(parts); i++ {
+					switch part := parts[i]; part {
+					case "omitempty":
+						omitempty = true
+					case "csv":
+						csv = true
+					case "batch":
+						batch = true
+					default:
+						if strings.HasPrefix(part, "layout:") {
+							// urlenc:"created,layout:2006-01-02"
+							layouts = parseLayouts(strings.TrimPrefix(part, "layout:"))
+							continue
+						}
+						if i != 2 || part == "" {
+							continue
+						}
+						fieldtype = nameToType(part, false)
+						if fieldtype == nil {
+							return nil, fmt.Errorf("urlenc: %w from struct tag: '%s'", ErrUnsupportedType, part)
+						}
+					}
+				}
+				keyname = parts[0]
+				if keyname == "" {
+					// e.g. urlenc:",omitempty"
+					keyname = f.Name
+				}
 			}
+		}
 
-			if st == "-" {
-				// ignore this field
+		if inkeyname == "" {
+			inkeyname = keyname
+		}
+		if outkeyname == "" {
+			outkeyname = keyname
+		}
+
+		nullable := f.Type.Kind() == reflect.Ptr && !omitempty
+		if fieldtype == f.Type && isScalarPointer(fieldtype) {
+			// Pointers to scalars are optional values. nil pointers are
+			// always left out, and pointers are allocated when decoding
+			fieldtype = fieldtype.Elem()
+			omitempty = true
+		}
+
+		if st, ok := nestedStruct(f.Type, fieldtype); ok {
+			// The fields of the struct are given as key.subkey=value
+			if containsType(append(parents, t), st) {
 				continue
 			}
 
-			// urlenc:"foo,omitempty,<type>"
-			parts := strings.SplitN(st, ",", 3)
-			if len(parts) > 2 {
-				var err error
-				name := strings.TrimSpace(parts[2])
-				fieldtype = nameToType(name, false)
-				if err != nil {
-					return nil, errors.New("urlenc: unsupported type from struct tag: '" + name + "'")
+			fields, err := buildStructFields(st, append(parents, t), tagName)
+			if err != nil {
+				return nil, err
+			}
+			for _, sf := range fields {
+				if sf.CatchAll {
+					// Only the top-level struct may catch unclaimed keys
+					continue
 				}
+				sf.Index = append([]int{i}, sf.Index...)
+				sf.KeyName = keyname + "." + sf.KeyName
+				sf.InKeyName = inkeyname + "." + sf.InKeyName
+				sf.OutKeyName = outkeyname + "." + sf.OutKeyName
+				sf.OmitEmpty = sf.OmitEmpty || omitempty
+				km = append(km, sf)
 			}
+			continue
+		}
 
-			if len(parts) > 1 {
-				if strings.TrimSpace(parts[1]) == "omitempty" {
-					omitempty = true
-				}
+		// strings, numbers, and slices of those two are allowed, as well as
+		// anything that can decode its own subset of the query
+		valuessetter := isValuesSetter(f.Type)
+		querytype := !valuessetter && fieldtype == f.Type && isQueryType(f.Type)
+		if ok := valuessetter || querytype || isSupportedType(fieldtype, true); !ok {
+			// Whether this is an error depends on the options given by
+			// the caller, so it is decided in getStructFields
+			km = append(km, structfield{
+				FieldName:   f.Name,
+				KeyName:     keyname,
+				InKeyName:   keyname,
+				OutKeyName:  keyname,
+				Unsupported: true,
+				Index:       []int{i},
+				Type:        f.Type,
+			})
+			continue
+		}
+
+		if encoding == "" && !csv && split == "" && fieldtype == f.Type && isDefaultBase64(f.Type) {
+			// []byte is given as a single base64url value, instead of
+			// a value for each byte
+			encoding = "base64"
+		}
+
+		if encoding != "" {
+			if err := checkEncoding(fieldtype, encoding); err != nil {
+				return nil, fmt.Errorf("urlenc: invalid encoding for struct field %s: %w", f.Name, err)
 			}
-			keyname = strings.TrimSpace(parts[0])
 		}
 
-		// strings, numbers, and slices of those two are allowed
-		if ok := isSupportedType(fieldtype, true); !ok {
-			return nil, errors.New("urlenc: unsupported type on struct field " + f.Name + ": " + f.Type.String())
+		if layouts != nil {
+			if !isTimeType(fieldtype) {
+				return nil, fmt.Errorf("urlenc: layouts for struct field %s require a time.Time field or a slice of them (got %s)", f.Name, fieldtype)
+			}
+			if err := checkLayouts(layouts); err != nil {
+				return nil, fmt.Errorf("urlenc: invalid layouts for struct field %s: %w", f.Name, err)
+			}
 		}
 
 		sf := structfield{
-			FieldName: f.Name,
-			KeyName:   keyname,
-			OmitEmpty: omitempty,
-			Type:      fieldtype,
+			FieldName:    f.Name,
+			KeyName:      keyname,
+			InKeyName:    inkeyname,
+			OutKeyName:   outkeyname,
+			OmitEmpty:    omitempty,
+			Nullable:     nullable && !valuessetter && !querytype && isScalar(fieldtype),
+			CSV:          csv,
+			Encoding:     encoding,
+			Split:        split,
+			Layouts:      layouts,
+			Batch:        batch,
+			ValuesSetter: valuessetter,
+			QueryType:    querytype,
+			Embedded:     querytype && f.Anonymous && f.Tag == "",
+			CatchAll:     catchall,
+			Index:        []int{i},
+			Type:         fieldtype,
 		}
+		sf.PlainString = isPlainString(f, sf)
 		km = append(km, sf)
 	}
 
-	tkm.lock.RUnlock()
-	tkm.lock.Lock()
-	defer tkm.lock.Unlock()
-
-	tkm.types[t] = km
+	// Promoted fields are shadowed by fields with the same key, just like
+	// Go shadows promoted fields with the same name. Among the promoted
+	// fields, the shallower one wins. Fields at the same depth are
+	// ambiguous, and like in Go (and encoding/json), none of them is used
+	sort.SliceStable(promoted, func(i, j int) bool {
+		return len(promoted[i].Index) < len(promoted[j].Index)
+	})
+	n := len(km)
+	taken := make(map[string]int, len(km))
+	for i, sf := range km {
+		taken[sf.KeyName] = i
+	}
+	for _, sf := range promoted {
+		if sf.CatchAll && hasCatchAll {
+			continue
+		}
+		if i, ok := taken[sf.KeyName]; ok {
+			if i >= n && len(km[i].Index) == len(sf.Index) {
+				km[i].Ambiguous = true
+			}
+			continue
+		}
+		taken[sf.KeyName] = len(km)
+		hasCatchAll = hasCatchAll || sf.CatchAll
+		km = append(km, sf)
+	}
 	return km, nil
 }
 
+// removeAmbiguousFields returns the fields in km that are not ambiguous
+func removeAmbiguousFields(km []structfield) []structfield {
+	fields := km[:0]
+	for _, sf := range km {
+		if !sf.Ambiguous {
+			fields = append(fields, sf)
+		}
+	}
+	return fields
+}
+
+// fieldByIndex is like reflect.Value.FieldByIndex, but instead of
+// panicking when stepping through a nil pointer to an embedded struct, it
+// either allocates the struct (if alloc is true and the pointer can be
+// set), or returns an invalid value
+func fieldByIndex(rv reflect.Value, index []int, alloc bool) reflect.Value {
+	for i, x := range index {
+		if i > 0 && rv.Kind() == reflect.Ptr {
+			if rv.IsNil() {
+				if !alloc || !rv.CanSet() {
+					return zeroval
+				}
+				rv.Set(reflect.New(rv.Type().Elem()))
+			}
+			rv = rv.Elem()
+		}
+		rv = rv.Field(x)
+	}
+	return rv
+}
+
 type Marshaler interface {
 	MarshalURL() ([]byte, error)
 }
@@ -344,150 +1022,554 @@ type Unmarshaler interface {
 // Marshal encodes the given value into a query string. Only structs and maps
 // with string keys and several types of types as values are supported.
 func Marshal(v interface{}) ([]byte, error) {
+	return MarshalWithOptions(v)
+}
+
+// MarshalWithOptions is the same as Marshal, but allows the caller to
+// tweak the encoding behavior via options.
+func MarshalWithOptions(v interface{}, options ...Option) ([]byte, error) {
 	if u, ok := v.(Marshaler); ok {
 		return u.MarshalURL()
 	}
 
-	rv := reflect.ValueOf(v)
-	if rv == zeroval {
-		return nil, errors.New("can not unmarshal into a nil value")
+	opts := newOptions(options)
+	uv, err := marshalValues(v, opts)
+	if err != nil {
+		return nil, err
 	}
+	return encodeValues(uv, opts)
+}
 
-	// This better be a pointer
-	switch rv.Kind() {
-	case reflect.Ptr, reflect.Interface:
-		// Get the value beyond the pointer
-		rv = rv.Elem()
+// MarshalAppend is the same as MarshalWithOptions, but appends the query
+// string to dst and returns the extended buffer, like the Append* functions
+// in the strconv package. Reusing dst avoids allocating a new buffer
+// for every call when building many queries. On error, dst is returned
+// with its original contents, so it can still be reused.
+func MarshalAppend(dst []byte, v interface{}, options ...Option) ([]byte, error) {
+	if u, ok := v.(Marshaler); ok {
+		buf, err := u.MarshalURL()
+		if err != nil {
+			return dst, err
+		}
+		return append(dst, buf...), nil
 	}
 
-	switch rv.Kind() {
-	case reflect.Map:
-		if kk := rv.Type().Key().Kind(); kk != reflect.String {
-			return nil, errors.New("urlenc.Marshal: map key must be string type (Kind: " + kk.String() + ")")
-		}
-		return marshalMap(rv)
-	case reflect.Struct:
-		return marshalStruct(rv)
-	default:
-		return nil, errors.New("urlenc.Marshal: unsupported type (" + rv.Type().String() + ")")
+	opts := newOptions(options)
+	uv, err := marshalValues(v, opts)
+	if err != nil {
+		return dst, err
 	}
+	return appendEncodedValues(dst, uv, opts)
 }
 
-func addValue(uv *url.Values, name string, fv reflect.Value, ft reflect.Type) error {
-	if mv := getValuerMethod(fv); mv != zeroval {
-		out := mv.Call(nil)
-		fv = out[0]
-		switch fv.Kind() {
-		case reflect.Ptr, reflect.Interface:
+// MarshalValues is the same as MarshalWithOptions, but returns the result
+// as url.Values instead of an encoded query string. This is useful for
+// adding more parameters before building a request.
+func MarshalValues(v interface{}, options ...Option) (url.Values, error) {
+	if u, ok := v.(Marshaler); ok {
+		buf, err := u.MarshalURL()
+		if err != nil {
+			return nil, err
+		}
+		uv, err := url.ParseQuery(string(buf))
+		if err != nil {
+			return nil, fmt.Errorf("urlenc.MarshalValues: failed to parse result of MarshalURL: %w", err)
+		}
+		return uv, nil
+	}
+
+	opts := newOptions(options)
+	uv, err := marshalValues(v, opts)
+	if err != nil {
+		return nil, err
+	}
+	if opts.errorOnEmptyOutput && len(uv) == 0 {
+		return nil, fmt.Errorf("urlenc.Marshal: %w", ErrEmptyOutput)
+	}
+	if opts.sortValues {
+		sortValueLists(uv)
+	}
+	return uv, nil
+}
+
+// ExtractValues returns the query parameters for v as url.Values. It is
+// the same as MarshalValues without any options, and is the counterpart
+// of BindValues.
+func ExtractValues(v interface{}) (url.Values, error) {
+	return MarshalValues(v)
+}
+
+func marshalValues(v interface{}, opts *options) (url.Values, error) {
+	rv := reflect.ValueOf(v)
+	if rv == zeroval {
+		return nil, fmt.Errorf("urlenc.Marshal: can not marshal a %w", ErrNilValue)
+	}
+
+	// This better be a pointer
+	switch rv.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		// Get the value beyond the pointer
+		rv = rv.Elem()
+		if !rv.IsValid() {
+			return nil, fmt.Errorf("urlenc.Marshal: can not marshal a %w (nil pointer)", ErrNilValue)
+		}
+	}
+
+	var uv url.Values
+	var err error
+	switch rv.Kind() {
+	case reflect.Map:
+		if kt := rv.Type().Key(); !isMarshalMapKey(kt) {
+			return nil, fmt.Errorf("urlenc.Marshal: %w (Kind: %s)", ErrNonStringMapKey, kt.Kind())
+		}
+		uv, err = marshalMap(rv, opts)
+	case reflect.Struct:
+		uv, err = marshalStruct(rv, opts)
+	default:
+		return nil, fmt.Errorf("urlenc.Marshal: %w (%s)", ErrUnsupportedType, rv.Type())
+	}
+	if err != nil {
+		return nil, err
+	}
+	return uv, nil
+}
+
+// sortValueLists sorts the values for each key in uv, in place
+func sortValueLists(uv url.Values) {
+	for _, list := range uv {
+		sort.Strings(list)
+	}
+}
+
+// addValue adds the value(s) in fv to uv. If sep is non-empty, slice
+// elements are joined using sep into a single value, instead of being
+// added as repeated keys. omitempty controls what happens when a Valuer
+// returns a nil value: it is either skipped, or added as an empty value
+func addValue(uv *url.Values, name string, fv reflect.Value, ft reflect.Type, sep string, omitempty bool, opts *options) error {
+	// Pointers are followed, unless a converter handles the pointer type
+	for fv.Kind() == reflect.Ptr {
+		if _, ok := lookupConverter(fv.Type()); ok {
+			break
+		}
+		if fv.IsNil() {
+			// Same as a Valuer returning nil
+			if !omitempty {
+				uv.Add(name, "")
+			}
+			return nil
+		}
+		fv = fv.Elem()
+	}
+
+	var mv reflect.Value
+	if !opts.withoutValuerSetter {
+		mv = getValuerMethod(fv)
+	}
+	if mv != zeroval {
+		out := mv.Call(nil)
+		if len(out) > 1 && !out[1].IsNil() {
+			return fmt.Errorf("urlenc: failed to get value for key %s: %w", name, out[1].Interface().(error))
+		}
+		fv = out[0]
+		for fv.Kind() == reflect.Ptr || fv.Kind() == reflect.Interface {
+			if fv.IsNil() {
+				// The Valuer does not have a value to give us
+				if !omitempty {
+					uv.Add(name, "")
+				}
+				return nil
+			}
 			fv = fv.Elem()
 		}
 	}
 
-	if isStringOrNumeric(ft.Kind()) {
-		s, err := convertToString(fv)
+	if isFlattenedStruct(ft) {
+		// Each field is given as name[field]=value
+		sub, err := marshalNested(fv, opts)
+		if err != nil {
+			return fmt.Errorf("urlenc: failed to encode value for key %s: %w", name, err)
+		}
+		for k, v := range sub {
+			key := joinKeyName(name, k, opts.mapKeyStyle)
+			(*uv)[key] = append((*uv)[key], v...)
+		}
+		return nil
+	}
+
+	if ft.Kind() == reflect.Map {
+		// Each element is given as name[subkey]=value
+		for _, key := range fv.MapKeys() {
+			ev := fv.MapIndex(key)
+			switch ev.Kind() {
+			case reflect.Ptr, reflect.Interface:
+				ev = ev.Elem()
+			}
+			if !ev.IsValid() {
+				continue
+			}
+			if err := addValue(uv, subKeyName(name, key.String(), opts.mapKeyStyle), ev, ev.Type(), "", false, opts); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if isSliceOfMaps(ft) {
+		// Each element is given as name[index][subkey]=value
+		for i := 0; i < fv.Len(); i++ {
+			if err := addValue(uv, name+"["+strconv.Itoa(i)+"]", fv.Index(i), ft.Elem(), "", false, opts); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if isSliceOfSlices(ft) {
+		// Each element is given as name[index][]=value, regardless of
+		// the array format
+		inner := *opts
+		inner.arrayFormat = ArrayFormatRepeat
+		for i := 0; i < fv.Len(); i++ {
+			if err := addValue(uv, name+"["+strconv.Itoa(i)+"][]", fv.Index(i), ft.Elem(), "", false, &inner); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if isScalar(ft) {
+		s, err := convertToString(fv, opts)
 		if err != nil {
-			return err
+			if err == errSkipValue {
+				return nil
+			}
+			return fmt.Errorf("urlenc: failed to encode value for key %s: %w", name, err)
 		}
 		uv.Add(name, s)
 	} else {
+		if sep == "" && opts.arrayFormat == ArrayFormatComma {
+			sep = ","
+		}
+
+		var list []string
 		for i := 0; i < fv.Len(); i++ {
 			ev := fv.Index(i)
-			s, err := convertToString(ev)
+			s, err := convertToString(ev, opts)
 			if err != nil {
-				return err
+				if err == errSkipValue {
+					continue
+				}
+				return fmt.Errorf("urlenc: failed to encode element %d for key %s: %w", i, name, err)
+			}
+			switch {
+			case sep != "":
+				list = append(list, s)
+			case opts.arrayFormat == ArrayFormatBrackets:
+				uv.Add(name+"[]", s)
+			case opts.arrayFormat == ArrayFormatIndices:
+				uv.Add(name+"["+strconv.Itoa(i)+"]", s)
+			default:
+				uv.Add(name, s)
 			}
-			uv.Add(name, s)
+		}
+		if len(list) > 0 {
+			uv.Add(name, strings.Join(list, sep))
 		}
 	}
 	return nil
 }
 
-func marshalMap(rv reflect.Value) ([]byte, error) {
+// isEmptyValue returns true if fv is equal to the zero value of its type,
+// which is when omitempty drops it
+func isEmptyValue(fv reflect.Value) bool {
+	if !fv.IsValid() {
+		return true
+	}
+
+	switch ft := fv.Type(); ft.Kind() {
+	case reflect.Chan, reflect.Func, reflect.Interface, reflect.Map, reflect.Ptr, reflect.Slice:
+		return fv.IsNil()
+	case reflect.Struct:
+		if z, ok := fv.Interface().(interface{ IsZero() bool }); ok {
+			// e.g. time.Time, whose zero value may carry a location
+			return z.IsZero()
+		}
+		if fv.Type().Comparable() {
+			if fv.Interface() == reflect.Zero(ft).Interface() {
+				return true
+			}
+		}
+		return reflect.DeepEqual(fv.Interface(), reflect.Zero(ft).Interface())
+	default:
+		return fv.CanInterface() && fv.Interface() == reflect.Zero(ft).Interface()
+	}
+}
+
+// isEmptyField is the same as isEmptyValue, except that with
+// WithValuerOmitEmpty, the emptiness of a Valuer is decided by the value
+// that it returns
+func isEmptyField(fv reflect.Value, opts *options) bool {
+	if !opts.valuerOmitEmpty || opts.withoutValuerSetter {
+		return isEmptyValue(fv)
+	}
+	if (fv.Kind() == reflect.Ptr || fv.Kind() == reflect.Interface) && fv.IsNil() {
+		// There is nothing to call Value on
+		return isEmptyValue(fv)
+	}
+
+	mv := getValuerMethod(fv)
+	if mv == zeroval {
+		return isEmptyValue(fv)
+	}
+
+	out := mv.Call(nil)
+	if len(out) > 1 && !out[1].IsNil() {
+		// Let addValue report the error
+		return false
+	}
+	v := out[0]
+	for v.Kind() == reflect.Interface {
+		v = v.Elem()
+	}
+	return isEmptyValue(v)
+}
+
+var stringerif = reflect.TypeOf((*fmt.Stringer)(nil)).Elem()
+
+// isMarshalMapKey returns true if map keys of type t can be encoded. Keys
+// of string kind are used as is, and other keys must implement fmt.Stringer
+func isMarshalMapKey(t reflect.Type) bool {
+	return t.Kind() == reflect.String || t.Implements(stringerif)
+}
+
+// mapKeyString returns the name for the map key key. Like encoding/json,
+// keys of string kind are used as is even if they implement fmt.Stringer.
+// nil pointer and interface keys are reported as errors
+func mapKeyString(key reflect.Value) (string, error) {
+	switch key.Kind() {
+	case reflect.String:
+		return key.String(), nil
+	case reflect.Ptr, reflect.Interface:
+		// There is nothing to call String on
+		if key.IsNil() {
+			return "", fmt.Errorf("urlenc.Marshal: can not marshal a %w map key (%s)", ErrNilValue, key.Type())
+		}
+	}
+	return key.Interface().(fmt.Stringer).String(), nil
+}
+
+func marshalMap(rv reflect.Value, opts *options) (url.Values, error) {
 	if rv.Kind() != reflect.Map {
 		return nil, errors.New("target is not a map (Kind: " + rv.Kind().String() + ")")
 	}
 
 	uv := url.Values{}
 	for _, key := range rv.MapKeys() {
+		name, err := mapKeyString(key)
+		if err != nil {
+			return nil, err
+		}
 		fv := rv.MapIndex(key)
 		switch fv.Kind() {
 		case reflect.Ptr, reflect.Interface:
 			fv = fv.Elem()
 		}
 
-		if ok := isSupportedType(fv.Type(), true); !ok {
-			return nil, errors.New("urlenc: unsupported type on map element " + key.String() + " (" + fv.Type().String() + ")")
+		if opts.mapOmitEmpty && isEmptyValue(fv) {
+			continue
+		}
+		if !fv.IsValid() {
+			// nil pointer or interface
+			continue
+		}
+
+		if ok := isFlattenedStruct(fv.Type()) || isSupportedType(fv.Type(), true); !ok {
+			return nil, fmt.Errorf("urlenc: %w on map element %s (%s)", ErrUnsupportedType, name, fv.Type())
 		}
 
-		if err := addValue(&uv, key.String(), fv, fv.Type()); err != nil {
-			return nil, err
+		if err := addValue(&uv, opts.mapKeyPrefix+name, fv, fv.Type(), "", opts.mapOmitEmpty, opts); err != nil {
+			return nil, fmt.Errorf("urlenc.Marshal: %w", err)
 		}
 	}
-	return []byte(uv.Encode()), nil
+	return uv, nil
 }
 
-func marshalStruct(rv reflect.Value) ([]byte, error) {
-	fields, err := t2f.getStructFields(rv.Type())
+func marshalStruct(rv reflect.Value, opts *options) (url.Values, error) {
+	fields, err := t2f.getStructFields(rv.Type(), opts)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("urlenc.Marshal: %w", err)
 	}
 
+	plain := plainStringsEnabled(opts, true)
 	uv := url.Values{}
 	for _, f := range fields {
-		fv := rv.FieldByName(f.FieldName)
+		fv := fieldByIndex(rv, f.Index, false)
+		if !fv.IsValid() {
+			// The field is in a nil embedded struct
+			continue
+		}
+		if plain && f.PlainString {
+			marshalPlainString(uv, f, fv)
+			continue
+		}
+		if err := marshalField(&uv, f, fv, opts); err != nil {
+			return nil, err
+		}
+	}
+	return uv, nil
+}
+
+// marshalField adds the value of the struct field f, whose value is fv, to uv
+func marshalField(uv *url.Values, f structfield, fv reflect.Value, opts *options) error {
+	if f.Nullable && opts.nullMarker != "" && fv.IsNil() {
+		uv.Add(f.OutKeyName, opts.nullMarker)
+		return nil
+	}
+
+	// Check for empty values
+	if f.OmitEmpty && isEmptyField(fv, opts) {
+		return nil
+	}
 
-		// Check for empty values
-		if f.OmitEmpty {
-			if !fv.IsValid() {
+	if f.CatchAll {
+		// Each element is given as a top-level key
+		for _, key := range fv.MapKeys() {
+			ev := reflect.Indirect(fv.MapIndex(key))
+			if ev.Kind() == reflect.Interface {
+				ev = ev.Elem()
+			}
+			if !ev.IsValid() {
 				continue
 			}
+			if err := addValue(uv, key.String(), ev, ev.Type(), "", false, opts); err != nil {
+				return fmt.Errorf("urlenc.Marshal: failed to marshal field %s: %w", f.FieldName, err)
+			}
+		}
+		return nil
+	}
 
-			switch ft := fv.Type(); ft.Kind() {
-			case reflect.Chan, reflect.Func, reflect.Interface, reflect.Map, reflect.Ptr, reflect.Slice:
-				if fv.IsNil() {
-					continue
-				}
-			case reflect.Struct:
-				if fv.Type().Comparable() {
-					if fv.Interface() == reflect.Zero(ft).Interface() {
-						continue
-					}
-				}
-				if reflect.DeepEqual(fv.Interface(), reflect.Zero(ft).Interface()) {
-					continue
-				}
-			default:
-				switch {
-				case fv == zeroval:
-					continue
-				case fv.CanInterface() && fv.Interface() == reflect.Zero(ft).Interface():
-					continue
-				}
+	if f.QueryType {
+		fv = reflect.Indirect(fv)
+		if !fv.IsValid() {
+			return nil
+		}
+		sub, err := marshalNested(fv, opts)
+		if err != nil {
+			return fmt.Errorf("urlenc.Marshal: failed to marshal field %s: %w", f.FieldName, err)
+		}
+		for k, v := range sub {
+			if !f.Embedded {
+				k = f.OutKeyName + "." + k
 			}
+			(*uv)[k] = append((*uv)[k], v...)
 		}
+		return nil
+	}
 
-		if err := addValue(&uv, f.KeyName, fv, f.Type); err != nil {
-			return nil, err
+	if f.ValuesSetter && (opts.withoutValuerSetter || getValuerMethod(fv) == zeroval) {
+		return fmt.Errorf("urlenc.Marshal: %w on struct field %s: %s (ValuesSetter without Valuer)", ErrUnsupportedType, f.FieldName, fv.Type())
+	}
+
+	if len(f.Layouts) > 0 {
+		// The time.Time value, or each of the elements of a time.Time
+		// slice, is formatted using the first layout
+		sub := *opts
+		sub.timeLayouts = f.Layouts
+		opts = &sub
+	}
+
+	if f.Encoding != "" {
+		s, err := encodeBytes(fv, f.Encoding)
+		if err != nil {
+			return fmt.Errorf("urlenc.Marshal: failed to marshal field %s: %w", f.FieldName, err)
 		}
+		uv.Add(f.OutKeyName, s)
+		return nil
+	}
+
+	sep := f.Split
+	if sep == "" && f.CSV {
+		sep = ","
+	}
+	if err := addValue(uv, f.OutKeyName, fv, f.Type, sep, f.OmitEmpty, opts); err != nil {
+		return fmt.Errorf("urlenc.Marshal: failed to marshal field %s: %w", f.FieldName, err)
 	}
-	return []byte(uv.Encode()), nil
+	return nil
 }
 
 var zeroval = reflect.Value{}
 
+// UnmarshalStrict is the same as UnmarshalWithOptions with
+// WithDisallowUnknownKeys, WithRequireAllFields, and WithStrictTypes,
+// which is useful for validating API input. Instead of stopping at the
+// first problem, all fields are looked at, and the errors are reported
+// together as a MultiError (see WithCollectErrors). Use errors.Is to check
+// for ErrUnknownKeys, ErrMissingFields, and ErrStrictType (requires Go 1.20
+// or later).
+func UnmarshalStrict(data []byte, v interface{}, options ...Option) error {
+	// options may have spare capacity that belongs to the caller
+	options = append(options[:len(options):len(options)], WithDisallowUnknownKeys(), WithRequireAllFields(), WithStrictTypes(), WithCollectErrors())
+	return UnmarshalWithOptions(data, v, options...)
+}
+
+// Unmarshal decodes the query string in data into v, which must be a
+// pointer to a struct or a map with string keys.
 func Unmarshal(data []byte, v interface{}) error {
+	return UnmarshalWithOptions(data, v)
+}
+
+// UnmarshalWithOptions is the same as Unmarshal, but allows the caller to
+// tweak the decoding behavior via options.
+func UnmarshalWithOptions(data []byte, v interface{}, options ...Option) error {
 	if u, ok := v.(Unmarshaler); ok {
 		return u.UnmarshalURL(data)
 	}
 
+	rv, err := unmarshalTarget(v)
+	if err != nil {
+		return err
+	}
+
+	q, err := url.ParseQuery(string(data))
+	if err != nil {
+		return fmt.Errorf("urlenc.Unmarshal: failed to parse query: %w", err)
+	}
+	return unmarshalValues(q, rv, newOptions(options))
+}
+
+// UnmarshalValues is the same as UnmarshalWithOptions, but decodes from
+// url.Values that have already been parsed, such as those from
+// (*http.Request).Form. uv is not modified.
+func UnmarshalValues(uv url.Values, v interface{}, options ...Option) error {
+	if u, ok := v.(Unmarshaler); ok {
+		return u.UnmarshalURL([]byte(uv.Encode()))
+	}
+
+	rv, err := unmarshalTarget(v)
+	if err != nil {
+		return err
+	}
+	return unmarshalValues(uv, rv, newOptions(options))
+}
+
+// BindValues populates v from values, which are typically taken from
+// (*http.Request).URL.Query() or (*http.Request).Form in an HTTP handler.
+// It is the same as UnmarshalValues without any options.
+func BindValues(values url.Values, v interface{}) error {
+	return UnmarshalValues(values, v)
+}
+
+// unmarshalTarget verifies that v can be unmarshaled into, and returns
+// the value that v points to
+func unmarshalTarget(v interface{}) (reflect.Value, error) {
 	rv := reflect.ValueOf(v)
 	if rv == zeroval {
-		return errors.New("can not unmarshal into a nil value")
+		return zeroval, fmt.Errorf("urlenc.Unmarshal: can not unmarshal into a %w", ErrNilValue)
 	}
 
 	// This better be a pointer
 	if rv.Kind() != reflect.Ptr {
-		return errors.New("pointer value required")
+		return zeroval, fmt.Errorf("urlenc.Unmarshal: %w", ErrNotPointer)
 	}
 
 	// Get the value beyond the pointer
@@ -496,39 +1578,152 @@ func Unmarshal(data []byte, v interface{}) error {
 	switch rv.Kind() {
 	case reflect.Map:
 		if kk := rv.Type().Key().Kind(); kk != reflect.String {
-			return errors.New("urlenc.Unmarshal: map key must be string type (Kind: " + kk.String() + ")")
+			return zeroval, fmt.Errorf("urlenc.Unmarshal: %w (Kind: %s)", ErrNonStringMapKey, kk)
 		}
-		return unmarshalMap(data, rv)
 	case reflect.Struct:
-		return unmarshalStruct(data, rv)
 	default:
-		return errors.New("urlenc.Unmarshal: unsupported type (Kind: " + rv.Kind().String() + ")")
+		return zeroval, fmt.Errorf("urlenc.Unmarshal: %w (Kind: %s)", ErrUnsupportedType, rv.Kind())
 	}
+	return rv, nil
 }
 
-func unmarshalMap(data []byte, rv reflect.Value) error {
-	q, err := url.ParseQuery(string(data))
-	if err != nil {
+func unmarshalValues(q url.Values, rv reflect.Value, opts *options) error {
+	if err := checkQuery(q, opts); err != nil {
 		return err
 	}
+	if opts.stripBracketSuffix {
+		q = stripBracketSuffixes(q)
+	}
+
+	if rv.Kind() == reflect.Map {
+		return unmarshalMap(q, rv, opts)
+	}
+	return unmarshalStruct(q, rv, opts)
+}
+
+// checkQuery applies any validation that was requested via options
+func checkQuery(q url.Values, opts *options) error {
+	if opts.rejectControlChars {
+		for k, values := range q {
+			if hasControlChar(k) {
+				return fmt.Errorf("urlenc.Unmarshal: control character in key %q", k)
+			}
+			for _, v := range values {
+				if hasControlChar(v) {
+					return fmt.Errorf("urlenc.Unmarshal: control character in value for key %q", k)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func hasControlChar(s string) bool {
+	return strings.IndexFunc(s, unicode.IsControl) >= 0
+}
+
+func unmarshalMap(q url.Values, rv reflect.Value, opts *options) error {
+	kt := rv.Type().Key()
+	et := rv.Type().Elem()
+	if !isMapElemType(et) {
+		return fmt.Errorf("urlenc.Unmarshal: %w (map element: %s)", ErrUnsupportedType, et)
+	}
+
+	if rv.IsNil() {
+		// Like encoding/json, a nil map is allocated first
+		rv.Set(reflect.MakeMapWithSize(rv.Type(), len(q)))
+	}
 
 	for k, v := range q {
-		if len(v) == 1 {
-			rv.SetMapIndex(reflect.ValueOf(k), reflect.ValueOf(v[0]))
-		} else {
-			rv.SetMapIndex(reflect.ValueOf(k), reflect.ValueOf(v))
+		if opts.mapKeyPrefix != "" {
+			if !strings.HasPrefix(k, opts.mapKeyPrefix) {
+				continue
+			}
+			k = k[len(opts.mapKeyPrefix):]
+		}
+
+		ev, err := mapElemValue(et, v, opts)
+		if err != nil {
+			return fmt.Errorf("urlenc.Unmarshal: failed to decode key %s: %w", k, err)
 		}
+		// kt may be a defined type such as `type Key string`
+		rv.SetMapIndex(reflect.ValueOf(k).Convert(kt), ev)
 	}
 
 	return nil
 }
 
+// isMapElemType returns true if a map with element type et can be given
+// to Unmarshal: interface{}, strings, numbers, or slices of those
+func isMapElemType(et reflect.Type) bool {
+	switch {
+	case et.Kind() == reflect.Interface:
+		return et.NumMethod() == 0
+	case et.Kind() == reflect.Slice:
+		return isScalar(et.Elem())
+	default:
+		return isScalar(et)
+	}
+}
+
+// mapElemValue converts the values for a key into an element of type et.
+// Slices receive all of the values, while other types receive the first
+// or the last value, depending on the MapMultiPolicy. interface{}
+// elements are given strings, or []string for keys with multiple values
+func mapElemValue(et reflect.Type, v []string, opts *options) (reflect.Value, error) {
+	if et.Kind() == reflect.Interface {
+		switch {
+		case len(v) == 1 || opts.mapMultiPolicy == MapMultiFirst:
+			return reflect.ValueOf(v[0]), nil
+		case opts.mapMultiPolicy == MapMultiLast:
+			return reflect.ValueOf(v[len(v)-1]), nil
+		default:
+			return reflect.ValueOf(v), nil
+		}
+	}
+
+	if et.Kind() != reflect.Slice && opts.mapMultiPolicy == MapMultiLast {
+		v = v[len(v)-1:]
+	}
+	return convertValues(et, v, opts)
+}
+
+// MarshalMapPrefixed is the same as MarshalWithOptions, but v must be a
+// map, and all of its keys are prefixed with prefix. This is useful for
+// namespacing a loose set of extra parameters, e.g. with a prefix of
+// "extra." the key "foo" becomes "extra.foo".
+func MarshalMapPrefixed(v interface{}, prefix string, options ...Option) ([]byte, error) {
+	if rv := reflect.Indirect(reflect.ValueOf(v)); rv.Kind() != reflect.Map {
+		return nil, fmt.Errorf("urlenc.MarshalMapPrefixed: %w (map required)", ErrUnsupportedType)
+	}
+	// options may have spare capacity that belongs to the caller
+	options = append(options[:len(options):len(options)], withMapKeyPrefix(prefix))
+	return MarshalWithOptions(v, options...)
+}
+
+// UnmarshalMapPrefixed is the counterpart of MarshalMapPrefixed. Only keys
+// that start with prefix are decoded into v, which must be a pointer to a
+// map, and the prefix is stripped from them.
+func UnmarshalMapPrefixed(data []byte, v interface{}, prefix string, options ...Option) error {
+	if rv := reflect.ValueOf(v); rv.Kind() != reflect.Ptr || rv.Elem().Kind() != reflect.Map {
+		return fmt.Errorf("urlenc.UnmarshalMapPrefixed: %w (pointer to map required)", ErrUnsupportedType)
+	}
+	options = append(options[:len(options):len(options)], withMapKeyPrefix(prefix))
+	return UnmarshalWithOptions(data, v, options...)
+}
+
 type Setter interface {
 	Set(interface{}) error
 }
 
 var setterif = reflect.TypeOf((*Setter)(nil)).Elem()
+var emptyif = reflect.TypeOf((*interface{})(nil)).Elem()
+var errorif = reflect.TypeOf((*error)(nil)).Elem()
 
+// getSetterMethod returns the Set method for either a Setter, or a type
+// with a chaining Set method in the form of Set(interface{}) (T, error),
+// as found in fluent APIs. In both cases, the error is the last return
+// value
 func getSetterMethod(fv reflect.Value) reflect.Value {
 	const methodName = "Set"
 	var mv reflect.Value
@@ -536,71 +1731,989 @@ func getSetterMethod(fv reflect.Value) reflect.Value {
 		mv = fv.MethodByName(methodName)
 	} else if fv.CanAddr() && fv.Addr().Type().Implements(setterif) {
 		mv = fv.Addr().MethodByName(methodName)
+	} else if m := fv.MethodByName(methodName); m.IsValid() && isChainingSetter(m.Type()) {
+		mv = m
+	} else if fv.CanAddr() {
+		if m := fv.Addr().MethodByName(methodName); m.IsValid() && isChainingSetter(m.Type()) {
+			mv = m
+		}
 	}
 	return mv
 }
 
-func unmarshalStruct(data []byte, rv reflect.Value) error {
-	// Grab the mapping from struct tags
-	fields, err := t2f.getStructFields(rv.Type())
-	if err != nil {
-		return err
-	}
+// isChainingSetter returns true if mt, the type of a method value, is
+// func(interface{}) (T, error)
+func isChainingSetter(mt reflect.Type) bool {
+	return mt.NumIn() == 1 && mt.In(0) == emptyif && mt.NumOut() == 2 && mt.Out(1) == errorif
+}
 
-	q, err := url.ParseQuery(string(data))
-	if err != nil {
-		return err
-	}
-	for _, f := range fields {
-		values := q[f.KeyName]
-		if len(values) <= 0 {
-			continue
-		}
+// SetterWithCurrent is implemented by fields that merge decoded values
+// into their existing state instead of replacing it. SetWith receives the
+// current value of the field along with the newly decoded value, which is
+// of the same type a Setter would receive.
+//
+// SetterWithCurrent takes precedence over Setter.
+type SetterWithCurrent interface {
+	SetWith(current, new interface{}) error
+}
 
-		fv := rv.FieldByName(f.FieldName)
-		switch fv.Kind() {
-		case reflect.Ptr, reflect.Interface:
-			fv = fv.Elem()
-		}
+var setterwithcurrentif = reflect.TypeOf((*SetterWithCurrent)(nil)).Elem()
 
-		var err error
-		var sv reflect.Value // value to be set
-		switch rk := f.Type.Kind(); rk {
-		case reflect.Slice, reflect.Array:
-			et := f.Type.Elem() // slice/array element type
-			ek := et.Kind()     // slice/array element kind
-			sv = reflect.MakeSlice(reflect.SliceOf(et), len(values), len(values))
-			for i := 0; i < len(values); i++ {
-				ev := sv.Index(i)
-				cv, err := convertFromString(ek, values[i])
-				if err != nil {
-					return err
+func getSetterWithCurrent(fv reflect.Value) (SetterWithCurrent, bool) {
+	if fv.Type().Implements(setterwithcurrentif) {
+		s, ok := fv.Interface().(SetterWithCurrent)
+		return s, ok
+	}
+	if fv.CanAddr() && fv.Addr().Type().Implements(setterwithcurrentif) {
+		return fv.Addr().Interface().(SetterWithCurrent), true
+	}
+	return nil, false
+}
+
+// ValuesSetter is implemented by fields that represent a whole sub-object,
+// and want to decode it on their own. SetValues receives the subset of
+// the query for keys in the form of key[subkey], keyed by subkey.
+//
+// Marshal does not know how to encode these fields unless they also
+// implement Valuer or ErrorValuer.
+type ValuesSetter interface {
+	SetValues(url.Values) error
+}
+
+var valuessetterif = reflect.TypeOf((*ValuesSetter)(nil)).Elem()
+
+func isValuesSetter(t reflect.Type) bool {
+	return t.Implements(valuessetterif) || reflect.PtrTo(t).Implements(valuessetterif)
+}
+
+func getValuesSetterMethod(fv reflect.Value) reflect.Value {
+	const methodName = "SetValues"
+	var mv reflect.Value
+	if fv.Type().Implements(valuessetterif) {
+		mv = fv.MethodByName(methodName)
+	} else if fv.CanAddr() && fv.Addr().Type().Implements(valuessetterif) {
+		mv = fv.Addr().MethodByName(methodName)
+	}
+	return mv
+}
+
+// SetterFactory is implemented by fields that hand out a fresh Setter
+// for every decode instead of being set directly. The decoded value is
+// passed to the Setter returned by NewSetter, so the factory is
+// responsible for keeping a reference to it if it needs one.
+type SetterFactory interface {
+	NewSetter() Setter
+}
+
+var setterfactoryif = reflect.TypeOf((*SetterFactory)(nil)).Elem()
+
+func getSetterFactoryMethod(fv reflect.Value) reflect.Value {
+	const methodName = "NewSetter"
+	var mv reflect.Value
+	if fv.Type().Implements(setterfactoryif) {
+		mv = fv.MethodByName(methodName)
+	} else if fv.CanAddr() && fv.Addr().Type().Implements(setterfactoryif) {
+		mv = fv.Addr().MethodByName(methodName)
+	}
+	return mv
+}
+
+// subValues extracts the values for keys in the form of prefix[subkey]
+// (or prefix.subkey, depending on style), keyed by subkey. Keys in
+// literal are matched literally by other fields, and are left alone
+func subValues(q url.Values, prefix string, style MapKeyStyle, literal map[string]bool) url.Values {
+	var sub url.Values
+	for k, v := range q {
+		if literal[k] {
+			continue
+		}
+		subkey, ok := subKey(k, prefix, style)
+		if !ok {
+			continue
+		}
+		if sub == nil {
+			sub = url.Values{}
+		}
+		// "prefix[subkey]" and "prefix[subkey][]" are the same thing
+		sub[subkey] = append(sub[subkey], v...)
+	}
+	return sub
+}
+
+// subKey returns "subkey" if k is in the form of "prefix[subkey]", or
+// "prefix.subkey" when style is MapKeyDot. A trailing "[]" array marker
+// is ignored
+func subKey(k, prefix string, style MapKeyStyle) (string, bool) {
+	subkey, ok := trimKeyPrefix(k, prefix, style)
+	if !ok {
+		return "", false
+	}
+
+	special := "[]"
+	if style == MapKeyDot {
+		special = ".[]"
+	}
+	if strings.ContainsAny(subkey, special) {
+		return "", false
+	}
+	return subkey, true
+}
+
+// trimKeyPrefix removes prefix from k, and returns the rest in the form
+// of a key. For example, "prefix[a][b]" becomes "a[b]", and with
+// MapKeyDot, "prefix.a.b" becomes "a.b". A trailing "[]" array marker
+// is removed
+func trimKeyPrefix(k, prefix string, style MapKeyStyle) (string, bool) {
+	k = strings.TrimSuffix(k, "[]")
+	if len(k) <= len(prefix)+1 || !strings.HasPrefix(k, prefix) {
+		return "", false
+	}
+
+	rest := k[len(prefix):]
+	if style == MapKeyDot {
+		if rest[0] != '.' {
+			return "", false
+		}
+		return rest[1:], true
+	}
+
+	end := strings.IndexByte(rest, ']')
+	if rest[0] != '[' || end <= 1 || (end+1 < len(rest) && rest[end+1] != '[') {
+		return "", false
+	}
+	return rest[1:end] + rest[end+1:], true
+}
+
+// nestedSubValues is like subValues, but also includes the values for
+// keys nested deeper than one level. The values are keyed by the rest of
+// the key, as returned by trimKeyPrefix
+func nestedSubValues(q url.Values, prefix string, style MapKeyStyle, literal map[string]bool) url.Values {
+	var sub url.Values
+	for k, v := range q {
+		if literal[k] {
+			continue
+		}
+		rest, ok := trimKeyPrefix(k, prefix, style)
+		if !ok {
+			continue
+		}
+		if sub == nil {
+			sub = url.Values{}
+		}
+		sub[rest] = append(sub[rest], v...)
+	}
+	return sub
+}
+
+// firstKeySegment returns the part of k before any nesting
+func firstKeySegment(k string, style MapKeyStyle) string {
+	special := "["
+	if style == MapKeyDot {
+		special = ".["
+	}
+	if i := strings.IndexAny(k, special); i >= 0 {
+		return k[:i]
+	}
+	return k
+}
+
+// subKeyName returns the name of the key for the element key of the map
+// given by name
+func subKeyName(name, key string, style MapKeyStyle) string {
+	if style == MapKeyDot {
+		return name + "." + key
+	}
+	return name + "[" + key + "]"
+}
+
+// joinKeyName returns the name of the key for the key k, as given by
+// a struct or a map that is nested in the map given by name. For example,
+// "name" and "a[b]" become "name[a][b]"
+func joinKeyName(name, k string, style MapKeyStyle) string {
+	seg := firstKeySegment(k, style)
+	return subKeyName(name, seg, style) + k[len(seg):]
+}
+
+// indexedSubValues groups the values in q whose keys are in the form of
+// "prefix[index][subkey]" by index. The groups are returned in ascending
+// order of their indices, and gaps between the indices are not preserved
+func indexedSubValues(q url.Values, prefix string, style MapKeyStyle) []url.Values {
+	groups := make(map[int]url.Values)
+	for k, v := range q {
+		idx, subkey, ok := indexedSubKey(k, prefix, style)
+		if !ok {
+			continue
+		}
+		if groups[idx] == nil {
+			groups[idx] = url.Values{}
+		}
+		groups[idx][subkey] = v
+	}
+	if len(groups) == 0 {
+		return nil
+	}
+
+	indices := make([]int, 0, len(groups))
+	for idx := range groups {
+		indices = append(indices, idx)
+	}
+	sort.Ints(indices)
+
+	list := make([]url.Values, len(indices))
+	for i, idx := range indices {
+		list[i] = groups[idx]
+	}
+	return list
+}
+
+// indexedSubKey returns the index and "subkey" if k is in the form of
+// "prefix[index][subkey]". The subkey part follows style
+func indexedSubKey(k, prefix string, style MapKeyStyle) (int, string, bool) {
+	if len(k) <= len(prefix)+2 || !strings.HasPrefix(k, prefix) || k[len(prefix)] != '[' {
+		return 0, "", false
+	}
+
+	rest := k[len(prefix)+1:]
+	end := strings.IndexByte(rest, ']')
+	if end <= 0 {
+		return 0, "", false
+	}
+	idx, err := strconv.Atoi(rest[:end])
+	if err != nil || idx < 0 {
+		return 0, "", false
+	}
+
+	subkey, ok := subKey(rest[end+1:], "", style)
+	if !ok {
+		return 0, "", false
+	}
+	return idx, subkey, true
+}
+
+func isSliceOfMaps(t reflect.Type) bool {
+	return t.Kind() == reflect.Slice && t.Elem().Kind() == reflect.Map
+}
+
+// isSliceOfSlices returns true if t is a two dimensional slice, such as
+// [][]int
+func isSliceOfSlices(t reflect.Type) bool {
+	return t.Kind() == reflect.Slice && t.Elem().Kind() == reflect.Slice && !isScalar(t.Elem())
+}
+
+// sliceRows groups the values for a slice of slices given by prefix into
+// rows. Keys in the form of "prefix[index][]" (or "prefix[index]") put
+// their values in the row at index, while each value of "prefix[][]"
+// becomes a row of its own, as PHP does. The indexed rows come first, in
+// ascending order of their indices, and gaps between the indices are not
+// preserved
+func sliceRows(q url.Values, prefix string) [][]string {
+	indexed := make(map[int][]string)
+	var unindexed []string
+	for k, v := range q {
+		idx, ok := sliceRowIndex(k, prefix)
+		if !ok {
+			continue
+		}
+		if idx < 0 {
+			unindexed = append(unindexed, v...)
+			continue
+		}
+		indexed[idx] = append(indexed[idx], v...)
+	}
+
+	indices := make([]int, 0, len(indexed))
+	for idx := range indexed {
+		indices = append(indices, idx)
+	}
+	sort.Ints(indices)
+
+	var rows [][]string
+	for _, idx := range indices {
+		rows = append(rows, indexed[idx])
+	}
+	for _, v := range unindexed {
+		rows = append(rows, []string{v})
+	}
+	return rows
+}
+
+// sliceRowIndex returns the index of the row that k refers to, if k is
+// in the form of "prefix[index][]" or "prefix[index]". The index is -1
+// for "prefix[][]"
+func sliceRowIndex(k, prefix string) (int, bool) {
+	if !strings.HasPrefix(k, prefix+"[") {
+		return 0, false
+	}
+	rest := k[len(prefix)+1:]
+	if rest == "][]" {
+		return -1, true
+	}
+
+	end := strings.IndexByte(rest, ']')
+	if end <= 0 || (rest[end+1:] != "" && rest[end+1:] != "[]") {
+		return 0, false
+	}
+	idx, err := strconv.Atoi(rest[:end])
+	if err != nil || idx < 0 {
+		return 0, false
+	}
+	return idx, true
+}
+
+// maxIndexGapFill is the maximum number of missing indices that are
+// filled with zero values for a single field under IndexGapFill
+const maxIndexGapFill = 1000
+
+// indexedValues returns the values for keys in the form of
+// "prefix[index]", in ascending order of their indices. Gaps between the
+// indices are handled according to policy: they are dropped, reported as
+// an error, or filled with an empty placeholder. The positions of the
+// placeholders in the returned list are given in gaps
+func indexedValues(q url.Values, prefix string, policy IndexGapPolicy) (list []string, gaps []int, err error) {
+	var indices []int
+	var byIndex map[int][]string
+	for k, v := range q {
+		idx, ok := elementIndex(k, prefix)
+		if !ok {
+			continue
+		}
+		if byIndex == nil {
+			byIndex = make(map[int][]string)
+		}
+		if _, ok := byIndex[idx]; !ok {
+			indices = append(indices, idx)
+		}
+		byIndex[idx] = append(byIndex[idx], v...)
+	}
+	sort.Ints(indices)
+
+	next := 0 // the index expected next, if there are no gaps
+	for _, idx := range indices {
+		if idx > next {
+			switch policy {
+			case IndexGapError:
+				return nil, nil, fmt.Errorf("%w: %s[%d]", ErrIndexGap, prefix, next)
+			case IndexGapFill:
+				if len(gaps)+idx-next > maxIndexGapFill {
+					// The index is given by the client, so it must not
+					// control how much is allocated
+					return nil, nil, fmt.Errorf("%w: more than %d missing indices for %s", ErrIndexGap, maxIndexGapFill, prefix)
+				}
+				for ; next < idx; next++ {
+					gaps = append(gaps, len(list))
+					list = append(list, "")
 				}
-				ev.Set(cv)
 			}
-		default:
-			// This is checking for the REGISTERED type, not the actual type of the field
-			if !isStringOrNumeric(rk) {
-				return errors.New("urlenc.Unmarshal: unsupported type for field " + f.FieldName + " (Kind: " + rk.String() + ")")
+		}
+		list = append(list, byIndex[idx]...)
+		next = idx + 1
+	}
+	return list, gaps, nil
+}
+
+// elementIndex returns the index if k is in the form of "prefix[index]"
+func elementIndex(k, prefix string) (int, bool) {
+	if len(k) <= len(prefix)+2 || !strings.HasPrefix(k, prefix) || k[len(prefix)] != '[' || k[len(k)-1] != ']' {
+		return 0, false
+	}
+	idx, err := strconv.Atoi(k[len(prefix)+1 : len(k)-1])
+	if err != nil || idx < 0 {
+		return 0, false
+	}
+	return idx, true
+}
+
+// isFlattenedStruct returns true if t is a struct whose fields are given
+// as sub keys, as is the case for map values such as map[string]Address
+func isFlattenedStruct(t reflect.Type) bool {
+	return t.Kind() == reflect.Struct && !isScalar(t)
+}
+
+// fieldKeys returns the set of keys that are looked up by the fields
+func fieldKeys(fields []structfield, opts *options) map[string]bool {
+	keys := make(map[string]bool, len(fields))
+	for _, f := range fields {
+		if f.CatchAll || f.Embedded {
+			continue
+		}
+		key := f.InKeyName
+		if opts.unicodeKeyNormalization {
+			key = normalizeKey(key)
+		}
+		keys[key] = true
+		if strings.Contains(key, "+") {
+			keys[unescapedPlusKey(key)] = true
+		}
+		if isArrayField(f) {
+			keys[key+"[]"] = true
+		}
+	}
+	return keys
+}
+
+// isArrayField returns true if f holds a list of values given as
+// repeated keys
+func isArrayField(f structfield) bool {
+	switch f.Type.Kind() {
+	case reflect.Slice, reflect.Array:
+		return !isScalar(f.Type) && !isSliceOfMaps(f.Type) && !isSliceOfSlices(f.Type)
+	}
+	return false
+}
+
+// unmatchedValues returns the values in q whose keys are not claimed by
+// any of the fields, nor by any of the field splitters
+func unmatchedValues(q url.Values, fields []structfield, opts *options) url.Values {
+	claimed := fieldKeys(fields, opts)
+	var prefixes, dotPrefixes, indexedPrefixes, rowPrefixes, arrayPrefixes []string
+	for _, f := range fields {
+		if f.CatchAll || f.Embedded {
+			continue
+		}
+		key := f.InKeyName
+		if opts.unicodeKeyNormalization {
+			key = normalizeKey(key)
+		}
+		if f.QueryType {
+			dotPrefixes = append(dotPrefixes, key)
+		}
+		if f.ValuesSetter || f.Type.Kind() == reflect.Map {
+			prefixes = append(prefixes, key)
+		}
+		if isSliceOfMaps(f.Type) {
+			indexedPrefixes = append(indexedPrefixes, key)
+		}
+		if isSliceOfSlices(f.Type) {
+			rowPrefixes = append(rowPrefixes, key)
+		}
+		if isArrayField(f) {
+			arrayPrefixes = append(arrayPrefixes, key)
+		}
+	}
+	for key := range opts.fieldSplitters {
+		claimed[key] = true
+	}
+
+	var extra url.Values
+OUTER:
+	for k, v := range q {
+		if claimed[k] {
+			continue
+		}
+		for _, prefix := range prefixes {
+			if _, ok := trimKeyPrefix(k, prefix, opts.mapKeyStyle); ok {
+				continue OUTER
+			}
+		}
+		for _, prefix := range dotPrefixes {
+			if _, ok := trimKeyPrefix(k, prefix, MapKeyDot); ok {
+				continue OUTER
+			}
+		}
+		for _, prefix := range indexedPrefixes {
+			if _, _, ok := indexedSubKey(k, prefix, opts.mapKeyStyle); ok {
+				continue OUTER
+			}
+		}
+		for _, prefix := range rowPrefixes {
+			if _, ok := sliceRowIndex(k, prefix); ok {
+				continue OUTER
+			}
+		}
+		for _, prefix := range arrayPrefixes {
+			if _, ok := elementIndex(k, prefix); ok {
+				continue OUTER
+			}
+		}
+		if extra == nil {
+			extra = url.Values{}
+		}
+		extra[k] = v
+	}
+	return extra
+}
+
+// convertValues converts the values into a value of type t, which must be
+// either a string/numeric type, or a slice of those
+func convertValues(t reflect.Type, values []string, opts *options) (reflect.Value, error) {
+	if t.Kind() != reflect.Slice {
+		cv, err := decodeString(t, values[0], opts)
+		if err != nil {
+			return zeroval, err
+		}
+		return cv.Convert(t), nil
+	}
+
+	et := t.Elem()
+	sv := reflect.MakeSlice(t, len(values), len(values))
+	for i, v := range values {
+		cv, err := decodeString(et, v, opts)
+		if err != nil {
+			return zeroval, fmt.Errorf("failed to decode element %d: %w", i, err)
+		}
+		sv.Index(i).Set(cv.Convert(et))
+	}
+	return sv, nil
+}
+
+// convertMap converts the values into a map of type t, which must have
+// string keys, and values that convertValues can handle
+func convertMap(t reflect.Type, values url.Values, opts *options) (reflect.Value, error) {
+	mv := reflect.MakeMapWithSize(t, len(values))
+	kt := t.Key()
+	et := t.Elem()
+	for k, v := range values {
+		ev, err := convertValues(et, v, opts)
+		if err != nil {
+			return zeroval, fmt.Errorf("failed to decode key %s: %w", k, err)
+		}
+		// kt may be a defined type such as `type Key string`
+		mv.SetMapIndex(reflect.ValueOf(k).Convert(kt), ev)
+	}
+	return mv, nil
+}
+
+// convertNestedMap converts the values, as returned by nestedSubValues,
+// into a map of type t. The map values may be maps or structs themselves
+func convertNestedMap(t reflect.Type, values url.Values, style MapKeyStyle, opts *options) (reflect.Value, error) {
+	et := t.Elem()
+	if et.Kind() != reflect.Map && !isFlattenedStruct(et) {
+		flat := make(url.Values, len(values))
+		for k, v := range values {
+			if firstKeySegment(k, style) == k {
+				flat[k] = v
+			}
+		}
+		return convertMap(t, flat, opts)
+	}
+
+	mv := reflect.MakeMap(t)
+	kt := t.Key()
+	for k := range values {
+		name := firstKeySegment(k, style)
+		if name == "" || mv.MapIndex(reflect.ValueOf(name).Convert(kt)).IsValid() {
+			continue
+		}
+
+		sub := nestedSubValues(values, name, style, nil)
+		var ev reflect.Value
+		var err error
+		if isFlattenedStruct(et) {
+			ev, err = convertStruct(et, sub, opts)
+		} else {
+			ev, err = convertNestedMap(et, sub, style, opts)
+		}
+		if err != nil {
+			return zeroval, fmt.Errorf("failed to decode key %s: %w", name, err)
+		}
+		mv.SetMapIndex(reflect.ValueOf(name).Convert(kt), ev)
+	}
+	return mv, nil
+}
+
+// convertStruct converts the values, whose keys are the keys of the
+// struct fields, into a struct of type t
+func convertStruct(t reflect.Type, values url.Values, opts *options) (reflect.Value, error) {
+	sv := reflect.New(t).Elem()
+	if err := unmarshalNested(values, sv, opts); err != nil {
+		return zeroval, err
+	}
+	return sv, nil
+}
+
+// arrayLength returns the number of values to decode into an array of
+// length size, when given count values
+func arrayLength(size, count int, policy ArrayMismatchPolicy) (int, error) {
+	switch {
+	case count == size:
+		return count, nil
+	case policy == ArrayMismatchTruncate:
+		if count > size {
+			return size, nil
+		}
+		return count, nil
+	case policy == ArrayMismatchZeroFill && count < size:
+		return count, nil
+	default:
+		return 0, fmt.Errorf("%w (got %d values for array of length %d)", ErrArrayLength, count, size)
+	}
+}
+
+// splitValues splits each of the values on sep. Empty elements are dropped
+func splitValues(values []string, sep string) []string {
+	list := make([]string, 0, len(values))
+	for _, v := range values {
+		for _, elem := range strings.Split(v, sep) {
+			if elem != "" {
+				list = append(list, elem)
 			}
+		}
+	}
+	return list
+}
+
+func unmarshalStruct(q url.Values, rv reflect.Value, opts *options) error {
+	// Grab the mapping from struct tags
+	fields, err := t2f.getStructFields(rv.Type(), opts)
+	if err != nil {
+		return fmt.Errorf("urlenc.Unmarshal: %w", err)
+	}
+
+	if opts.unicodeKeyNormalization {
+		q = normalizeKeys(q)
+	}
+	literal := fieldKeys(fields, opts)
 
-			// Now convert the value
-			sv, err = convertFromString(f.Type.Kind(), values[0])
+	plain := plainStringsEnabled(opts, false)
+	var missing []string
+	var errs []error
+	for _, f := range fields {
+		key := f.InKeyName
+		if opts.unicodeKeyNormalization {
+			key = normalizeKey(key)
+		}
+
+		var subvalues url.Values
+		var groups []url.Values
+		var rows [][]string
+		values := q[key]
+		if len(values) == 0 && strings.Contains(key, "+") {
+			values = q[unescapedPlusKey(key)]
+		}
+		var gaps []int
+		if isArrayField(f) {
+			// Slices may also be given as key[]=value, or key[index]=value
+			brackets := q[key+"[]"]
+			indexed, indexedGaps, err := indexedValues(q, key, opts.indexGapPolicy)
 			if err != nil {
-				return err
+				if !opts.collectErrors {
+					return fieldError(f, err)
+				}
+				errs = append(errs, fieldError(f, err))
+				continue
+			}
+			for _, i := range indexedGaps {
+				gaps = append(gaps, len(values)+len(brackets)+i)
+			}
+			if len(brackets) > 0 || len(indexed) > 0 {
+				values = append(append(append([]string(nil), values...), brackets...), indexed...)
 			}
 		}
+		present := len(values) > 0
+		switch {
+		case f.CatchAll:
+			subvalues = unmatchedValues(q, fields, opts)
+			if len(subvalues) == 0 {
+				// The catch-all is never missing
+				continue
+			}
+			present = true
+		case f.Embedded:
+			subvalues = q
+			if len(subvalues) == 0 {
+				// Embedded fields are never missing, as they have no
+				// key of their own
+				continue
+			}
+			present = true
+		case f.QueryType:
+			subvalues = nestedSubValues(q, key, MapKeyDot, literal)
+			present = len(subvalues) > 0
+		case f.ValuesSetter:
+			subvalues = subValues(q, key, opts.mapKeyStyle, literal)
+			present = len(subvalues) > 0
+		case f.Type.Kind() == reflect.Map:
+			// Map fields are given as key[subkey]=value, and maps of maps
+			// as key[subkey][subsubkey]=value
+			subvalues = nestedSubValues(q, key, opts.mapKeyStyle, literal)
+			present = len(subvalues) > 0
+		case isSliceOfMaps(f.Type):
+			// Slices of maps are given as key[index][subkey]=value
+			groups = indexedSubValues(q, key, opts.mapKeyStyle)
+			present = len(groups) > 0
+		case isSliceOfSlices(f.Type):
+			// Slices of slices are given as key[index][]=value, or
+			// key[][]=value
+			rows = sliceRows(q, key)
+			present = len(rows) > 0
+		}
 
-		// See if our value can Set()
-		mv := getSetterMethod(fv)
-		if mv == zeroval {
-			// No set. Try doing it the orthodox way
-			fv.Set(sv)
+		if !present {
+			// omitempty fields may be legitimately left out by the
+			// encoding side, so they never count as missing
+			if !f.OmitEmpty {
+				missing = append(missing, f.InKeyName)
+			}
+			continue
+		}
+
+		if plain && f.PlainString {
+			err = unmarshalPlainString(rv, f, values, opts)
 		} else {
-			out := mv.Call([]reflect.Value{sv})
-			if !out[0].IsNil() {
-				return out[0].Interface().(error)
+			err = unmarshalField(rv, f, values, gaps, subvalues, groups, rows, opts)
+		}
+		if err != nil {
+			if !opts.collectErrors {
+				return err
 			}
+			errs = append(errs, err)
+		}
+	}
+
+	// Splitters are called in sorted key order, so that the result does
+	// not depend on map iteration order when they set the same fields
+	splitKeys := make([]string, 0, len(opts.fieldSplitters))
+	for key := range opts.fieldSplitters {
+		splitKeys = append(splitKeys, key)
+	}
+	sort.Strings(splitKeys)
+	for _, key := range splitKeys {
+		values := q[key]
+		if len(values) == 0 {
+			continue
+		}
+		if err := opts.fieldSplitters[key](values[0], rv); err != nil {
+			return fmt.Errorf("urlenc.Unmarshal: failed to split key %s: %w", key, err)
+		}
+	}
+
+	if opts.requireAllFields && len(missing) > 0 {
+		errs = append(errs, fmt.Errorf("urlenc.Unmarshal: %w: %s", ErrMissingFields, strings.Join(missing, ", ")))
+	}
+
+	if opts.disallowUnknownKeys && !hasCatchAll(fields) {
+		if extra := unmatchedValues(q, fields, opts); len(extra) > 0 {
+			keys := make([]string, 0, len(extra))
+			for k := range extra {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			errs = append(errs, fmt.Errorf("urlenc.Unmarshal: %w: %s", ErrUnknownKeys, strings.Join(keys, ", ")))
+		}
+	}
+
+	switch {
+	case len(errs) == 0:
+		return nil
+	case len(errs) == 1 && !opts.collectErrors:
+		return errs[0]
+	default:
+		return MultiError(errs)
+	}
+}
+
+// fieldError returns a *FieldError for a failure to decode the value for
+// the struct field f
+func fieldError(f structfield, err error) error {
+	return &FieldError{Field: f.FieldName, Key: f.InKeyName, Err: err}
+}
+
+func hasCatchAll(fields []structfield) bool {
+	for _, f := range fields {
+		if f.CatchAll || f.Embedded {
+			return true
+		}
+	}
+	return false
+}
+
+// unmarshalField decodes the values for the struct field f, and sets the
+// result to the field in rv. gaps lists the positions in values that are
+// placeholders for missing indices, whose elements are left as zero values
+func unmarshalField(rv reflect.Value, f structfield, values []string, gaps []int, subvalues url.Values, groups []url.Values, rows [][]string, opts *options) error {
+	fv := fieldByIndex(rv, f.Index, true)
+	if !fv.IsValid() || !fv.CanSet() {
+		// e.g. the struct was not reached through a pointer
+		if opts.skipUnsettableFields {
+			return nil
+		}
+		return fieldError(f, ErrUnsettableField)
+	}
+	if f.Nullable && opts.nullMarker != "" && len(values) == 1 && values[0] == opts.nullMarker {
+		// The marker stands for a nil pointer
+		fv.Set(reflect.Zero(fv.Type()))
+		return nil
+	}
+	if _, ok := lookupConverter(fv.Type()); !ok {
+		// Converters produce values of the field's own type,
+		// pointers included
+		switch fv.Kind() {
+		case reflect.Ptr:
+			if fv.IsNil() {
+				fv.Set(reflect.New(fv.Type().Elem()))
+			}
+			fv = fv.Elem()
+		case reflect.Interface:
+			if fv.IsNil() {
+				return fmt.Errorf("urlenc.Unmarshal: can not decode into nil interface field %s", f.FieldName)
+			}
+			fv = fv.Elem()
+		}
+	}
+
+	if f.QueryType {
+		if err := unmarshalNested(subvalues, fv, opts); err != nil {
+			return fieldError(f, err)
+		}
+		return nil
+	}
+
+	if len(f.Layouts) > 0 {
+		sub := *opts
+		sub.timeLayouts = f.Layouts
+		opts = &sub
+	}
+
+	if f.ValuesSetter {
+		// The field consumes its subset of the query on its own
+		out := getValuesSetterMethod(fv).Call([]reflect.Value{reflect.ValueOf(subvalues)})
+		if !out[0].IsNil() {
+			return fmt.Errorf("urlenc.Unmarshal: failed to set field %s: %w", f.FieldName, out[0].Interface().(error))
+		}
+		return nil
+	}
+
+	var err error
+	var sv reflect.Value // value to be set
+	switch rk := f.Type.Kind(); {
+	case isScalar(f.Type) && f.Encoding == "":
+		sv, err = decodeString(f.Type, values[0], opts)
+		if err != nil {
+			return fieldError(f, err)
+		}
+	case f.CatchAll:
+		sv, err = convertMap(f.Type, subvalues, opts)
+		if err != nil {
+			return fieldError(f, err)
+		}
+	case rk == reflect.Map:
+		sv, err = convertNestedMap(f.Type, subvalues, opts.mapKeyStyle, opts)
+		if err != nil {
+			return fieldError(f, err)
+		}
+	case isSliceOfMaps(f.Type):
+		sv = reflect.MakeSlice(f.Type, len(groups), len(groups))
+		for i, group := range groups {
+			ev, err := convertMap(f.Type.Elem(), group, opts)
+			if err != nil {
+				return fieldError(f, fmt.Errorf("element %d: %w", i, err))
+			}
+			sv.Index(i).Set(ev)
+		}
+	case isSliceOfSlices(f.Type):
+		sv = reflect.MakeSlice(f.Type, len(rows), len(rows))
+		for i, row := range rows {
+			ev, err := convertValues(f.Type.Elem(), row, opts)
+			if err != nil {
+				return fieldError(f, fmt.Errorf("element %d: %w", i, err))
+			}
+			sv.Index(i).Set(ev)
+		}
+	case rk == reflect.Slice || rk == reflect.Array:
+		if f.Encoding != "" {
+			sv, err = decodeBytes(f.Type, values[0], f.Encoding)
+			if err != nil {
+				return fieldError(f, err)
+			}
+			break
+		}
+
+		switch {
+		case f.Split != "":
+			values = splitValues(values, f.Split)
+			gaps = nil // the placeholders are dropped along with empty elements
+		case f.CSV || opts.arrayFormat == ArrayFormatComma:
+			values = splitValues(values, ",")
+			gaps = nil
+		}
+
+		et := f.Type.Elem() // slice/array element type
+		var reuse reflect.Value
+		switch {
+		case rk == reflect.Array:
+			n, err := arrayLength(f.Type.Len(), len(values), opts.arrayMismatchPolicy)
+			if err != nil {
+				return fieldError(f, err)
+			}
+			values = values[:n]
+			sv = reflect.New(f.Type).Elem()
+		case opts.reuseSlices && fv.Kind() == reflect.Slice && fv.Type().Elem() == et && fv.Cap() >= len(values):
+			// The existing backing array is only written to once all
+			// elements have been decoded, so errors leave it untouched
+			reuse = fv.Slice(0, len(values))
+			sv = reflect.MakeSlice(reflect.SliceOf(et), len(values), len(values))
+		default:
+			sv = reflect.MakeSlice(reflect.SliceOf(et), len(values), len(values))
+		}
+		for i := 0; i < len(values); i++ {
+			ev := sv.Index(i)
+			if len(gaps) > 0 && gaps[0] == i {
+				gaps = gaps[1:]
+				ev.Set(reflect.Zero(et))
+				continue
+			}
+			cv, err := decodeString(et, values[i], opts)
+			if err != nil {
+				return fieldError(f, fmt.Errorf("element %d: %w", i, err))
+			}
+			// et may be a defined type such as `type Level int`
+			ev.Set(cv.Convert(et))
+		}
+		if reuse.IsValid() {
+			reflect.Copy(reuse, sv)
+			sv = reuse
+		}
+	default:
+		// This is checking for the REGISTERED type, not the actual type of the field
+		return fmt.Errorf("urlenc.Unmarshal: %w for field %s (Kind: %s)", ErrUnsupportedType, f.FieldName, rk)
+	}
+
+	var mv reflect.Value
+	if !opts.withoutValuerSetter {
+		mv = getSetterFactoryMethod(fv)
+	}
+
+	// See if our value can give us a Setter to use
+	if mv != zeroval {
+		s, _ := mv.Call(nil)[0].Interface().(Setter)
+		if s == nil {
+			return errors.New("urlenc.Unmarshal: NewSetter returned nil for field " + f.FieldName)
+		}
+		if err := s.Set(sv.Interface()); err != nil {
+			return fmt.Errorf("urlenc.Unmarshal: failed to set field %s: %w", f.FieldName, err)
+		}
+		return nil
+	}
+
+	// See if our value wants to merge the decoded value into what it has
+	if !opts.withoutValuerSetter {
+		if s, ok := getSetterWithCurrent(fv); ok {
+			if err := s.SetWith(fv.Interface(), sv.Interface()); err != nil {
+				return fmt.Errorf("urlenc.Unmarshal: failed to set field %s: %w", f.FieldName, err)
+			}
+			return nil
+		}
+	}
+
+	// See if our value can Set()
+	if !opts.withoutValuerSetter {
+		mv = getSetterMethod(fv)
+	}
+	if mv == zeroval {
+		// No set. Try doing it the orthodox way. sv is of the built-in
+		// type for its kind, so a field of a defined type such as
+		// `type Level int` requires a conversion
+		if st, ft := sv.Type(), fv.Type(); st != ft {
+			if st.Kind() != ft.Kind() || !st.ConvertibleTo(ft) {
+				return fmt.Errorf("urlenc.Unmarshal: can not assign %s to field %s (%s)", st, f.FieldName, ft)
+			}
+			sv = sv.Convert(ft)
+		}
+		fv.Set(sv)
+	} else {
+		out := mv.Call([]reflect.Value{sv})
+		if errv := out[len(out)-1]; !errv.IsNil() {
+			return fmt.Errorf("urlenc.Unmarshal: failed to set field %s: %w", f.FieldName, errv.Interface().(error))
 		}
 	}
 	return nil
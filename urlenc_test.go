@@ -1,10 +1,18 @@
 package urlenc_test
 
 import (
+	"encoding/json"
 	"errors"
+	"fmt"
+	"math"
+	"net"
 	"net/url"
 	"reflect"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/lestrrat-go/urlenc"
 	"github.com/stretchr/testify/assert"
@@ -188,6 +196,16 @@ func TestUnmarshalMap(t *testing.T) {
 	if !assert.Equal(t, m, expected, "Unmarshal produces the expected result") {
 		return
 	}
+
+	t.Run("nil map", func(t *testing.T) {
+		var m map[string]string
+		if !assert.NoError(t, urlenc.Unmarshal([]byte(`bar=one`), &m), "Unmarshal succeeds") {
+			return
+		}
+		if !assert.Equal(t, map[string]string{"bar": "one"}, m, "map is allocated") {
+			return
+		}
+	})
 }
 
 func TestMarshalJSONFallback(t *testing.T) {
@@ -248,3 +266,4942 @@ func TestRackStyleQuery(t *testing.T) {
 		return
 	}
 }
+
+type LazyString struct {
+	Setters []*MaybeString
+}
+
+func (l *LazyString) NewSetter() urlenc.Setter {
+	s := &MaybeString{}
+	l.Setters = append(l.Setters, s)
+	return s
+}
+
+type LazyPayload struct {
+	Name LazyString `urlenc:"name,,string"`
+}
+
+func TestUnmarshalSetterFactory(t *testing.T) {
+	var s LazyPayload
+	if !assert.NoError(t, urlenc.Unmarshal([]byte(`name=foo`), &s), "Unmarshal succeeds") {
+		return
+	}
+	if !assert.NoError(t, urlenc.Unmarshal([]byte(`name=bar`), &s), "Unmarshal succeeds") {
+		return
+	}
+
+	if !assert.Len(t, s.Name.Setters, 2, "a fresh Setter is created per decode") {
+		return
+	}
+	if !assert.Equal(t, MaybeString{Valid: true, String: "foo"}, *s.Name.Setters[0], "first Setter receives the first value") {
+		return
+	}
+	if !assert.Equal(t, MaybeString{Valid: true, String: "bar"}, *s.Name.Setters[1], "second Setter receives the second value") {
+		return
+	}
+}
+
+type SlicePayload struct {
+	Names []string `urlenc:"names"`
+	IDs   []int    `urlenc:"ids"`
+}
+
+func TestUnmarshalReuseSlices(t *testing.T) {
+	t.Run("enough capacity", func(t *testing.T) {
+		names := make([]string, 0, 4)
+		ids := make([]int, 5, 5)
+		s := SlicePayload{Names: names, IDs: ids}
+		const src = `names=foo&names=bar&ids=1&ids=2&ids=3`
+		if !assert.NoError(t, urlenc.UnmarshalWithOptions([]byte(src), &s, urlenc.WithReuseSlices()), "Unmarshal succeeds") {
+			return
+		}
+		if !assert.Equal(t, []string{"foo", "bar"}, s.Names, "Names is 'foo, bar'") {
+			return
+		}
+		if !assert.Equal(t, []int{1, 2, 3}, s.IDs, "IDs is '1, 2, 3'") {
+			return
+		}
+		if !assert.Equal(t, &names[:1][0], &s.Names[0], "backing array is reused for Names") {
+			return
+		}
+		if !assert.Equal(t, &ids[0], &s.IDs[0], "backing array is reused for IDs") {
+			return
+		}
+	})
+	t.Run("not enough capacity", func(t *testing.T) {
+		names := make([]string, 0, 1)
+		s := SlicePayload{Names: names}
+		const src = `names=foo&names=bar`
+		if !assert.NoError(t, urlenc.UnmarshalWithOptions([]byte(src), &s, urlenc.WithReuseSlices()), "Unmarshal succeeds") {
+			return
+		}
+		if !assert.Equal(t, []string{"foo", "bar"}, s.Names, "Names is 'foo, bar'") {
+			return
+		}
+		if !assert.Equal(t, 1, cap(names), "original slice is untouched") {
+			return
+		}
+	})
+	t.Run("decoding error", func(t *testing.T) {
+		ids := []int{9, 9, 9, 9}
+		s := SlicePayload{IDs: ids}
+		const src = `ids=1&ids=x&ids=3`
+		if !assert.Error(t, urlenc.UnmarshalWithOptions([]byte(src), &s, urlenc.WithReuseSlices()), "Unmarshal fails") {
+			return
+		}
+		if !assert.Equal(t, []int{9, 9, 9, 9}, ids, "backing array is untouched") {
+			return
+		}
+	})
+}
+
+func BenchmarkUnmarshalSlices(b *testing.B) {
+	const src = `names=foo&names=bar&names=baz&ids=1&ids=2&ids=3&ids=4`
+	b.Run("default", func(b *testing.B) {
+		b.ReportAllocs()
+		var s SlicePayload
+		for i := 0; i < b.N; i++ {
+			if err := urlenc.Unmarshal([]byte(src), &s); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("WithReuseSlices", func(b *testing.B) {
+		b.ReportAllocs()
+		var s SlicePayload
+		for i := 0; i < b.N; i++ {
+			if err := urlenc.UnmarshalWithOptions([]byte(src), &s, urlenc.WithReuseSlices()); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// WidePayload has enough fields for per-field lookups to show up in
+// benchmarks
+type WidePayload struct {
+	F01 string `urlenc:"f01"`
+	F02 string `urlenc:"f02"`
+	F03 string `urlenc:"f03"`
+	F04 string `urlenc:"f04"`
+	F05 string `urlenc:"f05"`
+	F06 int    `urlenc:"f06"`
+	F07 int    `urlenc:"f07"`
+	F08 int    `urlenc:"f08"`
+	F09 int    `urlenc:"f09"`
+	F10 int    `urlenc:"f10"`
+	F11 bool   `urlenc:"f11"`
+	F12 bool   `urlenc:"f12"`
+	F13 bool   `urlenc:"f13"`
+	F14 bool   `urlenc:"f14"`
+	F15 bool   `urlenc:"f15"`
+	F16 string `urlenc:"f16"`
+	F17 string `urlenc:"f17"`
+	F18 string `urlenc:"f18"`
+	F19 string `urlenc:"f19"`
+	F20 string `urlenc:"f20"`
+}
+
+func BenchmarkWideStruct(b *testing.B) {
+	src := WidePayload{F01: "a", F05: "e", F06: 6, F10: 10, F11: true, F15: true, F16: "p", F20: "t"}
+	buf, err := urlenc.Marshal(src)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Run("Marshal", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := urlenc.Marshal(src); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("Unmarshal", func(b *testing.B) {
+		b.ReportAllocs()
+		var s WidePayload
+		for i := 0; i < b.N; i++ {
+			if err := urlenc.Unmarshal(buf, &s); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestUnmarshalErrorWrapping(t *testing.T) {
+	t.Run("bad number", func(t *testing.T) {
+		var foo Foo
+		err := urlenc.Unmarshal([]byte(`baz=abc`), &foo)
+		if !assert.Error(t, err, "Unmarshal should fail") {
+			return
+		}
+		if !assert.True(t, errors.Is(err, strconv.ErrSyntax), "error should wrap strconv.ErrSyntax") {
+			return
+		}
+		var numerr *strconv.NumError
+		if !assert.True(t, errors.As(err, &numerr), "error should wrap *strconv.NumError") {
+			return
+		}
+		if !assert.Equal(t, "abc", numerr.Num, "NumError should carry the offending input") {
+			return
+		}
+	})
+	t.Run("bad number in slice", func(t *testing.T) {
+		var foo Foo
+		err := urlenc.Unmarshal([]byte(`corge=1.5&corge=abc`), &foo)
+		if !assert.True(t, errors.Is(err, strconv.ErrSyntax), "error should wrap strconv.ErrSyntax") {
+			return
+		}
+	})
+	t.Run("bad query", func(t *testing.T) {
+		var foo Foo
+		err := urlenc.Unmarshal([]byte(`bar=%zz`), &foo)
+		var escerr url.EscapeError
+		if !assert.True(t, errors.As(err, &escerr), "error should wrap url.EscapeError") {
+			return
+		}
+
+		m := make(map[string]interface{})
+		err = urlenc.Unmarshal([]byte(`bar=%zz`), &m)
+		if !assert.True(t, errors.As(err, &escerr), "error should wrap url.EscapeError") {
+			return
+		}
+	})
+}
+
+func TestSentinelErrors(t *testing.T) {
+	t.Run("ErrNilValue", func(t *testing.T) {
+		_, err := urlenc.Marshal(nil)
+		if !assert.True(t, errors.Is(err, urlenc.ErrNilValue), "Marshal(nil) should return ErrNilValue") {
+			return
+		}
+		err = urlenc.Unmarshal([]byte(`bar=one`), nil)
+		if !assert.True(t, errors.Is(err, urlenc.ErrNilValue), "Unmarshal into nil should return ErrNilValue") {
+			return
+		}
+	})
+	t.Run("ErrNotPointer", func(t *testing.T) {
+		var foo Foo
+		err := urlenc.Unmarshal([]byte(`bar=one`), foo)
+		if !assert.True(t, errors.Is(err, urlenc.ErrNotPointer), "Unmarshal into non-pointer should return ErrNotPointer") {
+			return
+		}
+	})
+	t.Run("ErrUnsupportedType", func(t *testing.T) {
+		_, err := urlenc.Marshal(1)
+		if !assert.True(t, errors.Is(err, urlenc.ErrUnsupportedType), "Marshal(int) should return ErrUnsupportedType") {
+			return
+		}
+		var i int
+		err = urlenc.Unmarshal([]byte(`bar=one`), &i)
+		if !assert.True(t, errors.Is(err, urlenc.ErrUnsupportedType), "Unmarshal into int should return ErrUnsupportedType") {
+			return
+		}
+		_, err = urlenc.Marshal(map[string]interface{}{"foo": make(chan int)})
+		if !assert.True(t, errors.Is(err, urlenc.ErrUnsupportedType), "Marshal with unsupported map element should return ErrUnsupportedType") {
+			return
+		}
+		_, err = urlenc.Marshal(struct {
+			Foo chan int
+		}{})
+		if !assert.True(t, errors.Is(err, urlenc.ErrUnsupportedType), "Marshal with unsupported struct field should return ErrUnsupportedType") {
+			return
+		}
+	})
+	t.Run("ErrNonStringMapKey", func(t *testing.T) {
+		_, err := urlenc.Marshal(map[int]string{1: "one"})
+		if !assert.True(t, errors.Is(err, urlenc.ErrNonStringMapKey), "Marshal with int keys should return ErrNonStringMapKey") {
+			return
+		}
+		m := make(map[int]string)
+		err = urlenc.Unmarshal([]byte(`1=one`), &m)
+		if !assert.True(t, errors.Is(err, urlenc.ErrNonStringMapKey), "Unmarshal with int keys should return ErrNonStringMapKey") {
+			return
+		}
+	})
+}
+
+var errNoValue = errors.New("no value")
+
+type FallibleString struct {
+	Valid  bool
+	String string
+}
+
+func (f FallibleString) Value() (interface{}, error) {
+	if !f.Valid {
+		return nil, errNoValue
+	}
+	return f.String, nil
+}
+
+type FalliblePayload struct {
+	Name FallibleString `urlenc:"name,,string"`
+}
+
+func TestMarshalErrorValuer(t *testing.T) {
+	t.Run("success", func(t *testing.T) {
+		buf, err := urlenc.Marshal(FalliblePayload{Name: FallibleString{Valid: true, String: "foo"}})
+		if !assert.NoError(t, err, "Marshal should succeed") {
+			return
+		}
+		if !assert.Equal(t, "name=foo", string(buf), "Marshal produces the expected result") {
+			return
+		}
+	})
+	t.Run("failure", func(t *testing.T) {
+		_, err := urlenc.Marshal(FalliblePayload{})
+		if !assert.Error(t, err, "Marshal should fail") {
+			return
+		}
+		if !assert.True(t, errors.Is(err, errNoValue), "error from Value() should be propagated") {
+			return
+		}
+	})
+}
+
+func TestUnmarshalRejectControlChars(t *testing.T) {
+	for _, src := range []string{`bar=foo%00bar`, `bar=foo%0Abar`, `b%00ar=foo`} {
+		src := src
+		t.Run(src, func(t *testing.T) {
+			var foo Foo
+			if !assert.NoError(t, urlenc.Unmarshal([]byte(src), &foo), "Unmarshal without option succeeds") {
+				return
+			}
+			if !assert.Error(t, urlenc.UnmarshalWithOptions([]byte(src), &foo, urlenc.WithRejectControlChars()), "Unmarshal with option fails") {
+				return
+			}
+			m := make(map[string]interface{})
+			if !assert.Error(t, urlenc.UnmarshalWithOptions([]byte(src), &m, urlenc.WithRejectControlChars()), "Unmarshal into map with option fails") {
+				return
+			}
+		})
+	}
+
+	var foo Foo
+	if !assert.NoError(t, urlenc.UnmarshalWithOptions([]byte(`bar=foo%20bar`), &foo, urlenc.WithRejectControlChars()), "Unmarshal with clean input succeeds") {
+		return
+	}
+	if !assert.Equal(t, "foo bar", foo.Bar, "Bar is 'foo bar'") {
+		return
+	}
+}
+
+func TestMarshalKeyOrder(t *testing.T) {
+	foo := Foo{
+		Bar: "one",
+		Baz: 2,
+		Qux: []string{"three", "4"},
+	}
+
+	buf, err := urlenc.MarshalWithOptions(foo, urlenc.WithKeyOrder([]string{"qux", "missing", "bar"}))
+	if !assert.NoError(t, err, "Marshal should succeed") {
+		return
+	}
+	if !assert.Equal(t, "qux=three&qux=4&bar=one&baz=2&grault=false", string(buf), "keys are emitted in the given order") {
+		return
+	}
+
+	m := map[string]interface{}{"a": "1", "b": "2", "c": "3 4"}
+	buf, err = urlenc.MarshalWithOptions(m, urlenc.WithKeyOrder([]string{"c", "a"}))
+	if !assert.NoError(t, err, "Marshal should succeed") {
+		return
+	}
+	if !assert.Equal(t, "c=3+4&a=1&b=2", string(buf), "keys are emitted in the given order") {
+		return
+	}
+}
+
+type MaybeInt struct {
+	Valid bool
+	Int   int
+}
+
+func (m MaybeInt) Value() interface{} {
+	return m.Int
+}
+
+func (m *MaybeInt) Set(v interface{}) error {
+	switch v.(type) {
+	case int:
+		m.Valid = true
+		m.Int = v.(int)
+	default:
+		return errors.New("expected int (got: " + reflect.TypeOf(v).String() + ")")
+	}
+	return nil
+}
+
+type Cents int64
+
+func (c *Cents) Set(v interface{}) error {
+	i, ok := v.(int64)
+	if !ok {
+		return errors.New("expected int64 (got: " + reflect.TypeOf(v).String() + ")")
+	}
+	*c = Cents(i * 100)
+	return nil
+}
+
+type Level int
+
+type NumericPayload struct {
+	Count  MaybeInt `urlenc:"count,omitempty,int"`
+	Price  Cents    `urlenc:"price"`
+	Level  Level    `urlenc:"level"`
+	Levels []Level  `urlenc:"levels"`
+}
+
+func TestNumericSetter(t *testing.T) {
+	const src = `count=10&price=3&level=2&levels=1&levels=3`
+
+	var s NumericPayload
+	if !assert.NoError(t, urlenc.Unmarshal([]byte(src), &s), "Unmarshal succeeds") {
+		return
+	}
+	expected := NumericPayload{
+		Count:  MaybeInt{Valid: true, Int: 10},
+		Price:  Cents(300),
+		Level:  Level(2),
+		Levels: []Level{1, 3},
+	}
+	if !assert.Equal(t, expected, s, "Unmarshal produces the expected result") {
+		return
+	}
+
+	if !assert.Error(t, urlenc.Unmarshal([]byte(`count=foo`), &s), "Unmarshal with non-numeric value fails") {
+		return
+	}
+
+	buf, err := urlenc.Marshal(NumericPayload{Count: MaybeInt{Valid: true, Int: 10}, Level: Level(2)})
+	if !assert.NoError(t, err, "Marshal succeeds") {
+		return
+	}
+	if !assert.Equal(t, "count=10&level=2&price=0", string(buf), "Marshal produces the expected result") {
+		return
+	}
+}
+
+func TestMarshalNilMap(t *testing.T) {
+	t.Run("nil map", func(t *testing.T) {
+		buf, err := urlenc.Marshal((map[string]interface{})(nil))
+		if !assert.NoError(t, err, "Marshal should succeed") {
+			return
+		}
+		if !assert.Equal(t, "", string(buf), "nil map produces an empty query") {
+			return
+		}
+	})
+	t.Run("pointer to nil map", func(t *testing.T) {
+		var m map[string]interface{}
+		buf, err := urlenc.Marshal(&m)
+		if !assert.NoError(t, err, "Marshal should succeed") {
+			return
+		}
+		if !assert.Equal(t, "", string(buf), "nil map produces an empty query") {
+			return
+		}
+	})
+	t.Run("nil pointer to map", func(t *testing.T) {
+		_, err := urlenc.Marshal((*map[string]interface{})(nil))
+		if !assert.True(t, errors.Is(err, urlenc.ErrNilValue), "nil pointer should return ErrNilValue") {
+			return
+		}
+	})
+	t.Run("nil pointer to struct", func(t *testing.T) {
+		_, err := urlenc.Marshal((*Foo)(nil))
+		if !assert.True(t, errors.Is(err, urlenc.ErrNilValue), "nil pointer should return ErrNilValue") {
+			return
+		}
+	})
+}
+
+func TestMarshalSpaceAsPercent20(t *testing.T) {
+	m := map[string]interface{}{
+		"a b": "c d",
+		"e":   "1+1 = 2",
+	}
+
+	buf, err := urlenc.Marshal(m)
+	if !assert.NoError(t, err, "Marshal should succeed") {
+		return
+	}
+	if !assert.Equal(t, "a+b=c+d&e=1%2B1+%3D+2", string(buf), "spaces are encoded as '+' by default") {
+		return
+	}
+
+	buf, err = urlenc.MarshalWithOptions(m, urlenc.WithSpaceAsPercent20())
+	if !assert.NoError(t, err, "Marshal should succeed") {
+		return
+	}
+	if !assert.Equal(t, "a%20b=c%20d&e=1%2B1%20%3D%202", string(buf), "spaces are encoded as '%20', literal '+' as '%2B'") {
+		return
+	}
+
+	decoded := make(map[string]interface{})
+	if !assert.NoError(t, urlenc.Unmarshal(buf, &decoded), "Unmarshal should succeed") {
+		return
+	}
+	if !assert.Equal(t, m, decoded, "round trip produces the same result") {
+		return
+	}
+}
+
+func TestMarshalRFC3986Escaping(t *testing.T) {
+	const reserved = "a b!*'();:@&=+$,/?#[]~-._ü"
+	m := map[string]interface{}{"q": reserved}
+
+	buf, err := urlenc.MarshalWithOptions(m, urlenc.WithRFC3986Escaping())
+	if !assert.NoError(t, err, "Marshal should succeed") {
+		return
+	}
+	const expected = "q=a%20b%21%2A%27%28%29%3B%3A%40%26%3D%2B%24%2C%2F%3F%23%5B%5D~-._%C3%BC"
+	if !assert.Equal(t, expected, string(buf), "everything but the unreserved set is escaped") {
+		return
+	}
+	if !assert.NotEqual(t, "q="+url.QueryEscape(reserved), string(buf), "output differs from url.QueryEscape") {
+		return
+	}
+
+	decoded := make(map[string]interface{})
+	if !assert.NoError(t, urlenc.Unmarshal(buf, &decoded), "Unmarshal should succeed") {
+		return
+	}
+	if !assert.Equal(t, m, decoded, "round trip produces the same result") {
+		return
+	}
+}
+
+type AsymmetricPayload struct {
+	Name  string `urlenc:"in=old_name,out=new_name"`
+	Count int    `urlenc:"count,omitempty,,in=cnt"`
+	Plain string `urlenc:"plain"`
+}
+
+func TestAsymmetricKeyNames(t *testing.T) {
+	const src = `old_name=foo&cnt=2&plain=bar&new_name=ignored&count=10`
+
+	var s AsymmetricPayload
+	if !assert.NoError(t, urlenc.Unmarshal([]byte(src), &s), "Unmarshal succeeds") {
+		return
+	}
+	expected := AsymmetricPayload{Name: "foo", Count: 2, Plain: "bar"}
+	if !assert.Equal(t, expected, s, "Unmarshal matches the 'in' names") {
+		return
+	}
+
+	buf, err := urlenc.Marshal(s)
+	if !assert.NoError(t, err, "Marshal succeeds") {
+		return
+	}
+	if !assert.Equal(t, "count=2&new_name=foo&plain=bar", string(buf), "Marshal emits the 'out' names") {
+		return
+	}
+
+	buf, err = urlenc.Marshal(AsymmetricPayload{Name: "foo"})
+	if !assert.NoError(t, err, "Marshal succeeds") {
+		return
+	}
+	if !assert.Equal(t, "new_name=foo&plain=", string(buf), "omitempty is still honored") {
+		return
+	}
+}
+
+type FlagsPayload struct {
+	Flags []bool `urlenc:"flags,csv"`
+}
+
+func TestUnmarshalCSVBoolSlice(t *testing.T) {
+	testcases := map[string][]bool{
+		`flags=true,false,1`:                   {true, false, true},
+		`flags=t,F,TRUE,0`:                     {true, false, true, false},
+		`flags=True,,false`:                    {true, false},
+		`flags=true,false&flags=1`:             {true, false, true},
+		`flags=true%2Cfalse%2C1`:               {true, false, true},
+		`flags=true&flags=false&flags=T&other`: {true, false, true},
+	}
+
+	for src, expected := range testcases {
+		src, expected := src, expected
+		t.Run(src, func(t *testing.T) {
+			var s FlagsPayload
+			if !assert.NoError(t, urlenc.Unmarshal([]byte(src), &s), "Unmarshal succeeds") {
+				return
+			}
+			if !assert.Equal(t, expected, s.Flags, "Unmarshal produces the expected result") {
+				return
+			}
+		})
+	}
+
+	var s FlagsPayload
+	if !assert.Error(t, urlenc.Unmarshal([]byte(`flags=true,maybe`), &s), "Unmarshal with invalid bool fails") {
+		return
+	}
+}
+
+type PricePayload struct {
+	Price  float64   `urlenc:"price"`
+	Prices []float64 `urlenc:"prices"`
+}
+
+func TestMarshalFloatRoundTripCheck(t *testing.T) {
+	t.Run("default precision", func(t *testing.T) {
+		buf, err := urlenc.MarshalWithOptions(PricePayload{Price: 19.99, Prices: []float64{0.1, 1.005}}, urlenc.WithFloatRoundTripCheck())
+		if !assert.NoError(t, err, "Marshal succeeds") {
+			return
+		}
+		if !assert.Equal(t, "price=19.99&prices=0.1&prices=1.005", string(buf), "Marshal produces the expected result") {
+			return
+		}
+	})
+	t.Run("lossy precision", func(t *testing.T) {
+		buf, err := urlenc.MarshalWithOptions(PricePayload{Price: 19.99}, urlenc.WithFloatPrecision(1))
+		if !assert.NoError(t, err, "Marshal without the check succeeds") {
+			return
+		}
+		if !assert.Equal(t, "price=20.0", string(buf), "value is silently rounded") {
+			return
+		}
+
+		_, err = urlenc.MarshalWithOptions(PricePayload{Price: 19.99}, urlenc.WithFloatPrecision(1), urlenc.WithFloatRoundTripCheck())
+		if !assert.Error(t, err, "Marshal with the check fails") {
+			return
+		}
+		_, err = urlenc.MarshalWithOptions(PricePayload{Prices: []float64{1.5, 19.99}}, urlenc.WithFloatPrecision(1), urlenc.WithFloatRoundTripCheck())
+		if !assert.Error(t, err, "Marshal with the check fails for slice elements") {
+			return
+		}
+	})
+	t.Run("exact precision", func(t *testing.T) {
+		buf, err := urlenc.MarshalWithOptions(PricePayload{Price: 19.5}, urlenc.WithFloatPrecision(2), urlenc.WithFloatRoundTripCheck())
+		if !assert.NoError(t, err, "Marshal succeeds") {
+			return
+		}
+		if !assert.Equal(t, "price=19.50", string(buf), "Marshal produces the expected result") {
+			return
+		}
+	})
+}
+
+type Meta map[string]string
+
+type MetaPayload struct {
+	Name string           `urlenc:"name"`
+	Meta Meta             `urlenc:"meta,omitempty"`
+	Tags map[string][]int `urlenc:"tags,omitempty"`
+}
+
+func TestDefinedMapField(t *testing.T) {
+	const src = `name=foo&meta[a]=1&meta[b]=two&tags[x]=1&tags[x]=2&tags[y]=3`
+
+	var s MetaPayload
+	if !assert.NoError(t, urlenc.Unmarshal([]byte(src), &s), "Unmarshal succeeds") {
+		return
+	}
+	expected := MetaPayload{
+		Name: "foo",
+		Meta: Meta{"a": "1", "b": "two"},
+		Tags: map[string][]int{"x": {1, 2}, "y": {3}},
+	}
+	if !assert.Equal(t, expected, s, "Unmarshal produces the expected result") {
+		return
+	}
+
+	buf, err := urlenc.Marshal(s)
+	if !assert.NoError(t, err, "Marshal succeeds") {
+		return
+	}
+	produced, err := url.ParseQuery(string(buf))
+	if !assert.NoError(t, err, "ParseQuery should succeed") {
+		return
+	}
+	expectedQuery, err := url.ParseQuery(src)
+	if !assert.NoError(t, err, "ParseQuery should succeed") {
+		return
+	}
+	if !assert.Equal(t, expectedQuery, produced, "Marshal produces the same result") {
+		return
+	}
+
+	buf, err = urlenc.Marshal(MetaPayload{Name: "foo"})
+	if !assert.NoError(t, err, "Marshal succeeds") {
+		return
+	}
+	if !assert.Equal(t, "name=foo", string(buf), "nil maps are omitted") {
+		return
+	}
+
+	if !assert.Error(t, urlenc.Unmarshal([]byte(`tags[x]=foo`), &s), "Unmarshal with invalid element fails") {
+		return
+	}
+}
+
+type RequiredPayload struct {
+	Name     string   `urlenc:"name"`
+	Count    int      `urlenc:"count"`
+	Tags     []string `urlenc:"tags"`
+	Optional string   `urlenc:"optional,omitempty"`
+}
+
+type RequiredNumbersPayload struct {
+	Count   int     `urlenc:"count"`
+	Ratio   float64 `urlenc:"ratio"`
+	Enabled bool    `urlenc:"enabled"`
+	Name    string  `urlenc:"name"`
+	Limit   *int    `urlenc:"limit"`
+}
+
+func TestUnmarshalRequireAllFields(t *testing.T) {
+	t.Run("all present", func(t *testing.T) {
+		var s RequiredPayload
+		if !assert.NoError(t, urlenc.UnmarshalWithOptions([]byte(`name=foo&count=0&tags=a`), &s, urlenc.WithRequireAllFields()), "Unmarshal succeeds") {
+			return
+		}
+		if !assert.Equal(t, RequiredPayload{Name: "foo", Tags: []string{"a"}}, s, "Unmarshal produces the expected result") {
+			return
+		}
+	})
+	t.Run("partially present", func(t *testing.T) {
+		var s RequiredPayload
+		if !assert.NoError(t, urlenc.Unmarshal([]byte(`name=foo`), &s), "Unmarshal without option succeeds") {
+			return
+		}
+
+		err := urlenc.UnmarshalWithOptions([]byte(`name=foo&optional=bar`), &s, urlenc.WithRequireAllFields())
+		if !assert.True(t, errors.Is(err, urlenc.ErrMissingFields), "error should be ErrMissingFields") {
+			return
+		}
+		if !assert.Contains(t, err.Error(), "count, tags", "error should list all missing keys") {
+			return
+		}
+	})
+	t.Run("present but zero", func(t *testing.T) {
+		var s RequiredNumbersPayload
+		if !assert.NoError(t, urlenc.UnmarshalWithOptions([]byte(`count=0&ratio=0.0&enabled=false&name=&limit=0`), &s, urlenc.WithRequireAllFields()), "zero values satisfy the requirement") {
+			return
+		}
+		if !assert.Equal(t, 0, *s.Limit, "pointers to zero values are allocated") {
+			return
+		}
+
+		err := urlenc.UnmarshalWithOptions([]byte(`ratio=0&enabled=false&name=`), &s, urlenc.WithRequireAllFields())
+		if !assert.True(t, errors.Is(err, urlenc.ErrMissingFields), "absent keys are missing") {
+			return
+		}
+		if !assert.Equal(t, `urlenc.Unmarshal: missing keys for required fields: count`, err.Error(), "only the absent key is listed") {
+			return
+		}
+	})
+}
+
+type Color int
+
+const (
+	Red Color = iota
+	Green
+	Blue
+)
+
+func (c Color) String() string {
+	switch c {
+	case Red:
+		return "red"
+	case Green:
+		return "green"
+	case Blue:
+		return "blue"
+	}
+	return "unknown"
+}
+
+type ColorPayload struct {
+	Color   Color   `urlenc:"color"`
+	Palette []Color `urlenc:"palette,omitempty"`
+}
+
+func TestRegisterEnum(t *testing.T) {
+	err := urlenc.RegisterEnum(Red, map[string]interface{}{
+		Red.String():   Red,
+		Green.String(): Green,
+		Blue.String():  Blue,
+	})
+	if !assert.NoError(t, err, "RegisterEnum succeeds") {
+		return
+	}
+
+	s := ColorPayload{Color: Green, Palette: []Color{Blue, Red}}
+	buf, err := urlenc.Marshal(s)
+	if !assert.NoError(t, err, "Marshal succeeds") {
+		return
+	}
+	if !assert.Equal(t, "color=green&palette=blue&palette=red", string(buf), "enums are marshaled as names") {
+		return
+	}
+
+	var decoded ColorPayload
+	if !assert.NoError(t, urlenc.Unmarshal(buf, &decoded), "Unmarshal succeeds") {
+		return
+	}
+	if !assert.Equal(t, s, decoded, "names are unmarshaled back to values") {
+		return
+	}
+
+	if !assert.Error(t, urlenc.Unmarshal([]byte(`color=purple`), &decoded), "Unmarshal with unknown name fails") {
+		return
+	}
+	if _, err := urlenc.Marshal(ColorPayload{Color: Color(42)}); !assert.Error(t, err, "Marshal with unknown value fails") {
+		return
+	}
+	if !assert.Error(t, urlenc.RegisterEnum(Red, map[string]interface{}{"red": 0}), "RegisterEnum with mismatched type fails") {
+		return
+	}
+}
+
+type UUIDPayload struct {
+	ID  [16]byte `urlenc:"id,encoding=hex"`
+	Raw []byte   `urlenc:"raw,omitempty,encoding=hex"`
+}
+
+func TestHexByteArray(t *testing.T) {
+	s := UUIDPayload{
+		ID:  [16]byte{0x12, 0x3e, 0x45, 0x67, 0xe8, 0x9b, 0x12, 0xd3, 0xa4, 0x56, 0x42, 0x66, 0x14, 0x17, 0x40, 0x00},
+		Raw: []byte{0xde, 0xad, 0xbe, 0xef},
+	}
+
+	buf, err := urlenc.Marshal(s)
+	if !assert.NoError(t, err, "Marshal succeeds") {
+		return
+	}
+	if !assert.Equal(t, "id=123e4567e89b12d3a456426614174000&raw=deadbeef", string(buf), "byte arrays are marshaled as hex") {
+		return
+	}
+
+	var decoded UUIDPayload
+	if !assert.NoError(t, urlenc.Unmarshal(buf, &decoded), "Unmarshal succeeds") {
+		return
+	}
+	if !assert.Equal(t, s, decoded, "hex is unmarshaled back into the array") {
+		return
+	}
+
+	if !assert.Error(t, urlenc.Unmarshal([]byte(`id=123e`), &decoded), "Unmarshal with wrong length fails") {
+		return
+	}
+	if !assert.Error(t, urlenc.Unmarshal([]byte(`id=xyz`), &decoded), "Unmarshal with invalid hex fails") {
+		return
+	}
+
+	_, err = urlenc.Marshal(struct {
+		Name string `urlenc:"name,encoding=hex"`
+	}{})
+	if !assert.Error(t, err, "encoding=hex on a non-byte field fails") {
+		return
+	}
+}
+
+type ByteListPayload struct {
+	Default []byte `urlenc:"default"`
+	CSV     []byte `urlenc:"csv,encoding=csv"`
+}
+
+func TestCSVByteSlice(t *testing.T) {
+	s := ByteListPayload{
+		Default: []byte{1, 2},
+		CSV:     []byte{1, 2, 255},
+	}
+
+	buf, err := urlenc.Marshal(s)
+	if !assert.NoError(t, err, "Marshal succeeds") {
+		return
+	}
+	if !assert.Equal(t, "csv=1%2C2%2C255&default=AQI%3D", string(buf), "encoding=csv overrides the default") {
+		return
+	}
+
+	var decoded ByteListPayload
+	if !assert.NoError(t, urlenc.Unmarshal(buf, &decoded), "Unmarshal succeeds") {
+		return
+	}
+	if !assert.Equal(t, s, decoded, "round trip produces the same result") {
+		return
+	}
+
+	if !assert.Error(t, urlenc.Unmarshal([]byte(`csv=1,256`), &decoded), "Unmarshal with out of range value fails") {
+		return
+	}
+}
+
+// Blob is not []byte itself, so its bytes are given one by one
+type Blob []byte
+
+type TokenBytesPayload struct {
+	Token []byte `urlenc:"token"`
+	Hex   []byte `urlenc:"hex,encoding=hex"`
+	Blob  Blob   `urlenc:"blob"`
+}
+
+func TestByteSliceBase64(t *testing.T) {
+	s := TokenBytesPayload{
+		Token: []byte{0xde, 0xad, 0xbe, 0xef},
+		Hex:   []byte{0xde, 0xad},
+		Blob:  Blob{1, 2},
+	}
+
+	buf, err := urlenc.Marshal(s)
+	if !assert.NoError(t, err, "Marshal succeeds") {
+		return
+	}
+	if !assert.Equal(t, "blob=1&blob=2&hex=dead&token=3q2-7w%3D%3D", string(buf), "[]byte is encoded as base64url") {
+		return
+	}
+
+	var decoded TokenBytesPayload
+	if !assert.NoError(t, urlenc.Unmarshal(buf, &decoded), "Unmarshal succeeds") {
+		return
+	}
+	if !assert.Equal(t, s, decoded, "round trip produces the same result") {
+		return
+	}
+
+	var sb strings.Builder
+	if !assert.NoError(t, urlenc.NewEncoder(&sb).Encode(s), "Encode succeeds") {
+		return
+	}
+	if !assert.Equal(t, string(buf), sb.String(), "Encoder produces the same result") {
+		return
+	}
+
+	if !assert.Error(t, urlenc.Unmarshal([]byte(`token=%21%21`), &decoded), "Unmarshal with invalid base64 fails") {
+		return
+	}
+}
+
+func TestMapPrefixed(t *testing.T) {
+	m := map[string]interface{}{
+		"foo": "one",
+		"bar": []string{"two", "three"},
+	}
+
+	buf, err := urlenc.MarshalMapPrefixed(m, "extra.")
+	if !assert.NoError(t, err, "MarshalMapPrefixed succeeds") {
+		return
+	}
+	if !assert.Equal(t, "extra.bar=two&extra.bar=three&extra.foo=one", string(buf), "keys are prefixed") {
+		return
+	}
+
+	src := append([]byte("name=baz&"), buf...)
+	decoded := make(map[string]interface{})
+	if !assert.NoError(t, urlenc.UnmarshalMapPrefixed(src, &decoded, "extra."), "UnmarshalMapPrefixed succeeds") {
+		return
+	}
+	if !assert.Equal(t, m, decoded, "prefix is stripped, and unprefixed keys are ignored") {
+		return
+	}
+
+	if _, err := urlenc.MarshalMapPrefixed(Foo{}, "extra."); !assert.Error(t, err, "MarshalMapPrefixed with a struct fails") {
+		return
+	}
+	var foo Foo
+	if !assert.Error(t, urlenc.UnmarshalMapPrefixed(src, &foo, "extra."), "UnmarshalMapPrefixed with a struct fails") {
+		return
+	}
+
+	// The caller's options are not written to
+	options := make([]urlenc.Option, 0, 8)
+	if _, err := urlenc.MarshalMapPrefixed(m, "extra.", options...); !assert.NoError(t, err, "MarshalMapPrefixed succeeds") {
+		return
+	}
+	if !assert.NoError(t, urlenc.UnmarshalMapPrefixed(src, &decoded, "extra.", options...), "UnmarshalMapPrefixed succeeds") {
+		return
+	}
+	if !assert.Nil(t, options[:1][0], "spare capacity is left alone") {
+		return
+	}
+}
+
+func TestUnmarshalMapMultiPolicy(t *testing.T) {
+	const src = `foo=one&foo=two&foo=three&bar=four`
+
+	testcases := []struct {
+		Name     string
+		Options  []urlenc.Option
+		Expected map[string]interface{}
+	}{
+		{
+			Name:     "default",
+			Expected: map[string]interface{}{"foo": []string{"one", "two", "three"}, "bar": "four"},
+		},
+		{
+			Name:     "MapMultiSlice",
+			Options:  []urlenc.Option{urlenc.WithMapMultiPolicy(urlenc.MapMultiSlice)},
+			Expected: map[string]interface{}{"foo": []string{"one", "two", "three"}, "bar": "four"},
+		},
+		{
+			Name:     "MapMultiFirst",
+			Options:  []urlenc.Option{urlenc.WithMapMultiPolicy(urlenc.MapMultiFirst)},
+			Expected: map[string]interface{}{"foo": "one", "bar": "four"},
+		},
+		{
+			Name:     "MapMultiLast",
+			Options:  []urlenc.Option{urlenc.WithMapMultiPolicy(urlenc.MapMultiLast)},
+			Expected: map[string]interface{}{"foo": "three", "bar": "four"},
+		},
+	}
+
+	for _, tc := range testcases {
+		tc := tc
+		t.Run(tc.Name, func(t *testing.T) {
+			m := make(map[string]interface{})
+			if !assert.NoError(t, urlenc.UnmarshalWithOptions([]byte(src), &m, tc.Options...), "Unmarshal succeeds") {
+				return
+			}
+			if !assert.Equal(t, tc.Expected, m, "Unmarshal produces the expected result") {
+				return
+			}
+		})
+	}
+}
+
+func TestUnmarshalTypedMap(t *testing.T) {
+	const src = `foo=one&foo=two&bar=three`
+
+	t.Run("map[string]string", func(t *testing.T) {
+		m := make(map[string]string)
+		if !assert.NoError(t, urlenc.Unmarshal([]byte(src), &m), "Unmarshal succeeds") {
+			return
+		}
+		if !assert.Equal(t, map[string]string{"foo": "one", "bar": "three"}, m, "the first value is stored") {
+			return
+		}
+
+		m = make(map[string]string)
+		if !assert.NoError(t, urlenc.UnmarshalWithOptions([]byte(src), &m, urlenc.WithMapMultiPolicy(urlenc.MapMultiLast)), "Unmarshal succeeds") {
+			return
+		}
+		if !assert.Equal(t, map[string]string{"foo": "two", "bar": "three"}, m, "MapMultiLast stores the last value") {
+			return
+		}
+	})
+	t.Run("map[string][]string", func(t *testing.T) {
+		m := make(map[string][]string)
+		if !assert.NoError(t, urlenc.Unmarshal([]byte(src), &m), "Unmarshal succeeds") {
+			return
+		}
+		if !assert.Equal(t, map[string][]string{"foo": {"one", "two"}, "bar": {"three"}}, m, "all values are stored, even single ones") {
+			return
+		}
+	})
+	t.Run("url.Values", func(t *testing.T) {
+		uv := url.Values{}
+		if !assert.NoError(t, urlenc.Unmarshal([]byte(src), &uv), "Unmarshal succeeds") {
+			return
+		}
+		if !assert.Equal(t, url.Values{"foo": {"one", "two"}, "bar": {"three"}}, uv, "defined map types work") {
+			return
+		}
+	})
+	t.Run("map[string]int", func(t *testing.T) {
+		m := make(map[string]int)
+		if !assert.NoError(t, urlenc.Unmarshal([]byte(`a=1&b=-2`), &m), "Unmarshal succeeds") {
+			return
+		}
+		if !assert.Equal(t, map[string]int{"a": 1, "b": -2}, m, "values are converted") {
+			return
+		}
+	})
+	t.Run("map[string][]int", func(t *testing.T) {
+		m := make(map[string][]int)
+		if !assert.NoError(t, urlenc.Unmarshal([]byte(`a=1&a=2&b=3`), &m), "Unmarshal succeeds") {
+			return
+		}
+		if !assert.Equal(t, map[string][]int{"a": {1, 2}, "b": {3}}, m, "each value is converted") {
+			return
+		}
+	})
+	t.Run("map[string]float64", func(t *testing.T) {
+		m := make(map[string]float64)
+		if !assert.NoError(t, urlenc.Unmarshal([]byte(`pi=3.14`), &m), "Unmarshal succeeds") {
+			return
+		}
+		if !assert.Equal(t, map[string]float64{"pi": 3.14}, m, "values are converted") {
+			return
+		}
+	})
+	t.Run("invalid value", func(t *testing.T) {
+		m := make(map[string][]int)
+		err := urlenc.Unmarshal([]byte(`a=1&a=x`), &m)
+		if !assert.True(t, errors.Is(err, strconv.ErrSyntax), "the parse error is unwrapped") {
+			return
+		}
+		if !assert.Equal(t, `urlenc.Unmarshal: failed to decode key a: failed to decode element 1: strconv.ParseInt: parsing "x": invalid syntax`, err.Error(), "error names the key") {
+			return
+		}
+	})
+	t.Run("unsupported element type", func(t *testing.T) {
+		m := make(map[string]chan int)
+		err := urlenc.Unmarshal([]byte(src), &m)
+		if !assert.True(t, errors.Is(err, urlenc.ErrUnsupportedType), "error should be ErrUnsupportedType") {
+			return
+		}
+	})
+}
+
+type SplitPayload struct {
+	Path  []string `urlenc:"path,split=."`
+	Names []string `urlenc:"names,omitempty,split=|"`
+	IDs   []int    `urlenc:"ids,split=|"`
+}
+
+func TestSplitField(t *testing.T) {
+	const src = `ids=1%7C2%7C3&names=foo%7Cbar&path=a.b.c`
+
+	var s SplitPayload
+	if !assert.NoError(t, urlenc.Unmarshal([]byte(src), &s), "Unmarshal succeeds") {
+		return
+	}
+	expected := SplitPayload{
+		Path:  []string{"a", "b", "c"},
+		Names: []string{"foo", "bar"},
+		IDs:   []int{1, 2, 3},
+	}
+	if !assert.Equal(t, expected, s, "values are split on the given separator") {
+		return
+	}
+
+	buf, err := urlenc.Marshal(s)
+	if !assert.NoError(t, err, "Marshal succeeds") {
+		return
+	}
+	if !assert.Equal(t, src, string(buf), "elements are joined using the given separator") {
+		return
+	}
+
+	buf, err = urlenc.Marshal(SplitPayload{Path: []string{"a"}})
+	if !assert.NoError(t, err, "Marshal succeeds") {
+		return
+	}
+	if !assert.Equal(t, "path=a", string(buf), "empty slices produce no value") {
+		return
+	}
+}
+
+type UnicodePayload struct {
+	Cafe   string `urlenc:"café"`
+	Resume string `urlenc:"Résumé"`
+}
+
+func TestUnmarshalUnicodeKeyNormalization(t *testing.T) {
+	// "cafe\u0301" is the decomposed form of "caf\u00e9"
+	src := url.QueryEscape("cafe\u0301") + `=latte&` + url.QueryEscape("R\u00c9SUM\u00c9") + `=cv`
+
+	var s UnicodePayload
+	if !assert.NoError(t, urlenc.Unmarshal([]byte(src), &s), "Unmarshal succeeds") {
+		return
+	}
+	if !assert.Equal(t, UnicodePayload{}, s, "keys do not match without normalization") {
+		return
+	}
+
+	if !assert.NoError(t, urlenc.UnmarshalWithOptions([]byte(src), &s, urlenc.WithUnicodeKeyNormalization()), "Unmarshal succeeds") {
+		return
+	}
+	if !assert.Equal(t, UnicodePayload{Cafe: "latte", Resume: "cv"}, s, "keys match after normalization") {
+		return
+	}
+
+	s = UnicodePayload{}
+	if !assert.NoError(t, urlenc.UnmarshalWithOptions([]byte(`cafe=mocha`), &s, urlenc.WithUnicodeKeyNormalization()), "Unmarshal succeeds") {
+		return
+	}
+	if !assert.Equal(t, "mocha", s.Cafe, "accents are ignored") {
+		return
+	}
+
+	s = UnicodePayload{}
+	if !assert.NoError(t, urlenc.UnmarshalWithOptions([]byte(url.QueryEscape("\uff23\uff21\uff26\uff25")+`=espresso`), &s, urlenc.WithUnicodeKeyNormalization()), "Unmarshal succeeds") {
+		return
+	}
+	if !assert.Equal(t, "espresso", s.Cafe, "fullwidth forms are decomposed") {
+		return
+	}
+}
+
+type BatchPayload struct {
+	Action string `urlenc:"action"`
+	IDs    []int  `urlenc:"ids,batch"`
+}
+
+func TestMarshalBatch(t *testing.T) {
+	s := BatchPayload{Action: "delete", IDs: []int{1, 2, 3, 4, 5}}
+
+	list, err := urlenc.MarshalBatch(s, 2)
+	if !assert.NoError(t, err, "MarshalBatch succeeds") {
+		return
+	}
+
+	var produced []string
+	for _, buf := range list {
+		produced = append(produced, string(buf))
+	}
+	expected := []string{
+		"action=delete&ids=1&ids=2",
+		"action=delete&ids=3&ids=4",
+		"action=delete&ids=5",
+	}
+	if !assert.Equal(t, expected, produced, "MarshalBatch produces the expected result") {
+		return
+	}
+	if !assert.Equal(t, []int{1, 2, 3, 4, 5}, s.IDs, "original value is untouched") {
+		return
+	}
+
+	list, err = urlenc.MarshalBatch(BatchPayload{Action: "noop"}, 2)
+	if !assert.NoError(t, err, "MarshalBatch succeeds") {
+		return
+	}
+	if !assert.Len(t, list, 1, "empty slice produces a single batch") {
+		return
+	}
+	if !assert.Equal(t, "action=noop", string(list[0]), "MarshalBatch produces the expected result") {
+		return
+	}
+
+	if _, err := urlenc.MarshalBatch(Foo{}, 2); !assert.Error(t, err, "struct without batch field fails") {
+		return
+	}
+	if _, err := urlenc.MarshalBatch(s, 0); !assert.Error(t, err, "non-positive perBatch fails") {
+		return
+	}
+
+	t.Run("behind an embedded pointer", func(t *testing.T) {
+		s := EmbeddedBatchPayload{Name: "x", BatchIDs: &BatchIDs{IDs: []int{1, 2, 3, 4, 5}}}
+		list, err := urlenc.MarshalBatch(s, 2)
+		if !assert.NoError(t, err, "MarshalBatch succeeds") {
+			return
+		}
+
+		var produced []string
+		for _, buf := range list {
+			produced = append(produced, string(buf))
+		}
+		expected := []string{
+			"ids=1&ids=2&name=x",
+			"ids=3&ids=4&name=x",
+			"ids=5&name=x",
+		}
+		if !assert.Equal(t, expected, produced, "all of the elements are batched") {
+			return
+		}
+		if !assert.Equal(t, []int{1, 2, 3, 4, 5}, s.IDs, "original value is untouched") {
+			return
+		}
+	})
+}
+
+type BatchIDs struct {
+	IDs []int `urlenc:"ids,batch"`
+}
+
+type EmbeddedBatchPayload struct {
+	Name string `urlenc:"name"`
+	*BatchIDs
+}
+
+func TestMapOmitEmpty(t *testing.T) {
+	m := map[string]interface{}{
+		"name":  "",
+		"count": 0,
+		"tags":  []string(nil),
+		"keep":  "yes",
+	}
+	s := ZeroInt{}
+
+	buf, err := urlenc.Marshal(m)
+	if !assert.NoError(t, err, "Marshal succeeds") {
+		return
+	}
+	if !assert.Equal(t, "count=0&keep=yes&name=", string(buf), "maps do not omit zero values by default") {
+		return
+	}
+
+	buf, err = urlenc.MarshalWithOptions(m, urlenc.WithMapOmitEmpty(true))
+	if !assert.NoError(t, err, "Marshal succeeds") {
+		return
+	}
+	if !assert.Equal(t, "keep=yes", string(buf), "maps omit zero values with WithMapOmitEmpty(true)") {
+		return
+	}
+
+	// Struct fields are still controlled by their tags
+	buf, err = urlenc.MarshalWithOptions(s, urlenc.WithMapOmitEmpty(false))
+	if !assert.NoError(t, err, "Marshal succeeds") {
+		return
+	}
+	if !assert.Equal(t, "", string(buf), "omitempty struct tag is still honored") {
+		return
+	}
+	buf, err = urlenc.MarshalWithOptions(RequiredPayload{}, urlenc.WithMapOmitEmpty(true))
+	if !assert.NoError(t, err, "Marshal succeeds") {
+		return
+	}
+	if !assert.Equal(t, "count=0&name=", string(buf), "struct fields without omitempty are not dropped") {
+		return
+	}
+}
+
+type MaybeIntPtr struct {
+	Valid bool
+	Int   *int
+}
+
+func (m MaybeIntPtr) Value() interface{} {
+	return m.Int
+}
+
+type NilValuerPayload struct {
+	Required MaybeIntPtr `urlenc:"required,,int"`
+	Optional MaybeIntPtr `urlenc:"optional,omitempty,int"`
+}
+
+func TestMarshalNilPointerValuer(t *testing.T) {
+	// The wrappers are non-zero, so omitempty does not kick in by itself
+	var nilptr *int
+	s := NilValuerPayload{
+		Required: MaybeIntPtr{Valid: true, Int: nilptr},
+		Optional: MaybeIntPtr{Valid: true, Int: nilptr},
+	}
+	buf, err := urlenc.Marshal(s)
+	if !assert.NoError(t, err, "Marshal succeeds") {
+		return
+	}
+	if !assert.Equal(t, "required=", string(buf), "nil values are emitted as empty, or skipped under omitempty") {
+		return
+	}
+
+	one, two := 1, 2
+	s = NilValuerPayload{
+		Required: MaybeIntPtr{Int: &one},
+		Optional: MaybeIntPtr{Int: &two},
+	}
+	buf, err = urlenc.Marshal(s)
+	if !assert.NoError(t, err, "Marshal succeeds") {
+		return
+	}
+	if !assert.Equal(t, "optional=2&required=1", string(buf), "non-nil pointers are dereferenced") {
+		return
+	}
+}
+
+type FlagPayload struct {
+	Active  bool `urlenc:"active"`
+	Verbose bool `urlenc:"verbose"`
+	Other   int  `urlenc:"other"`
+}
+
+func TestUnmarshalFlagBooleans(t *testing.T) {
+	const src = `active&other=1`
+
+	var s FlagPayload
+	if !assert.Error(t, urlenc.Unmarshal([]byte(src), &s), "Unmarshal without option fails") {
+		return
+	}
+
+	s = FlagPayload{}
+	if !assert.NoError(t, urlenc.UnmarshalWithOptions([]byte(src), &s, urlenc.WithFlagBooleans()), "Unmarshal succeeds") {
+		return
+	}
+	if !assert.Equal(t, FlagPayload{Active: true, Other: 1}, s, "keys without values are true") {
+		return
+	}
+
+	s = FlagPayload{}
+	if !assert.NoError(t, urlenc.UnmarshalWithOptions([]byte(`active=false&verbose=`), &s, urlenc.WithFlagBooleans()), "Unmarshal succeeds") {
+		return
+	}
+	if !assert.Equal(t, FlagPayload{Active: false, Verbose: true}, s, "explicit values are still honored") {
+		return
+	}
+}
+
+func TestMarshalNonFinitePolicy(t *testing.T) {
+	s := PricePayload{
+		Price:  math.Inf(1),
+		Prices: []float64{1.5, math.NaN(), 2.5},
+	}
+
+	testcases := []struct {
+		Name     string
+		Policy   urlenc.NonFinitePolicy
+		Expected string
+		Error    bool
+	}{
+		{Name: "allow", Policy: urlenc.NonFiniteAllow, Expected: "price=%2BInf&prices=1.5&prices=NaN&prices=2.5"},
+		{Name: "error", Policy: urlenc.NonFiniteError, Error: true},
+		{Name: "skip", Policy: urlenc.NonFiniteSkip, Expected: "prices=1.5&prices=2.5"},
+		{Name: "empty", Policy: urlenc.NonFiniteEmpty, Expected: "price=&prices=1.5&prices=&prices=2.5"},
+	}
+
+	for _, tc := range testcases {
+		tc := tc
+		t.Run(tc.Name, func(t *testing.T) {
+			buf, err := urlenc.MarshalWithOptions(s, urlenc.WithNonFinitePolicy(tc.Policy))
+			if tc.Error {
+				if !assert.Error(t, err, "Marshal fails") {
+					return
+				}
+				_, err = urlenc.MarshalWithOptions(PricePayload{Prices: []float64{math.NaN()}}, urlenc.WithNonFinitePolicy(tc.Policy))
+				if !assert.Error(t, err, "Marshal fails for a NaN slice element") {
+					return
+				}
+				return
+			}
+			if !assert.NoError(t, err, "Marshal succeeds") {
+				return
+			}
+			if !assert.Equal(t, tc.Expected, string(buf), "Marshal produces the expected result") {
+				return
+			}
+		})
+	}
+}
+
+type Point struct {
+	X int
+	Y int
+}
+
+func (p *Point) SetValues(uv url.Values) error {
+	for k, list := range uv {
+		n, err := strconv.Atoi(list[0])
+		if err != nil {
+			return err
+		}
+		switch k {
+		case "x":
+			p.X = n
+		case "y":
+			p.Y = n
+		default:
+			return errors.New("unknown key " + k)
+		}
+	}
+	return nil
+}
+
+type PointPayload struct {
+	Name   string `urlenc:"name"`
+	Origin Point  `urlenc:"origin"`
+}
+
+func TestUnmarshalValuesSetter(t *testing.T) {
+	var s PointPayload
+	if !assert.NoError(t, urlenc.Unmarshal([]byte(`name=foo&origin[x]=1&origin[y]=2&other[x]=3`), &s), "Unmarshal succeeds") {
+		return
+	}
+	if !assert.Equal(t, PointPayload{Name: "foo", Origin: Point{X: 1, Y: 2}}, s, "SetValues receives the namespaced subset") {
+		return
+	}
+
+	err := urlenc.Unmarshal([]byte(`origin[x]=foo`), &s)
+	if !assert.True(t, errors.Is(err, strconv.ErrSyntax), "errors from SetValues are propagated") {
+		return
+	}
+
+	_, err = urlenc.Marshal(s)
+	if !assert.True(t, errors.Is(err, urlenc.ErrUnsupportedType), "Marshal without Valuer fails") {
+		return
+	}
+}
+
+type NetworkPayload struct {
+	MAC    net.HardwareAddr `urlenc:"mac"`
+	Subnet *net.IPNet       `urlenc:"subnet,omitempty"`
+}
+
+func TestNetworkTypes(t *testing.T) {
+	mac, _ := net.ParseMAC("00:00:5e:00:53:01")
+	_, subnet, _ := net.ParseCIDR("192.0.2.0/24")
+
+	buf, err := urlenc.Marshal(NetworkPayload{MAC: mac, Subnet: subnet})
+	if !assert.NoError(t, err, "Marshal succeeds") {
+		return
+	}
+	if !assert.Equal(t, `mac=00%3A00%3A5e%3A00%3A53%3A01&subnet=192.0.2.0%2F24`, string(buf), "Marshal produces the expected result") {
+		return
+	}
+
+	var s NetworkPayload
+	if !assert.NoError(t, urlenc.Unmarshal(buf, &s), "Unmarshal succeeds") {
+		return
+	}
+	if !assert.Equal(t, mac, s.MAC, "MAC round-trips") {
+		return
+	}
+	if !assert.NotNil(t, s.Subnet, "pointer is allocated") {
+		return
+	}
+	if !assert.Equal(t, subnet.String(), s.Subnet.String(), "subnet round-trips") {
+		return
+	}
+
+	buf, err = urlenc.Marshal(NetworkPayload{MAC: mac})
+	if !assert.NoError(t, err, "Marshal succeeds") {
+		return
+	}
+	if !assert.Equal(t, `mac=00%3A00%3A5e%3A00%3A53%3A01`, string(buf), "nil subnet is omitted") {
+		return
+	}
+
+	err = urlenc.Unmarshal([]byte(`subnet=192.0.2.0`), &s)
+	if !assert.Error(t, err, "Unmarshal fails without a prefix length") {
+		return
+	}
+}
+
+type RangePayload struct {
+	Name string `urlenc:"name"`
+	Min  int    `urlenc:"-"`
+	Max  int    `urlenc:"-"`
+}
+
+func TestFieldSplitter(t *testing.T) {
+	splitRange := func(v string, rv reflect.Value) error {
+		parts := strings.SplitN(v, "-", 2)
+		if len(parts) != 2 {
+			return errors.New("invalid range " + v)
+		}
+		min, err := strconv.Atoi(parts[0])
+		if err != nil {
+			return err
+		}
+		max, err := strconv.Atoi(parts[1])
+		if err != nil {
+			return err
+		}
+		rv.FieldByName("Min").SetInt(int64(min))
+		rv.FieldByName("Max").SetInt(int64(max))
+		return nil
+	}
+
+	var s RangePayload
+	if !assert.NoError(t, urlenc.UnmarshalWithOptions([]byte(`name=foo&range=10-20`), &s, urlenc.WithFieldSplitter("range", splitRange)), "Unmarshal succeeds") {
+		return
+	}
+	if !assert.Equal(t, RangePayload{Name: "foo", Min: 10, Max: 20}, s, "range is split into two fields") {
+		return
+	}
+
+	err := urlenc.UnmarshalWithOptions([]byte(`range=10`), &s, urlenc.WithFieldSplitter("range", splitRange))
+	if !assert.Error(t, err, "errors from the splitter are propagated") {
+		return
+	}
+
+	t.Run("order", func(t *testing.T) {
+		// Both splitters set Min, and are called in sorted key order
+		splitMin := func(v string, rv reflect.Value) error {
+			min, err := strconv.Atoi(v)
+			if err != nil {
+				return err
+			}
+			rv.FieldByName("Min").SetInt(int64(min))
+			return nil
+		}
+		options := []urlenc.Option{
+			urlenc.WithFieldSplitter("z", splitMin),
+			urlenc.WithFieldSplitter("range", splitRange),
+			urlenc.WithFieldSplitter("a", splitMin),
+		}
+		for i := 0; i < 20; i++ {
+			var s RangePayload
+			if !assert.NoError(t, urlenc.UnmarshalWithOptions([]byte(`a=1&range=10-20&z=5`), &s, options...), "Unmarshal succeeds") {
+				return
+			}
+			if !assert.Equal(t, RangePayload{Min: 5, Max: 20}, s, "the splitter for the last key wins") {
+				return
+			}
+		}
+	})
+}
+
+type ProfilePayload struct {
+	Name  string   `urlenc:"name"`
+	Age   int      `urlenc:"age"`
+	Tags  []string `urlenc:"tags"`
+	Email string   `urlenc:"email,omitempty"`
+}
+
+func TestMarshalDiff(t *testing.T) {
+	old := ProfilePayload{Name: "foo", Age: 20, Tags: []string{"a", "b"}, Email: "foo@example.com"}
+
+	testcases := []struct {
+		Name     string
+		New      ProfilePayload
+		Expected string
+	}{
+		{
+			Name:     "no changes",
+			New:      ProfilePayload{Name: "foo", Age: 20, Tags: []string{"a", "b"}, Email: "foo@example.com"},
+			Expected: ``,
+		},
+		{
+			Name:     "scalar changed",
+			New:      ProfilePayload{Name: "foo", Age: 21, Tags: []string{"a", "b"}, Email: "foo@example.com"},
+			Expected: `age=21`,
+		},
+		{
+			Name:     "slice changed",
+			New:      ProfilePayload{Name: "bar", Age: 20, Tags: []string{"a", "c"}, Email: "foo@example.com"},
+			Expected: `name=bar&tags=a&tags=c`,
+		},
+		{
+			Name:     "omitempty field cleared",
+			New:      ProfilePayload{Name: "foo", Age: 20, Tags: []string{"a", "b"}},
+			Expected: ``,
+		},
+	}
+
+	for _, tc := range testcases {
+		tc := tc
+		t.Run(tc.Name, func(t *testing.T) {
+			buf, err := urlenc.MarshalDiff(old, &tc.New)
+			if !assert.NoError(t, err, "MarshalDiff succeeds") {
+				return
+			}
+			if !assert.Equal(t, tc.Expected, string(buf), "MarshalDiff produces the expected result") {
+				return
+			}
+		})
+	}
+
+	_, err := urlenc.MarshalDiff(old, PointPayload{})
+	if !assert.Error(t, err, "MarshalDiff fails for different types") {
+		return
+	}
+}
+
+type Extras map[string][]string
+
+type ExtrasPayload struct {
+	Name string            `urlenc:"name"`
+	Meta map[string]string `urlenc:"meta"`
+	Extras
+}
+
+func TestEmbeddedMapCatchAll(t *testing.T) {
+	var s ExtrasPayload
+	if !assert.NoError(t, urlenc.Unmarshal([]byte(`name=foo&meta[a]=1&x=1&x=2&y=3`), &s), "Unmarshal succeeds") {
+		return
+	}
+	expected := ExtrasPayload{
+		Name:   "foo",
+		Meta:   map[string]string{"a": "1"},
+		Extras: Extras{"x": {"1", "2"}, "y": {"3"}},
+	}
+	if !assert.Equal(t, expected, s, "unmatched keys are captured by the embedded map") {
+		return
+	}
+
+	buf, err := urlenc.Marshal(s)
+	if !assert.NoError(t, err, "Marshal succeeds") {
+		return
+	}
+	if !assert.Equal(t, `meta%5Ba%5D=1&name=foo&x=1&x=2&y=3`, string(buf), "embedded map elements are marshaled as top-level keys") {
+		return
+	}
+
+	s = ExtrasPayload{}
+	if !assert.NoError(t, urlenc.Unmarshal([]byte(`name=foo`), &s), "Unmarshal succeeds") {
+		return
+	}
+	if !assert.Nil(t, s.Extras, "embedded map is left alone without extra keys") {
+		return
+	}
+}
+
+type FilterPayload struct {
+	Filters []map[string]string `urlenc:"filters"`
+}
+
+func TestSliceOfMaps(t *testing.T) {
+	var s FilterPayload
+	if !assert.NoError(t, urlenc.Unmarshal([]byte(`filters[0][k]=a&filters[0][v]=1&filters[1][k]=b`), &s), "Unmarshal succeeds") {
+		return
+	}
+	expected := FilterPayload{
+		Filters: []map[string]string{
+			{"k": "a", "v": "1"},
+			{"k": "b"},
+		},
+	}
+	if !assert.Equal(t, expected, s, "elements are grouped by index") {
+		return
+	}
+
+	buf, err := urlenc.Marshal(s)
+	if !assert.NoError(t, err, "Marshal succeeds") {
+		return
+	}
+	if !assert.Equal(t, `filters%5B0%5D%5Bk%5D=a&filters%5B0%5D%5Bv%5D=1&filters%5B1%5D%5Bk%5D=b`, string(buf), "Marshal produces the expected result") {
+		return
+	}
+}
+
+type SwitchPayload struct {
+	Enabled bool   `urlenc:"enabled"`
+	Debug   bool   `urlenc:"debug"`
+	Modes   []bool `urlenc:"modes"`
+}
+
+func TestNumericBooleans(t *testing.T) {
+	s := SwitchPayload{Enabled: true, Modes: []bool{false, true}}
+	buf, err := urlenc.MarshalWithOptions(s, urlenc.WithNumericBooleans())
+	if !assert.NoError(t, err, "Marshal succeeds") {
+		return
+	}
+	if !assert.Equal(t, `debug=0&enabled=1&modes=0&modes=1`, string(buf), "booleans are encoded as 1/0") {
+		return
+	}
+
+	var decoded SwitchPayload
+	if !assert.NoError(t, urlenc.UnmarshalWithOptions(buf, &decoded, urlenc.WithNumericBooleans()), "Unmarshal succeeds") {
+		return
+	}
+	if !assert.Equal(t, s, decoded, "round trip produces the same result") {
+		return
+	}
+
+	decoded = SwitchPayload{}
+	if !assert.NoError(t, urlenc.UnmarshalWithOptions([]byte(`enabled=true&debug=false`), &decoded, urlenc.WithNumericBooleans()), "Unmarshal succeeds") {
+		return
+	}
+	if !assert.True(t, decoded.Enabled, "true/false are still accepted") {
+		return
+	}
+}
+
+type ExtraValuesPayload struct {
+	Name  string     `urlenc:"name"`
+	Extra url.Values `urlenc:"Extra"`
+}
+
+func TestURLValuesField(t *testing.T) {
+	s := ExtraValuesPayload{
+		Name:  "foo",
+		Extra: url.Values{"a": {"1"}, "b": {"2", "3"}},
+	}
+
+	testcases := []struct {
+		Name     string
+		Style    urlenc.MapKeyStyle
+		Expected string
+	}{
+		{
+			Name:     "bracket",
+			Style:    urlenc.MapKeyBracket,
+			Expected: `Extra%5Ba%5D=1&Extra%5Bb%5D=2&Extra%5Bb%5D=3&name=foo`,
+		},
+		{
+			Name:     "dot",
+			Style:    urlenc.MapKeyDot,
+			Expected: `Extra.a=1&Extra.b=2&Extra.b=3&name=foo`,
+		},
+	}
+
+	for _, tc := range testcases {
+		tc := tc
+		t.Run(tc.Name, func(t *testing.T) {
+			buf, err := urlenc.MarshalWithOptions(s, urlenc.WithMapKeyStyle(tc.Style))
+			if !assert.NoError(t, err, "Marshal succeeds") {
+				return
+			}
+			if !assert.Equal(t, tc.Expected, string(buf), "Marshal produces the expected result") {
+				return
+			}
+
+			var decoded ExtraValuesPayload
+			if !assert.NoError(t, urlenc.UnmarshalWithOptions(buf, &decoded, urlenc.WithMapKeyStyle(tc.Style)), "Unmarshal succeeds") {
+				return
+			}
+			if !assert.Equal(t, s, decoded, "round trip produces the same result") {
+				return
+			}
+		})
+	}
+}
+
+func TestMaxOutputBytes(t *testing.T) {
+	s := ProfilePayload{Name: "foo", Age: 20}
+
+	buf, err := urlenc.MarshalWithOptions(s, urlenc.WithMaxOutputBytes(15))
+	if !assert.NoError(t, err, "Marshal within the limit succeeds") {
+		return
+	}
+	if !assert.Equal(t, `age=20&name=foo`, string(buf), "Marshal produces the expected result") {
+		return
+	}
+
+	_, err = urlenc.MarshalWithOptions(s, urlenc.WithMaxOutputBytes(14))
+	if !assert.True(t, errors.Is(err, urlenc.ErrOutputTooLarge), "Marshal exceeding the limit fails") {
+		return
+	}
+}
+
+func TestMarshalAppend(t *testing.T) {
+	s := ProfilePayload{Name: "foo bar", Age: 20}
+
+	buf, err := urlenc.MarshalAppend([]byte("https://example.com/?"), s)
+	if !assert.NoError(t, err, "MarshalAppend succeeds") {
+		return
+	}
+	if !assert.Equal(t, `https://example.com/?age=20&name=foo+bar`, string(buf), "query is appended") {
+		return
+	}
+
+	// Options that change the serialization also apply
+	buf, err = urlenc.MarshalAppend([]byte("?"), s, urlenc.WithKeyOrder([]string{"name"}), urlenc.WithSpaceAsPercent20())
+	if !assert.NoError(t, err, "MarshalAppend succeeds") {
+		return
+	}
+	if !assert.Equal(t, `?name=foo%20bar&age=20`, string(buf), "options are applied") {
+		return
+	}
+	buf, err = urlenc.MarshalAppend([]byte("?"), s, urlenc.WithRFC3986Escaping())
+	if !assert.NoError(t, err, "MarshalAppend succeeds") {
+		return
+	}
+	if !assert.Equal(t, `?age=20&name=foo%20bar`, string(buf), "RFC 3986 escaping is applied") {
+		return
+	}
+
+	// The limit only applies to the appended part
+	buf, err = urlenc.MarshalAppend([]byte("https://example.com/?"), s, urlenc.WithMaxOutputBytes(19))
+	if !assert.NoError(t, err, "MarshalAppend within the limit succeeds") {
+		return
+	}
+	if !assert.Equal(t, `https://example.com/?age=20&name=foo+bar`, string(buf), "query is appended") {
+		return
+	}
+	buf, err = urlenc.MarshalAppend([]byte("https://example.com/?"), s, urlenc.WithMaxOutputBytes(18))
+	if !assert.True(t, errors.Is(err, urlenc.ErrOutputTooLarge), "MarshalAppend exceeding the limit fails") {
+		return
+	}
+	if !assert.Equal(t, `https://example.com/?`, string(buf), "dst is returned as is on error") {
+		return
+	}
+	buf, err = urlenc.MarshalAppend([]byte("https://example.com/?"), 1)
+	if !assert.True(t, errors.Is(err, urlenc.ErrUnsupportedType), "MarshalAppend of an unsupported type fails") {
+		return
+	}
+	if !assert.Equal(t, `https://example.com/?`, string(buf), "dst is returned as is on error") {
+		return
+	}
+
+	// The buffer is reused if it is large enough
+	dst := make([]byte, 0, 64)
+	buf, err = urlenc.MarshalAppend(dst, s)
+	if !assert.NoError(t, err, "MarshalAppend succeeds") {
+		return
+	}
+	if !assert.Equal(t, &dst[:1][0], &buf[0], "backing array is reused") {
+		return
+	}
+}
+
+func BenchmarkMarshalAppend(b *testing.B) {
+	s := ProfilePayload{Name: "foo", Age: 20}
+	b.Run("Marshal", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := urlenc.Marshal(s); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("MarshalAppend", func(b *testing.B) {
+		b.ReportAllocs()
+		buf := make([]byte, 0, 64)
+		for i := 0; i < b.N; i++ {
+			var err error
+			buf, err = urlenc.MarshalAppend(buf[:0], s)
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+type Code string
+
+func (c Code) Value() interface{} {
+	panic("Value should not be called")
+}
+
+func (c *Code) Set(v interface{}) error {
+	panic("Set should not be called")
+}
+
+type CodePayload struct {
+	Code Code `urlenc:"code"`
+}
+
+func TestWithoutValuerSetter(t *testing.T) {
+	s := CodePayload{Code: "abc"}
+	buf, err := urlenc.MarshalWithOptions(s, urlenc.WithoutValuerSetter())
+	if !assert.NoError(t, err, "Marshal succeeds") {
+		return
+	}
+	if !assert.Equal(t, `code=abc`, string(buf), "Value is not called") {
+		return
+	}
+
+	var decoded CodePayload
+	if !assert.NoError(t, urlenc.UnmarshalWithOptions(buf, &decoded, urlenc.WithoutValuerSetter()), "Unmarshal succeeds") {
+		return
+	}
+	if !assert.Equal(t, s, decoded, "Set is not called") {
+		return
+	}
+
+	if !assert.Panics(t, func() { _, _ = urlenc.Marshal(s) }, "Value is called without the option") {
+		return
+	}
+}
+
+type Paging struct {
+	Page  int `urlenc:"page"`
+	Limit int `urlenc:"limit"`
+}
+
+type Sorting struct {
+	Sort  string `urlenc:"sort"`
+	Limit int    `urlenc:"limit"`
+}
+
+type SearchPayload struct {
+	Query string `urlenc:"q"`
+	Paging
+	*Sorting
+}
+
+func TestEmbeddedStructs(t *testing.T) {
+	var s SearchPayload
+	if !assert.NoError(t, urlenc.Unmarshal([]byte(`q=foo&page=2&limit=10&sort=name`), &s), "Unmarshal succeeds") {
+		return
+	}
+	if !assert.Equal(t, "foo", s.Query, "direct field is decoded") {
+		return
+	}
+	if !assert.Equal(t, Paging{Page: 2}, s.Paging, "embedded struct fields are decoded, and ambiguous keys are left alone") {
+		return
+	}
+	if !assert.NotNil(t, s.Sorting, "embedded pointer is allocated") {
+		return
+	}
+	if !assert.Equal(t, Sorting{Sort: "name"}, *s.Sorting, "embedded pointer fields are decoded, and ambiguous keys are left alone") {
+		return
+	}
+
+	buf, err := urlenc.Marshal(s)
+	if !assert.NoError(t, err, "Marshal succeeds") {
+		return
+	}
+	if !assert.Equal(t, `page=2&q=foo&sort=name`, string(buf), "Marshal produces the expected result") {
+		return
+	}
+
+	buf, err = urlenc.Marshal(SearchPayload{Query: "foo"})
+	if !assert.NoError(t, err, "Marshal succeeds") {
+		return
+	}
+	if !assert.Equal(t, `page=0&q=foo`, string(buf), "fields in nil embedded pointers are skipped") {
+		return
+	}
+
+	s = SearchPayload{}
+	if !assert.NoError(t, urlenc.Unmarshal([]byte(`q=foo`), &s), "Unmarshal succeeds") {
+		return
+	}
+	if !assert.Nil(t, s.Sorting, "embedded pointer is not allocated without any of its keys") {
+		return
+	}
+}
+
+func TestWithSortValues(t *testing.T) {
+	t.Run("slice values", func(t *testing.T) {
+		s := SignedPayload{Nonce: "x", Scopes: []string{"write", "admin", "read"}}
+		buf, err := urlenc.MarshalWithOptions(s, urlenc.WithSortValues())
+		if !assert.NoError(t, err, "Marshal succeeds") {
+			return
+		}
+		if !assert.Equal(t, `amount=0&oauth_callback=&oauth_nonce=x&scope=admin&scope=read&scope=write`, string(buf), "values are sorted") {
+			return
+		}
+
+		buf, err = urlenc.Marshal(s)
+		if !assert.NoError(t, err, "Marshal succeeds") {
+			return
+		}
+		if !assert.Equal(t, `amount=0&oauth_callback=&oauth_nonce=x&scope=write&scope=admin&scope=read`, string(buf), "values are left in order without the option") {
+			return
+		}
+	})
+	t.Run("values from map iteration", func(t *testing.T) {
+		// Both elements produce the key "a.b", in map iteration order
+		m := map[string]interface{}{
+			"a.b": "2",
+			"a":   map[string]string{"b": "1"},
+		}
+		for i := 0; i < 20; i++ {
+			buf, err := urlenc.MarshalWithOptions(m, urlenc.WithMapKeyStyle(urlenc.MapKeyDot), urlenc.WithSortValues())
+			if !assert.NoError(t, err, "Marshal succeeds") {
+				return
+			}
+			if !assert.Equal(t, `a.b=1&a.b=2`, string(buf), "output is deterministic") {
+				return
+			}
+		}
+	})
+	t.Run("MarshalValues", func(t *testing.T) {
+		uv, err := urlenc.MarshalValues(SignedPayload{Scopes: []string{"b", "a"}}, urlenc.WithSortValues())
+		if !assert.NoError(t, err, "MarshalValues succeeds") {
+			return
+		}
+		if !assert.Equal(t, []string{"a", "b"}, uv["scope"], "values are sorted") {
+			return
+		}
+	})
+	t.Run("MarshalDiff", func(t *testing.T) {
+		buf, err := urlenc.MarshalDiff(SignedPayload{}, SignedPayload{Scopes: []string{"z", "a"}}, urlenc.WithSortValues())
+		if !assert.NoError(t, err, "MarshalDiff succeeds") {
+			return
+		}
+		if !assert.Equal(t, `scope=a&scope=z`, string(buf), "values are sorted") {
+			return
+		}
+	})
+	t.Run("MarshalBatch", func(t *testing.T) {
+		list, err := urlenc.MarshalBatch(BatchPayload{Action: "delete", IDs: []int{5, 4, 3}}, 2, urlenc.WithSortValues())
+		if !assert.NoError(t, err, "MarshalBatch succeeds") {
+			return
+		}
+		if !assert.Len(t, list, 2, "two batches") {
+			return
+		}
+		if !assert.Equal(t, `action=delete&ids=4&ids=5`, string(list[0]), "values are sorted") {
+			return
+		}
+		if !assert.Equal(t, `action=delete&ids=3`, string(list[1]), "values are sorted") {
+			return
+		}
+	})
+}
+
+type SignedPayload struct {
+	Callback string   `urlenc:"oauth_callback"`
+	Nonce    string   `urlenc:"oauth_nonce"`
+	Scopes   []string `urlenc:"scope"`
+	Amount   float64  `urlenc:"amount"`
+}
+
+func TestMarshalCanonical(t *testing.T) {
+	s := SignedPayload{
+		Callback: "http://example.com/cb?a=b c",
+		Nonce:    "kllo9940pd9333jh",
+		Scopes:   []string{"write", "read~only"},
+		Amount:   12.5,
+	}
+
+	buf, err := urlenc.MarshalCanonical(s, urlenc.WithKeyOrder([]string{"scope"}))
+	if !assert.NoError(t, err, "MarshalCanonical succeeds") {
+		return
+	}
+	const expected = `amount=12.5&oauth_callback=http%3A%2F%2Fexample.com%2Fcb%3Fa%3Db%20c&oauth_nonce=kllo9940pd9333jh&scope=read~only&scope=write`
+	if !assert.Equal(t, expected, string(buf), "MarshalCanonical produces the canonical form") {
+		return
+	}
+
+	// The caller's options are not written to
+	options := make([]urlenc.Option, 0, 8)
+	if _, err := urlenc.MarshalCanonical(s, options...); !assert.NoError(t, err, "MarshalCanonical succeeds") {
+		return
+	}
+	if !assert.Nil(t, options[:1][0], "spare capacity is left alone") {
+		return
+	}
+}
+
+type EventPayload struct {
+	Timestamp time.Time `urlenc:"ts,,time,layouts=RFC3339|2006-01-02"`
+	Created   time.Time `urlenc:"created"`
+}
+
+func TestTimeLayouts(t *testing.T) {
+	ts := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	s := EventPayload{Timestamp: ts, Created: ts}
+
+	buf, err := urlenc.Marshal(s)
+	if !assert.NoError(t, err, "Marshal succeeds") {
+		return
+	}
+	if !assert.Equal(t, `created=2020-01-02T03%3A04%3A05Z&ts=2020-01-02T03%3A04%3A05Z`, string(buf), "the first layout is used") {
+		return
+	}
+
+	testcases := []struct {
+		Name     string
+		Value    string
+		Expected time.Time
+		Error    bool
+	}{
+		{
+			Name:     "RFC3339",
+			Value:    "2020-01-02T03:04:05Z",
+			Expected: ts,
+		},
+		{
+			Name:     "date only",
+			Value:    "2020-01-02",
+			Expected: time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			Name:  "unparseable",
+			Value: "01/02/2020",
+			Error: true,
+		},
+	}
+
+	for _, tc := range testcases {
+		tc := tc
+		t.Run(tc.Name, func(t *testing.T) {
+			var s EventPayload
+			err := urlenc.Unmarshal([]byte(`ts=`+url.QueryEscape(tc.Value)), &s)
+			if tc.Error {
+				if !assert.Error(t, err, "Unmarshal should fail") {
+					return
+				}
+				return
+			}
+			if !assert.NoError(t, err, "Unmarshal succeeds") {
+				return
+			}
+			if !assert.True(t, tc.Expected.Equal(s.Timestamp), "Unmarshal produces the expected result") {
+				return
+			}
+		})
+	}
+}
+
+type SharedPayload struct {
+	Name     string `urlenc:"name"`
+	Handler  func() `urlenc:"handler"`
+	Children []ProfilePayload
+	Count    int `urlenc:"count"`
+}
+
+func TestSkipUnsupportedFields(t *testing.T) {
+	s := SharedPayload{Name: "foo", Count: 2}
+
+	_, err := urlenc.Marshal(s)
+	if !assert.True(t, errors.Is(err, urlenc.ErrUnsupportedType), "Marshal without the option fails") {
+		return
+	}
+
+	buf, err := urlenc.MarshalWithOptions(s, urlenc.WithSkipUnsupportedFields())
+	if !assert.NoError(t, err, "Marshal succeeds") {
+		return
+	}
+	if !assert.Equal(t, `count=2&name=foo`, string(buf), "unsupported fields are skipped") {
+		return
+	}
+
+	var decoded SharedPayload
+	if !assert.NoError(t, urlenc.UnmarshalWithOptions([]byte(`name=foo&count=2&handler=x`), &decoded, urlenc.WithSkipUnsupportedFields()), "Unmarshal succeeds") {
+		return
+	}
+	if !assert.Equal(t, "foo", decoded.Name, "supported fields are decoded") {
+		return
+	}
+	if !assert.Equal(t, 2, decoded.Count, "supported fields are decoded") {
+		return
+	}
+
+	err = urlenc.Unmarshal([]byte(`name=foo`), &decoded)
+	if !assert.True(t, errors.Is(err, urlenc.ErrUnsupportedType), "Unmarshal without the option fails") {
+		return
+	}
+}
+
+type SettablePayload struct {
+	Name  string `urlenc:"name"`
+	Count int    `urlenc:"count"`
+}
+
+func TestUnsettableFields(t *testing.T) {
+	q := url.Values{"name": {"foo"}}
+
+	// A struct that is not addressable can not have its fields set
+	rv := reflect.ValueOf(SettablePayload{})
+	err := urlenc.UnmarshalStructValue(q, rv)
+	if !assert.True(t, errors.Is(err, urlenc.ErrUnsettableField), "Unmarshal into unsettable field returns ErrUnsettableField") {
+		return
+	}
+	var fe *urlenc.FieldError
+	if !assert.True(t, errors.As(err, &fe), "error is a FieldError") {
+		return
+	}
+	if !assert.Equal(t, "Name", fe.Field, "error names the field") {
+		return
+	}
+
+	if !assert.NoError(t, urlenc.UnmarshalStructValue(q, rv, urlenc.WithSkipUnsettableFields()), "Unmarshal with WithSkipUnsettableFields succeeds") {
+		return
+	}
+
+	// Keys that are not present do not touch the field at all
+	if !assert.NoError(t, urlenc.UnmarshalStructValue(url.Values{}, rv), "Unmarshal without values succeeds") {
+		return
+	}
+
+	var s SettablePayload
+	if !assert.NoError(t, urlenc.UnmarshalStructValue(q, reflect.ValueOf(&s).Elem()), "Unmarshal into addressable struct succeeds") {
+		return
+	}
+	if !assert.Equal(t, "foo", s.Name, "field is set") {
+		return
+	}
+}
+
+type WorkerPayload struct {
+	Name   string        `urlenc:"name"`
+	Done   chan struct{} `urlenc:"done"`
+	OnStop func()
+	Count  int `urlenc:"count"`
+}
+
+func TestIgnoreUnsupportedKinds(t *testing.T) {
+	s := WorkerPayload{Name: "foo", Done: make(chan struct{}), Count: 2}
+
+	_, err := urlenc.Marshal(s)
+	if !assert.True(t, errors.Is(err, urlenc.ErrUnsupportedType), "Marshal without the option fails") {
+		return
+	}
+
+	buf, err := urlenc.MarshalWithOptions(s, urlenc.WithIgnoreUnsupportedKinds())
+	if !assert.NoError(t, err, "Marshal succeeds") {
+		return
+	}
+	if !assert.Equal(t, `count=2&name=foo`, string(buf), "channel and func fields are skipped") {
+		return
+	}
+
+	var decoded WorkerPayload
+	if !assert.NoError(t, urlenc.UnmarshalWithOptions([]byte(`name=foo&count=2&done=x`), &decoded, urlenc.WithIgnoreUnsupportedKinds()), "Unmarshal succeeds") {
+		return
+	}
+	if !assert.Equal(t, WorkerPayload{Name: "foo", Count: 2}, decoded, "supported fields are decoded, channel is left alone") {
+		return
+	}
+
+	// Other unsupported fields still make the call fail
+	_, err = urlenc.MarshalWithOptions(SharedPayload{Name: "foo"}, urlenc.WithIgnoreUnsupportedKinds())
+	if !assert.True(t, errors.Is(err, urlenc.ErrUnsupportedType), "slices of structs are still an error") {
+		return
+	}
+	if !assert.Contains(t, err.Error(), "Children", "error names the field") {
+		return
+	}
+}
+
+type OptionalNamePayload struct {
+	Name MaybeString `urlenc:"name,omitempty,string"`
+	ID   int         `urlenc:"id"`
+}
+
+type OptionalNamePtrPayload struct {
+	Name *MaybeString `urlenc:"name,omitempty,string"`
+	ID   int          `urlenc:"id"`
+}
+
+func TestValuerOmitEmpty(t *testing.T) {
+	s := OptionalNamePayload{Name: MaybeString{Valid: true}, ID: 1}
+
+	buf, err := urlenc.Marshal(s)
+	if !assert.NoError(t, err, "Marshal succeeds") {
+		return
+	}
+	if !assert.Equal(t, `id=1&name=`, string(buf), "non-zero wrapper is emitted by default") {
+		return
+	}
+
+	buf, err = urlenc.MarshalWithOptions(s, urlenc.WithValuerOmitEmpty())
+	if !assert.NoError(t, err, "Marshal succeeds") {
+		return
+	}
+	if !assert.Equal(t, `id=1`, string(buf), "wrapper with an empty Value is omitted") {
+		return
+	}
+
+	s.Name = MaybeString{Valid: true, String: "foo"}
+	buf, err = urlenc.MarshalWithOptions(s, urlenc.WithValuerOmitEmpty())
+	if !assert.NoError(t, err, "Marshal succeeds") {
+		return
+	}
+	if !assert.Equal(t, `id=1&name=foo`, string(buf), "wrapper with a non-empty Value is emitted") {
+		return
+	}
+
+	t.Run("pointer", func(t *testing.T) {
+		var p OptionalNamePtrPayload
+		buf, err := urlenc.MarshalWithOptions(p, urlenc.WithValuerOmitEmpty())
+		if !assert.NoError(t, err, "Marshal succeeds") {
+			return
+		}
+		if !assert.Equal(t, `id=0`, string(buf), "nil pointer is omitted") {
+			return
+		}
+
+		p.Name = &MaybeString{Valid: true}
+		buf, err = urlenc.MarshalWithOptions(p, urlenc.WithValuerOmitEmpty())
+		if !assert.NoError(t, err, "Marshal succeeds") {
+			return
+		}
+		if !assert.Equal(t, `id=0`, string(buf), "pointer to a wrapper with an empty Value is omitted") {
+			return
+		}
+
+		p.Name = &MaybeString{Valid: true, String: "foo"}
+		buf, err = urlenc.MarshalWithOptions(p, urlenc.WithValuerOmitEmpty())
+		if !assert.NoError(t, err, "Marshal succeeds") {
+			return
+		}
+		if !assert.Equal(t, `id=0&name=foo`, string(buf), "pointer to a wrapper with a non-empty Value is emitted") {
+			return
+		}
+	})
+}
+
+type LiteralKeyPayload struct {
+	Dotted   string   `urlenc:"a.b"`
+	Bracket  string   `urlenc:"user[name]"`
+	Brackets []string `urlenc:"ids[]"`
+	Spaced   int      `urlenc:"the count"`
+}
+
+func TestLiteralSpecialKeys(t *testing.T) {
+	s := LiteralKeyPayload{
+		Dotted:   "1",
+		Bracket:  "foo",
+		Brackets: []string{"x", "y"},
+		Spaced:   3,
+	}
+
+	buf, err := urlenc.Marshal(s)
+	if !assert.NoError(t, err, "Marshal succeeds") {
+		return
+	}
+	if !assert.Equal(t, `a.b=1&ids%5B%5D=x&ids%5B%5D=y&the+count=3&user%5Bname%5D=foo`, string(buf), "special characters in keys are escaped") {
+		return
+	}
+
+	var decoded LiteralKeyPayload
+	if !assert.NoError(t, urlenc.Unmarshal(buf, &decoded), "Unmarshal succeeds") {
+		return
+	}
+	if !assert.Equal(t, s, decoded, "keys are matched literally") {
+		return
+	}
+
+	decoded = LiteralKeyPayload{}
+	if !assert.NoError(t, urlenc.Unmarshal([]byte(`a.b=1&user[name]=foo&ids[]=x&ids[]=y&the%20count=3`), &decoded), "Unmarshal succeeds") {
+		return
+	}
+	if !assert.Equal(t, s, decoded, "unescaped keys are matched literally") {
+		return
+	}
+
+	var m struct {
+		User map[string]string `urlenc:"user"`
+		Name string            `urlenc:"user[name]"`
+	}
+	if !assert.NoError(t, urlenc.Unmarshal([]byte(`user[id]=1&user[name]=foo`), &m), "Unmarshal succeeds") {
+		return
+	}
+	if !assert.Equal(t, map[string]string{"id": "1"}, m.User, "literal keys are not captured by map fields") {
+		return
+	}
+	if !assert.Equal(t, "foo", m.Name, "literal key is matched") {
+		return
+	}
+}
+
+func TestSetDefaultOptions(t *testing.T) {
+	urlenc.SetDefaultOptions(urlenc.WithNumericBooleans(), urlenc.WithFloatPrecision(2))
+	defer urlenc.SetDefaultOptions()
+
+	s := struct {
+		Enabled bool    `urlenc:"enabled"`
+		Price   float64 `urlenc:"price"`
+	}{Enabled: true, Price: 1.5}
+
+	buf, err := urlenc.Marshal(s)
+	if !assert.NoError(t, err, "Marshal succeeds") {
+		return
+	}
+	if !assert.Equal(t, `enabled=1&price=1.50`, string(buf), "plain Marshal uses the defaults") {
+		return
+	}
+
+	buf, err = urlenc.MarshalWithOptions(s, urlenc.WithFloatPrecision(1))
+	if !assert.NoError(t, err, "Marshal succeeds") {
+		return
+	}
+	if !assert.Equal(t, `enabled=1&price=1.5`, string(buf), "per-call options take precedence") {
+		return
+	}
+
+	urlenc.SetDefaultOptions()
+	buf, err = urlenc.Marshal(s)
+	if !assert.NoError(t, err, "Marshal succeeds") {
+		return
+	}
+	if !assert.Equal(t, `enabled=true&price=1.5`, string(buf), "defaults are cleared") {
+		return
+	}
+
+	t.Run("key names", func(t *testing.T) {
+		// There is no option to map field names to keys, but the struct
+		// tag that is used decides the key for each field
+		urlenc.SetDefaultOptions(urlenc.WithTagName("query"))
+		defer urlenc.SetDefaultOptions()
+
+		type payload struct {
+			UserID int    `query:"user_id" urlenc:"uid"`
+			Name   string `query:"name" urlenc:"n"`
+		}
+		buf, err := urlenc.Marshal(payload{UserID: 1, Name: "foo"})
+		if !assert.NoError(t, err, "Marshal succeeds") {
+			return
+		}
+		if !assert.Equal(t, `name=foo&user_id=1`, string(buf), "plain Marshal uses the default tag") {
+			return
+		}
+
+		var decoded payload
+		if !assert.NoError(t, urlenc.Unmarshal(buf, &decoded), "Unmarshal succeeds") {
+			return
+		}
+		if !assert.Equal(t, payload{UserID: 1, Name: "foo"}, decoded, "plain Unmarshal uses the default tag") {
+			return
+		}
+
+		buf, err = urlenc.MarshalWithOptions(payload{UserID: 1, Name: "foo"}, urlenc.WithTagName("urlenc"))
+		if !assert.NoError(t, err, "Marshal succeeds") {
+			return
+		}
+		if !assert.Equal(t, `n=foo&uid=1`, string(buf), "per-call options take precedence") {
+			return
+		}
+	})
+}
+
+func TestBoolFields(t *testing.T) {
+	for _, v := range []string{"1", "t", "T", "TRUE", "true", "True"} {
+		var s SwitchPayload
+		if !assert.NoError(t, urlenc.Unmarshal([]byte(`enabled=`+v+`&modes=`+v+`&modes=0`), &s), "Unmarshal succeeds for %q", v) {
+			return
+		}
+		if !assert.Equal(t, SwitchPayload{Enabled: true, Modes: []bool{true, false}}, s, "%q is parsed as true", v) {
+			return
+		}
+	}
+
+	buf, err := urlenc.Marshal(SwitchPayload{Enabled: true, Modes: []bool{true, false}})
+	if !assert.NoError(t, err, "Marshal succeeds") {
+		return
+	}
+	if !assert.Equal(t, `debug=false&enabled=true&modes=true&modes=false`, string(buf), "booleans are encoded as true/false") {
+		return
+	}
+
+	var s SwitchPayload
+	if !assert.Error(t, urlenc.Unmarshal([]byte(`enabled=yes`), &s), "Unmarshal fails for invalid booleans") {
+		return
+	}
+}
+
+type MaybeStringPtrPayload struct {
+	Name  *MaybeString `urlenc:"name,,string"`
+	Other *MaybeString `urlenc:"other,omitempty,string"`
+}
+
+func TestPointerToSetter(t *testing.T) {
+	var s MaybeStringPtrPayload
+	if !assert.NoError(t, urlenc.Unmarshal([]byte(`name=foo`), &s), "Unmarshal succeeds") {
+		return
+	}
+	if !assert.Equal(t, &MaybeString{Valid: true, String: "foo"}, s.Name, "pointer is allocated, and Set is called") {
+		return
+	}
+	if !assert.Nil(t, s.Other, "absent field is left nil") {
+		return
+	}
+
+	buf, err := urlenc.Marshal(s)
+	if !assert.NoError(t, err, "Marshal succeeds") {
+		return
+	}
+	if !assert.Equal(t, `name=foo`, string(buf), "Value is called through the pointer") {
+		return
+	}
+
+	buf, err = urlenc.Marshal(MaybeStringPtrPayload{})
+	if !assert.NoError(t, err, "Marshal succeeds") {
+		return
+	}
+	if !assert.Equal(t, `name=`, string(buf), "nil pointer is marshaled as an empty value") {
+		return
+	}
+}
+
+type NestedArrayPayload struct {
+	IDs    []int                       `urlenc:"ids"`
+	Attrs  map[string][]int            `urlenc:"a"`
+	Nested map[string]map[string][]int `urlenc:"n"`
+}
+
+func TestNestedArrays(t *testing.T) {
+	testcases := []struct {
+		Name     string
+		Query    string
+		Expected NestedArrayPayload
+	}{
+		{
+			Name:     "top level",
+			Query:    `ids[]=1&ids[]=2`,
+			Expected: NestedArrayPayload{IDs: []int{1, 2}},
+		},
+		{
+			Name:     "one level",
+			Query:    `a[b][]=1&a[b][]=2&a[c][]=3`,
+			Expected: NestedArrayPayload{Attrs: map[string][]int{"b": {1, 2}, "c": {3}}},
+		},
+		{
+			Name:  "two levels",
+			Query: `n[x][b][]=1&n[x][b][]=2&n[x][c][]=3&n[y][b][]=4`,
+			Expected: NestedArrayPayload{
+				Nested: map[string]map[string][]int{
+					"x": {"b": {1, 2}, "c": {3}},
+					"y": {"b": {4}},
+				},
+			},
+		},
+	}
+
+	for _, tc := range testcases {
+		tc := tc
+		t.Run(tc.Name, func(t *testing.T) {
+			var s NestedArrayPayload
+			if !assert.NoError(t, urlenc.Unmarshal([]byte(tc.Query), &s), "Unmarshal succeeds") {
+				return
+			}
+			if !assert.Equal(t, tc.Expected, s, "Unmarshal produces the expected result") {
+				return
+			}
+
+			buf, err := urlenc.Marshal(s)
+			if !assert.NoError(t, err, "Marshal succeeds") {
+				return
+			}
+			var decoded NestedArrayPayload
+			if !assert.NoError(t, urlenc.Unmarshal(buf, &decoded), "Unmarshal succeeds") {
+				return
+			}
+			if !assert.Equal(t, tc.Expected, decoded, "round trip produces the same result") {
+				return
+			}
+		})
+	}
+}
+
+type EmptyTagPayload struct {
+	Name  string `urlenc:""`
+	Other string `urlenc:",omitempty"`
+	Count int    `json:""`
+}
+
+func TestEmptyTag(t *testing.T) {
+	s := EmptyTagPayload{Name: "foo", Other: "bar", Count: 1}
+	buf, err := urlenc.Marshal(s)
+	if !assert.NoError(t, err, "Marshal succeeds") {
+		return
+	}
+	if !assert.Equal(t, `Count=1&Name=foo&Other=bar`, string(buf), "field names are used as keys") {
+		return
+	}
+
+	var decoded EmptyTagPayload
+	if !assert.NoError(t, urlenc.Unmarshal(buf, &decoded), "Unmarshal succeeds") {
+		return
+	}
+	if !assert.Equal(t, s, decoded, "round trip produces the same result") {
+		return
+	}
+}
+
+type DatedPayload struct {
+	Created time.Time `urlenc:"created,omitempty,layout:2006-01-02"`
+	Updated time.Time `urlenc:"updated,omitempty"`
+}
+
+func TestTimeLayout(t *testing.T) {
+	s := DatedPayload{
+		Created: time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC),
+		Updated: time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC),
+	}
+
+	buf, err := urlenc.Marshal(s)
+	if !assert.NoError(t, err, "Marshal succeeds") {
+		return
+	}
+	if !assert.Equal(t, `created=2020-01-02&updated=2020-01-02T03%3A04%3A05Z`, string(buf), "the layout from the tag is used, and RFC3339 otherwise") {
+		return
+	}
+
+	var decoded DatedPayload
+	if !assert.NoError(t, urlenc.Unmarshal(buf, &decoded), "Unmarshal succeeds") {
+		return
+	}
+	if !assert.Equal(t, s, decoded, "round trip produces the same result") {
+		return
+	}
+
+	buf, err = urlenc.Marshal(DatedPayload{Updated: time.Time{}.In(time.FixedZone("X", 3600))})
+	if !assert.NoError(t, err, "Marshal succeeds") {
+		return
+	}
+	if !assert.Equal(t, ``, string(buf), "zero times are omitted") {
+		return
+	}
+}
+
+type StrictPayload struct {
+	Name    string  `urlenc:"name"`
+	Count   int     `urlenc:"count"`
+	Enabled bool    `urlenc:"enabled"`
+	Ratio   float64 `urlenc:"ratio,omitempty"`
+}
+
+func TestUnmarshalStrict(t *testing.T) {
+	var s StrictPayload
+	if !assert.NoError(t, urlenc.UnmarshalStrict([]byte(`name=foo&count=1&enabled=true&ratio=0.5`), &s), "UnmarshalStrict succeeds") {
+		return
+	}
+	if !assert.Equal(t, StrictPayload{Name: "foo", Count: 1, Enabled: true, Ratio: 0.5}, s, "UnmarshalStrict produces the expected result") {
+		return
+	}
+
+	// The caller's options are not written to
+	options := make([]urlenc.Option, 0, 8)
+	if !assert.NoError(t, urlenc.UnmarshalStrict([]byte(`name=foo&count=1&enabled=true`), &s, options...), "UnmarshalStrict succeeds") {
+		return
+	}
+	if !assert.Nil(t, options[:1][0], "spare capacity is left alone") {
+		return
+	}
+
+	testcases := []struct {
+		Name   string
+		Query  string
+		Errors []error
+	}{
+		{
+			Name:   "unknown key",
+			Query:  `name=foo&count=1&enabled=true&extra=1`,
+			Errors: []error{urlenc.ErrUnknownKeys},
+		},
+		{
+			Name:   "missing field",
+			Query:  `name=foo&enabled=true`,
+			Errors: []error{urlenc.ErrMissingFields},
+		},
+		{
+			Name:   "loose bool",
+			Query:  `name=foo&count=1&enabled=T`,
+			Errors: []error{urlenc.ErrStrictType},
+		},
+		{
+			Name:   "loose int",
+			Query:  `name=foo&count=%2B01&enabled=true`,
+			Errors: []error{urlenc.ErrStrictType},
+		},
+		{
+			Name:   "non-finite float",
+			Query:  `name=foo&count=1&enabled=true&ratio=NaN`,
+			Errors: []error{urlenc.ErrStrictType},
+		},
+		{
+			Name:   "everything at once",
+			Query:  `count=01&enabled=T&extra=1`,
+			Errors: []error{urlenc.ErrStrictType, urlenc.ErrMissingFields, urlenc.ErrUnknownKeys},
+		},
+	}
+
+	for _, tc := range testcases {
+		tc := tc
+		t.Run(tc.Name, func(t *testing.T) {
+			var s StrictPayload
+			err := urlenc.UnmarshalStrict([]byte(tc.Query), &s)
+			if !assert.Error(t, err, "UnmarshalStrict fails") {
+				return
+			}
+			for _, expected := range tc.Errors {
+				if !assert.True(t, errors.Is(err, expected), "error wraps %s", expected) {
+					return
+				}
+			}
+		})
+	}
+}
+
+type RawQuery string
+
+func (q RawQuery) MarshalURL() ([]byte, error) {
+	return []byte(q), nil
+}
+
+func TestValues(t *testing.T) {
+	t.Run("MarshalValues", func(t *testing.T) {
+		uv, err := urlenc.MarshalValues(StrictPayload{Name: "foo", Count: 2})
+		if !assert.NoError(t, err, "MarshalValues succeeds") {
+			return
+		}
+		uv.Set("page", "3")
+		if !assert.Equal(t, `count=2&enabled=false&name=foo&page=3`, uv.Encode(), "result matches") {
+			return
+		}
+	})
+	t.Run("MarshalValues with Marshaler", func(t *testing.T) {
+		uv, err := urlenc.MarshalValues(RawQuery(`foo=bar`))
+		if !assert.NoError(t, err, "MarshalValues succeeds") {
+			return
+		}
+		if !assert.Equal(t, url.Values{"foo": []string{"bar"}}, uv, "result matches") {
+			return
+		}
+	})
+	t.Run("UnmarshalValues", func(t *testing.T) {
+		uv := url.Values{
+			"name":    []string{"foo"},
+			"count":   []string{"2"},
+			"enabled": []string{"true"},
+		}
+		var s StrictPayload
+		if !assert.NoError(t, urlenc.UnmarshalValues(uv, &s), "UnmarshalValues succeeds") {
+			return
+		}
+		if !assert.Equal(t, StrictPayload{Name: "foo", Count: 2, Enabled: true}, s, "result matches") {
+			return
+		}
+		if !assert.Len(t, uv, 3, "input is not modified") {
+			return
+		}
+	})
+	t.Run("UnmarshalValues into map", func(t *testing.T) {
+		m := map[string]string{}
+		if !assert.NoError(t, urlenc.UnmarshalValues(url.Values{"a": []string{"b"}}, &m), "UnmarshalValues succeeds") {
+			return
+		}
+		if !assert.Equal(t, map[string]string{"a": "b"}, m, "result matches") {
+			return
+		}
+	})
+	t.Run("UnmarshalValues errors", func(t *testing.T) {
+		var s StrictPayload
+		if !assert.True(t, errors.Is(urlenc.UnmarshalValues(url.Values{}, s), urlenc.ErrNotPointer), "non-pointer is rejected") {
+			return
+		}
+	})
+}
+
+type Address struct {
+	Street string `urlenc:"street"`
+	City   string `urlenc:"city"`
+	Zip    string `urlenc:"zip,omitempty"`
+}
+
+type AddressBookPayload struct {
+	Addresses map[string]Address `urlenc:"addr"`
+}
+
+func TestMapOfStructs(t *testing.T) {
+	t.Run("Marshal map", func(t *testing.T) {
+		buf, err := urlenc.Marshal(map[string]Address{
+			"home": {Street: "1 Main St", City: "Springfield"},
+		})
+		if !assert.NoError(t, err, "Marshal succeeds") {
+			return
+		}
+		if !assert.Equal(t, `home%5Bcity%5D=Springfield&home%5Bstreet%5D=1+Main+St`, string(buf), "result matches") {
+			return
+		}
+	})
+	t.Run("Marshal map of pointers", func(t *testing.T) {
+		buf, err := urlenc.Marshal(map[string]*Address{
+			"home": {Street: "1 Main St", City: "Springfield"},
+			"work": nil,
+		})
+		if !assert.NoError(t, err, "Marshal succeeds") {
+			return
+		}
+		if !assert.Equal(t, `home%5Bcity%5D=Springfield&home%5Bstreet%5D=1+Main+St`, string(buf), "result matches") {
+			return
+		}
+	})
+	t.Run("Marshal with MapKeyDot", func(t *testing.T) {
+		buf, err := urlenc.MarshalWithOptions(map[string]Address{
+			"home": {Street: "1 Main St", City: "Springfield", Zip: "12345"},
+		}, urlenc.WithMapKeyStyle(urlenc.MapKeyDot))
+		if !assert.NoError(t, err, "Marshal succeeds") {
+			return
+		}
+		if !assert.Equal(t, `home.city=Springfield&home.street=1+Main+St&home.zip=12345`, string(buf), "result matches") {
+			return
+		}
+	})
+	t.Run("Round trip field", func(t *testing.T) {
+		src := AddressBookPayload{
+			Addresses: map[string]Address{
+				"home": {Street: "1 Main St", City: "Springfield"},
+				"work": {Street: "2 Side St", City: "Shelbyville", Zip: "54321"},
+			},
+		}
+		buf, err := urlenc.Marshal(src)
+		if !assert.NoError(t, err, "Marshal succeeds") {
+			return
+		}
+		if !assert.Equal(t, `addr%5Bhome%5D%5Bcity%5D=Springfield&addr%5Bhome%5D%5Bstreet%5D=1+Main+St&addr%5Bwork%5D%5Bcity%5D=Shelbyville&addr%5Bwork%5D%5Bstreet%5D=2+Side+St&addr%5Bwork%5D%5Bzip%5D=54321`, string(buf), "result matches") {
+			return
+		}
+
+		var dst AddressBookPayload
+		if !assert.NoError(t, urlenc.Unmarshal(buf, &dst), "Unmarshal succeeds") {
+			return
+		}
+		if !assert.Equal(t, src, dst, "round trip matches") {
+			return
+		}
+	})
+}
+
+type MatrixPayload struct {
+	Matrix [][]int `urlenc:"matrix"`
+}
+
+func TestSliceOfSlices(t *testing.T) {
+	testcases := []struct {
+		Name     string
+		Query    string
+		Expected [][]int
+	}{
+		{
+			Name:     "empty brackets",
+			Query:    `matrix[][]=1&matrix[][]=2`,
+			Expected: [][]int{{1}, {2}},
+		},
+		{
+			Name:     "indexed rows",
+			Query:    `matrix[0][]=1&matrix[0][]=2&matrix[1][]=3`,
+			Expected: [][]int{{1, 2}, {3}},
+		},
+		{
+			Name:     "indexed rows without array marker",
+			Query:    `matrix[1]=3&matrix[0]=1&matrix[0]=2`,
+			Expected: [][]int{{1, 2}, {3}},
+		},
+		{
+			Name:     "gaps between indices",
+			Query:    `matrix[5][]=3&matrix[2][]=1`,
+			Expected: [][]int{{1}, {3}},
+		},
+		{
+			Name:     "indexed rows come first",
+			Query:    `matrix[][]=9&matrix[0][]=1&matrix[0][]=2`,
+			Expected: [][]int{{1, 2}, {9}},
+		},
+	}
+
+	for _, tc := range testcases {
+		tc := tc
+		t.Run(tc.Name, func(t *testing.T) {
+			var m MatrixPayload
+			if !assert.NoError(t, urlenc.UnmarshalWithOptions([]byte(tc.Query), &m, urlenc.WithDisallowUnknownKeys()), "Unmarshal succeeds") {
+				return
+			}
+			if !assert.Equal(t, tc.Expected, m.Matrix, "result matches") {
+				return
+			}
+		})
+	}
+
+	t.Run("Round trip", func(t *testing.T) {
+		src := MatrixPayload{Matrix: [][]int{{1, 2}, {3}}}
+		buf, err := urlenc.Marshal(src)
+		if !assert.NoError(t, err, "Marshal succeeds") {
+			return
+		}
+		if !assert.Equal(t, `matrix%5B0%5D%5B%5D=1&matrix%5B0%5D%5B%5D=2&matrix%5B1%5D%5B%5D=3`, string(buf), "result matches") {
+			return
+		}
+
+		var dst MatrixPayload
+		if !assert.NoError(t, urlenc.Unmarshal(buf, &dst), "Unmarshal succeeds") {
+			return
+		}
+		if !assert.Equal(t, src, dst, "round trip matches") {
+			return
+		}
+	})
+	t.Run("Invalid element", func(t *testing.T) {
+		var m MatrixPayload
+		if !assert.Error(t, urlenc.Unmarshal([]byte(`matrix[][]=x`), &m), "Unmarshal fails") {
+			return
+		}
+	})
+}
+
+type TimeoutPayload struct {
+	Timeout  time.Duration   `urlenc:"timeout"`
+	Backoffs []time.Duration `urlenc:"backoff,omitempty"`
+}
+
+func TestDuration(t *testing.T) {
+	src := TimeoutPayload{
+		Timeout:  5 * time.Minute,
+		Backoffs: []time.Duration{time.Second, 1500 * time.Millisecond},
+	}
+	buf, err := urlenc.Marshal(src)
+	if !assert.NoError(t, err, "Marshal succeeds") {
+		return
+	}
+	if !assert.Equal(t, `backoff=1s&backoff=1.5s&timeout=5m0s`, string(buf), "result matches") {
+		return
+	}
+
+	var dst TimeoutPayload
+	if !assert.NoError(t, urlenc.Unmarshal(buf, &dst), "Unmarshal succeeds") {
+		return
+	}
+	if !assert.Equal(t, src, dst, "round trip matches") {
+		return
+	}
+
+	if !assert.Error(t, urlenc.Unmarshal([]byte(`timeout=300000000000`), &dst), "nanoseconds without a unit are rejected") {
+		return
+	}
+}
+
+// Coord implements encoding.TextMarshaler and encoding.TextUnmarshaler
+type Coord struct {
+	X, Y int
+}
+
+func (p Coord) MarshalText() ([]byte, error) {
+	return []byte(fmt.Sprintf("%d:%d", p.X, p.Y)), nil
+}
+
+func (p *Coord) UnmarshalText(b []byte) error {
+	_, err := fmt.Sscanf(string(b), "%d:%d", &p.X, &p.Y)
+	return err
+}
+
+type TextPayload struct {
+	Origin Coord            `urlenc:"origin"`
+	Path   []Coord          `urlenc:"path,omitempty"`
+	Named  map[string]Coord `urlenc:"named,omitempty"`
+	Addr   net.IP           `urlenc:"addr,omitempty"`
+}
+
+func TestTextMarshaler(t *testing.T) {
+	src := TextPayload{
+		Origin: Coord{X: 1, Y: 2},
+		Path:   []Coord{{X: 3, Y: 4}, {X: 5, Y: 6}},
+		Named:  map[string]Coord{"home": {X: 7, Y: 8}},
+		Addr:   net.ParseIP("192.0.2.1"),
+	}
+	buf, err := urlenc.Marshal(src)
+	if !assert.NoError(t, err, "Marshal succeeds") {
+		return
+	}
+	if !assert.Equal(t, `addr=192.0.2.1&named%5Bhome%5D=7%3A8&origin=1%3A2&path=3%3A4&path=5%3A6`, string(buf), "result matches") {
+		return
+	}
+
+	var dst TextPayload
+	if !assert.NoError(t, urlenc.Unmarshal(buf, &dst), "Unmarshal succeeds") {
+		return
+	}
+	if !assert.Equal(t, src.Origin, dst.Origin, "origin matches") {
+		return
+	}
+	if !assert.Equal(t, src.Path, dst.Path, "path matches") {
+		return
+	}
+	if !assert.Equal(t, src.Named, dst.Named, "named matches") {
+		return
+	}
+	if !assert.True(t, src.Addr.Equal(dst.Addr), "addr matches") {
+		return
+	}
+
+	if !assert.Error(t, urlenc.Unmarshal([]byte(`origin=nope`), &dst), "UnmarshalText errors are reported") {
+		return
+	}
+}
+
+type CasePayload struct {
+	Name  string   `urlenc:"name"`
+	Tags  []string `urlenc:"tags"`
+	Count int      `urlenc:"count"`
+}
+
+func TestValueCaseMode(t *testing.T) {
+	src := CasePayload{
+		Name:  "MiXeD",
+		Tags:  []string{"Foo", "bAR"},
+		Count: 10,
+	}
+
+	testcases := []struct {
+		Name     string
+		Mode     urlenc.ValueCaseMode
+		Expected string
+	}{
+		{
+			Name:     "none",
+			Mode:     urlenc.ValueCaseNone,
+			Expected: `count=10&name=MiXeD&tags=Foo&tags=bAR`,
+		},
+		{
+			Name:     "lower",
+			Mode:     urlenc.ValueCaseLower,
+			Expected: `count=10&name=mixed&tags=foo&tags=bar`,
+		},
+		{
+			Name:     "upper",
+			Mode:     urlenc.ValueCaseUpper,
+			Expected: `count=10&name=MIXED&tags=FOO&tags=BAR`,
+		},
+	}
+
+	for _, tc := range testcases {
+		tc := tc
+		t.Run(tc.Name, func(t *testing.T) {
+			buf, err := urlenc.MarshalWithOptions(src, urlenc.WithValueCaseMode(tc.Mode))
+			if !assert.NoError(t, err, "Marshal succeeds") {
+				return
+			}
+			if !assert.Equal(t, tc.Expected, string(buf), "result matches") {
+				return
+			}
+		})
+	}
+}
+
+// ChainString has a chaining Set method, as found in fluent APIs
+type ChainString struct {
+	Value string
+	Calls int
+}
+
+func (c *ChainString) Set(v interface{}) (*ChainString, error) {
+	s, ok := v.(string)
+	if !ok {
+		return c, errors.New("expected string (got: " + reflect.TypeOf(v).String() + ")")
+	}
+	if s == "invalid" {
+		return c, errors.New("invalid value")
+	}
+	c.Value = s
+	c.Calls++
+	return c, nil
+}
+
+type ChainPayload struct {
+	Name ChainString `urlenc:"name,,string"`
+}
+
+func TestChainingSetter(t *testing.T) {
+	var s ChainPayload
+	if !assert.NoError(t, urlenc.Unmarshal([]byte(`name=foo`), &s), "Unmarshal succeeds") {
+		return
+	}
+	if !assert.Equal(t, ChainString{Value: "foo", Calls: 1}, s.Name, "Set is called once") {
+		return
+	}
+
+	err := urlenc.Unmarshal([]byte(`name=invalid`), &s)
+	if !assert.Error(t, err, "Unmarshal fails") {
+		return
+	}
+	if !assert.Contains(t, err.Error(), "invalid value", "error from Set is reported") {
+		return
+	}
+}
+
+// TagSet merges decoded tags into the ones it already has
+type TagSet struct {
+	Tags []string
+}
+
+func (ts *TagSet) SetWith(current, v interface{}) error {
+	tags, ok := v.([]string)
+	if !ok {
+		return errors.New("expected string slice (got: " + reflect.TypeOf(v).String() + ")")
+	}
+	for _, tag := range tags {
+		if tag == "invalid" {
+			return errors.New("invalid tag")
+		}
+	}
+	ts.Tags = append(current.(TagSet).Tags, tags...)
+	return nil
+}
+
+// Set should never be called, as SetWith takes precedence
+func (ts *TagSet) Set(v interface{}) error {
+	return errors.New("Set called")
+}
+
+type TagSetPayload struct {
+	Tags TagSet `urlenc:"tags,,[]string"`
+}
+
+func TestSetterWithCurrent(t *testing.T) {
+	s := TagSetPayload{Tags: TagSet{Tags: []string{"a"}}}
+	if !assert.NoError(t, urlenc.Unmarshal([]byte(`tags=b&tags=c`), &s), "Unmarshal succeeds") {
+		return
+	}
+	if !assert.Equal(t, []string{"a", "b", "c"}, s.Tags.Tags, "decoded tags are appended") {
+		return
+	}
+	if !assert.NoError(t, urlenc.Unmarshal([]byte(`tags=d`), &s), "Unmarshal succeeds") {
+		return
+	}
+	if !assert.Equal(t, []string{"a", "b", "c", "d"}, s.Tags.Tags, "decoded tags are appended again") {
+		return
+	}
+
+	err := urlenc.Unmarshal([]byte(`tags=invalid`), &s)
+	if !assert.Error(t, err, "Unmarshal fails") {
+		return
+	}
+	if !assert.Contains(t, err.Error(), "invalid tag", "error from SetWith is reported") {
+		return
+	}
+	if !assert.Equal(t, []string{"a", "b", "c", "d"}, s.Tags.Tags, "tags are left alone on error") {
+		return
+	}
+}
+
+// RegionID is a map key that is not a string, but knows how to print itself
+type RegionID int
+
+func (r RegionID) String() string {
+	return "region-" + strconv.Itoa(int(r))
+}
+
+// Shade is a string map key with a String method, which is not used
+type Shade string
+
+func (s Shade) String() string {
+	return "shade:" + string(s)
+}
+
+func TestMarshalStringerKeys(t *testing.T) {
+	testcases := []struct {
+		Name     string
+		Value    interface{}
+		Expected string
+	}{
+		{
+			Name:     "map[RegionID]string",
+			Value:    map[RegionID]string{1: "tokyo", 2: "osaka"},
+			Expected: `region-1=tokyo&region-2=osaka`,
+		},
+		{
+			Name:     "map[RegionID][]int",
+			Value:    map[RegionID][]int{3: {1, 2}},
+			Expected: `region-3=1&region-3=2`,
+		},
+		{
+			Name:     "string keys are used as is",
+			Value:    map[Shade]string{"red": "ff0000"},
+			Expected: `red=ff0000`,
+		},
+	}
+
+	for _, tc := range testcases {
+		tc := tc
+		t.Run(tc.Name, func(t *testing.T) {
+			buf, err := urlenc.Marshal(tc.Value)
+			if !assert.NoError(t, err, "Marshal succeeds") {
+				return
+			}
+			if !assert.Equal(t, tc.Expected, string(buf), "result matches") {
+				return
+			}
+		})
+	}
+
+	t.Run("MarshalMapPrefixed", func(t *testing.T) {
+		buf, err := urlenc.MarshalMapPrefixed(map[RegionID]string{1: "tokyo"}, "r_")
+		if !assert.NoError(t, err, "MarshalMapPrefixed succeeds") {
+			return
+		}
+		if !assert.Equal(t, `r_region-1=tokyo`, string(buf), "result matches") {
+			return
+		}
+	})
+	t.Run("nil keys", func(t *testing.T) {
+		values := []interface{}{
+			map[*RegionID]string{nil: "a"},
+			map[fmt.Stringer]string{nil: "a"},
+		}
+		for _, v := range values {
+			_, err := urlenc.Marshal(v)
+			if !assert.True(t, errors.Is(err, urlenc.ErrNilValue), "nil keys should return ErrNilValue") {
+				return
+			}
+		}
+	})
+	t.Run("Unmarshal", func(t *testing.T) {
+		m := make(map[RegionID]string)
+		err := urlenc.Unmarshal([]byte(`region-1=tokyo`), &m)
+		if !assert.True(t, errors.Is(err, urlenc.ErrNonStringMapKey), "Unmarshal into Stringer keys should return ErrNonStringMapKey") {
+			return
+		}
+	})
+}
+
+// Version has no Valuer, but knows how to print itself
+type Version struct {
+	Major int
+	Minor int
+}
+
+func (v Version) String() string {
+	return strconv.Itoa(v.Major) + "." + strconv.Itoa(v.Minor)
+}
+
+// VersionList hands out values that are only Stringers
+type VersionList struct {
+	List []Version
+}
+
+func (l VersionList) Value() interface{} {
+	return l.List
+}
+
+type ReleasePayload struct {
+	Version  Version     `urlenc:"version,,string"`
+	Versions VersionList `urlenc:"versions,,[]string"`
+	Region   RegionID    `urlenc:"region"`
+}
+
+func TestMarshalStringer(t *testing.T) {
+	s := ReleasePayload{
+		Version:  Version{Major: 1, Minor: 2},
+		Versions: VersionList{List: []Version{{Major: 0, Minor: 9}, {Major: 1, Minor: 0}}},
+		Region:   RegionID(3),
+	}
+	buf, err := urlenc.Marshal(s)
+	if !assert.NoError(t, err, "Marshal succeeds") {
+		return
+	}
+	if !assert.Equal(t, `region=3&version=1.2&versions=0.9&versions=1.0`, string(buf), "String() is used for values that can not be converted otherwise, numbers are left alone") {
+		return
+	}
+}
+
+type NumberPayload struct {
+	Count  json.Number   `urlenc:"count"`
+	Limits []json.Number `urlenc:"limit,omitempty"`
+}
+
+func TestJSONNumber(t *testing.T) {
+	s := NumberPayload{Count: "12.50", Limits: []json.Number{"-1", "1e10"}}
+	buf, err := urlenc.Marshal(s)
+	if !assert.NoError(t, err, "Marshal succeeds") {
+		return
+	}
+	if !assert.Equal(t, `count=12.50&limit=-1&limit=1e10`, string(buf), "numbers are given as-is") {
+		return
+	}
+
+	var decoded NumberPayload
+	if !assert.NoError(t, urlenc.Unmarshal(buf, &decoded), "Unmarshal succeeds") {
+		return
+	}
+	if !assert.Equal(t, s, decoded, "round trip produces the same result") {
+		return
+	}
+	n, err := decoded.Count.Float64()
+	if !assert.NoError(t, err, "Float64 succeeds") {
+		return
+	}
+	if !assert.Equal(t, 12.5, n, "value can be used as a number") {
+		return
+	}
+
+	for _, v := range []string{"", "abc", "0x10", "+1", "01", ".5", "1.", "1e", "NaN", "Inf"} {
+		err := urlenc.Unmarshal([]byte(`count=`+url.QueryEscape(v)), &decoded)
+		if !assert.Error(t, err, "Unmarshal of %q fails", v) {
+			return
+		}
+		var fe *urlenc.FieldError
+		if !assert.True(t, errors.As(err, &fe), "error is a FieldError") {
+			return
+		}
+		if !assert.Equal(t, "Count", fe.Field, "error names the field") {
+			return
+		}
+	}
+}
+
+type FeaturesPayload struct {
+	Features map[string]bool `urlenc:"features"`
+}
+
+func TestMapBooleans(t *testing.T) {
+	t.Run("Marshal", func(t *testing.T) {
+		buf, err := urlenc.Marshal(map[string]interface{}{
+			"active": true,
+			"flags":  []bool{true, false},
+		})
+		if !assert.NoError(t, err, "Marshal succeeds") {
+			return
+		}
+		if !assert.Equal(t, `active=true&flags=true&flags=false`, string(buf), "result matches") {
+			return
+		}
+	})
+	t.Run("Marshal with WithNumericBooleans", func(t *testing.T) {
+		buf, err := urlenc.MarshalWithOptions(map[string]bool{"active": true, "deleted": false}, urlenc.WithNumericBooleans())
+		if !assert.NoError(t, err, "Marshal succeeds") {
+			return
+		}
+		if !assert.Equal(t, `active=1&deleted=0`, string(buf), "result matches") {
+			return
+		}
+	})
+	t.Run("Map field", func(t *testing.T) {
+		src := FeaturesPayload{Features: map[string]bool{"a": true, "b": false}}
+		buf, err := urlenc.Marshal(src)
+		if !assert.NoError(t, err, "Marshal succeeds") {
+			return
+		}
+		if !assert.Equal(t, `features%5Ba%5D=true&features%5Bb%5D=false`, string(buf), "result matches") {
+			return
+		}
+
+		var dst FeaturesPayload
+		if !assert.NoError(t, urlenc.Unmarshal(buf, &dst), "Unmarshal succeeds") {
+			return
+		}
+		if !assert.Equal(t, src, dst, "round trip matches") {
+			return
+		}
+	})
+}
+
+type BracketPayload struct {
+	Names []string `urlenc:"names"`
+	Name  string   `urlenc:"name,omitempty"`
+}
+
+func TestStripBracketSuffix(t *testing.T) {
+	testcases := []struct {
+		Name     string
+		Query    string
+		Expected BracketPayload
+	}{
+		{
+			Name:     "slice field",
+			Query:    `names[]=a&names[]=b`,
+			Expected: BracketPayload{Names: []string{"a", "b"}},
+		},
+		{
+			Name:     "mixed",
+			Query:    `names[]=b&names=a`,
+			Expected: BracketPayload{Names: []string{"a", "b"}},
+		},
+		{
+			Name:     "scalar field",
+			Query:    `names=a&name[]=foo`,
+			Expected: BracketPayload{Names: []string{"a"}, Name: "foo"},
+		},
+	}
+
+	for _, tc := range testcases {
+		tc := tc
+		t.Run(tc.Name, func(t *testing.T) {
+			var s BracketPayload
+			if !assert.NoError(t, urlenc.UnmarshalWithOptions([]byte(tc.Query), &s, urlenc.WithStripBracketSuffix(), urlenc.WithDisallowUnknownKeys()), "Unmarshal succeeds") {
+				return
+			}
+			if !assert.Equal(t, tc.Expected, s, "result matches") {
+				return
+			}
+		})
+	}
+
+	t.Run("map", func(t *testing.T) {
+		m := map[string]string{}
+		if !assert.NoError(t, urlenc.UnmarshalWithOptions([]byte(`name[]=foo`), &m, urlenc.WithStripBracketSuffix()), "Unmarshal succeeds") {
+			return
+		}
+		if !assert.Equal(t, map[string]string{"name": "foo"}, m, "result matches") {
+			return
+		}
+	})
+	t.Run("nested keys are left alone", func(t *testing.T) {
+		var m MatrixPayload
+		if !assert.NoError(t, urlenc.UnmarshalWithOptions([]byte(`matrix[][]=1&matrix[0][]=2`), &m, urlenc.WithStripBracketSuffix()), "Unmarshal succeeds") {
+			return
+		}
+		if !assert.Equal(t, [][]int{{2}, {1}}, m.Matrix, "result matches") {
+			return
+		}
+	})
+	t.Run("without option", func(t *testing.T) {
+		var s BracketPayload
+		if !assert.NoError(t, urlenc.Unmarshal([]byte(`names[]=a&name[]=foo`), &s), "Unmarshal succeeds") {
+			return
+		}
+		if !assert.Equal(t, BracketPayload{Names: []string{"a"}}, s, "only slice fields accept the array marker") {
+			return
+		}
+	})
+}
+
+type Location struct {
+	City string `urlenc:"city"`
+	Zip  string `urlenc:"zip,omitempty"`
+}
+
+type Person struct {
+	Name    string    `urlenc:"name"`
+	Home    Location  `urlenc:"address"`
+	Work    *Location `urlenc:"work"`
+	Billing Location  `urlenc:"billing,omitempty"`
+}
+
+type TreeNode struct {
+	Name   string    `urlenc:"name"`
+	Parent *TreeNode `urlenc:"parent"`
+	Info   struct {
+		Depth int `urlenc:"depth"`
+	} `urlenc:"info"`
+}
+
+func TestNestedStructs(t *testing.T) {
+	t.Run("Round trip", func(t *testing.T) {
+		src := Person{
+			Name: "foo",
+			Home: Location{City: "Springfield", Zip: "12345"},
+			Work: &Location{City: "Shelbyville"},
+		}
+		buf, err := urlenc.Marshal(src)
+		if !assert.NoError(t, err, "Marshal succeeds") {
+			return
+		}
+		if !assert.Equal(t, `address.city=Springfield&address.zip=12345&name=foo&work.city=Shelbyville`, string(buf), "result matches") {
+			return
+		}
+
+		var dst Person
+		if !assert.NoError(t, urlenc.Unmarshal(buf, &dst), "Unmarshal succeeds") {
+			return
+		}
+		if !assert.Equal(t, src, dst, "round trip matches") {
+			return
+		}
+	})
+	t.Run("nil pointer", func(t *testing.T) {
+		buf, err := urlenc.Marshal(Person{Name: "foo"})
+		if !assert.NoError(t, err, "Marshal succeeds") {
+			return
+		}
+		if !assert.Equal(t, `address.city=&name=foo`, string(buf), "fields of nil pointers are skipped") {
+			return
+		}
+
+		var dst Person
+		if !assert.NoError(t, urlenc.Unmarshal([]byte(`name=foo`), &dst), "Unmarshal succeeds") {
+			return
+		}
+		if !assert.Nil(t, dst.Work, "pointers are not allocated without values") {
+			return
+		}
+	})
+	t.Run("unknown keys", func(t *testing.T) {
+		var dst Person
+		err := urlenc.UnmarshalWithOptions([]byte(`name=foo&address.city=x&address.street=y`), &dst, urlenc.WithDisallowUnknownKeys())
+		if !assert.True(t, errors.Is(err, urlenc.ErrUnknownKeys), "unknown nested keys are reported") {
+			return
+		}
+		if !assert.Contains(t, err.Error(), "address.street", "error names the key") {
+			return
+		}
+	})
+	t.Run("self-referential type", func(t *testing.T) {
+		src := TreeNode{Name: "leaf", Parent: &TreeNode{Name: "root"}}
+		src.Info.Depth = 1
+		buf, err := urlenc.Marshal(src)
+		if !assert.NoError(t, err, "Marshal succeeds") {
+			return
+		}
+		if !assert.Equal(t, `info.depth=1&name=leaf`, string(buf), "recursive fields are not descended into") {
+			return
+		}
+
+		var dst TreeNode
+		if !assert.NoError(t, urlenc.Unmarshal(buf, &dst), "Unmarshal succeeds") {
+			return
+		}
+		if !assert.Equal(t, 1, dst.Info.Depth, "nested field is decoded") {
+			return
+		}
+	})
+}
+
+type Cursor struct {
+	Limit int `urlenc:"limit"`
+}
+
+type DeepPaging struct {
+	Cursor
+	Next string `urlenc:"next"`
+}
+
+type ShallowFirstPayload struct {
+	DeepPaging
+	Sorting
+}
+
+func TestEmbeddedShallowerFieldWins(t *testing.T) {
+	var s ShallowFirstPayload
+	if !assert.NoError(t, urlenc.Unmarshal([]byte(`limit=10&next=abc&sort=name`), &s), "Unmarshal succeeds") {
+		return
+	}
+	if !assert.Equal(t, 10, s.Sorting.Limit, "the shallower field is decoded") {
+		return
+	}
+	if !assert.Equal(t, 0, s.DeepPaging.Limit, "the deeper field is shadowed") {
+		return
+	}
+	if !assert.Equal(t, "abc", s.Next, "other promoted fields are decoded") {
+		return
+	}
+
+	buf, err := urlenc.Marshal(s)
+	if !assert.NoError(t, err, "Marshal succeeds") {
+		return
+	}
+	if !assert.Equal(t, `limit=10&next=abc&sort=name`, string(buf), "result matches") {
+		return
+	}
+}
+
+type AmbiguousLimits struct {
+	Paging
+	Sorting
+}
+
+type DeeperPaging struct {
+	DeepPaging
+}
+
+type NestedAmbiguousPayload struct {
+	AmbiguousLimits
+	DeeperPaging
+}
+
+func TestEmbeddedAmbiguousFields(t *testing.T) {
+	// Paging.Limit and Sorting.Limit are at the same depth, so neither is
+	// used, and they still hide the deeper Cursor.Limit
+	var s NestedAmbiguousPayload
+	if !assert.NoError(t, urlenc.Unmarshal([]byte(`limit=10&page=2&next=abc&sort=name`), &s), "Unmarshal succeeds") {
+		return
+	}
+	expected := NestedAmbiguousPayload{
+		AmbiguousLimits: AmbiguousLimits{Paging: Paging{Page: 2}, Sorting: Sorting{Sort: "name"}},
+		DeeperPaging:    DeeperPaging{DeepPaging: DeepPaging{Next: "abc"}},
+	}
+	if !assert.Equal(t, expected, s, "ambiguous fields are left alone") {
+		return
+	}
+
+	s.Paging.Limit = 1
+	s.Sorting.Limit = 2
+	s.Cursor.Limit = 3
+	buf, err := urlenc.Marshal(s)
+	if !assert.NoError(t, err, "Marshal succeeds") {
+		return
+	}
+	if !assert.Equal(t, `next=abc&page=2&sort=name`, string(buf), "ambiguous fields are not marshaled") {
+		return
+	}
+
+	if !assert.True(t, errors.Is(urlenc.UnmarshalWithOptions([]byte(`limit=10`), &s, urlenc.WithDisallowUnknownKeys()), urlenc.ErrUnknownKeys), "ambiguous keys are unknown keys") {
+		return
+	}
+}
+
+type NoFields struct{}
+
+func TestEmptyStruct(t *testing.T) {
+	for _, v := range []interface{}{struct{}{}, NoFields{}, &NoFields{}} {
+		buf, err := urlenc.Marshal(v)
+		if !assert.NoError(t, err, "Marshal succeeds") {
+			return
+		}
+		if !assert.Equal(t, ``, string(buf), "result is empty") {
+			return
+		}
+	}
+
+	var s NoFields
+	if !assert.NoError(t, urlenc.Unmarshal([]byte(`foo=bar&baz=1`), &s), "Unmarshal succeeds") {
+		return
+	}
+	if !assert.NoError(t, urlenc.Unmarshal([]byte(``), &s), "Unmarshal of an empty query succeeds") {
+		return
+	}
+	if !assert.True(t, errors.Is(urlenc.UnmarshalWithOptions([]byte(`foo=bar`), &s, urlenc.WithDisallowUnknownKeys()), urlenc.ErrUnknownKeys), "unknown keys are still reported") {
+		return
+	}
+}
+
+type OptionalPayload struct {
+	Count   *int       `urlenc:"count"`
+	Total   *int64     `urlenc:"total"`
+	Ratio   *float64   `urlenc:"ratio"`
+	Enabled *bool      `urlenc:"enabled"`
+	Name    *string    `urlenc:"name"`
+	Since   *time.Time `urlenc:"since,layout:2006-01-02"`
+}
+
+func TestPointerToScalar(t *testing.T) {
+	t.Run("nil pointers are skipped", func(t *testing.T) {
+		buf, err := urlenc.Marshal(OptionalPayload{})
+		if !assert.NoError(t, err, "Marshal succeeds") {
+			return
+		}
+		if !assert.Equal(t, ``, string(buf), "result is empty") {
+			return
+		}
+
+		var dst OptionalPayload
+		if !assert.NoError(t, urlenc.UnmarshalWithOptions([]byte(``), &dst, urlenc.WithRequireAllFields()), "optional fields are never missing") {
+			return
+		}
+		if !assert.Equal(t, OptionalPayload{}, dst, "pointers are not allocated without values") {
+			return
+		}
+	})
+	t.Run("Round trip", func(t *testing.T) {
+		count := 0
+		total := int64(100)
+		ratio := 0.5
+		enabled := false
+		name := "foo"
+		since := time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC)
+		src := OptionalPayload{
+			Count:   &count,
+			Total:   &total,
+			Ratio:   &ratio,
+			Enabled: &enabled,
+			Name:    &name,
+			Since:   &since,
+		}
+		buf, err := urlenc.Marshal(src)
+		if !assert.NoError(t, err, "Marshal succeeds") {
+			return
+		}
+		if !assert.Equal(t, `count=0&enabled=false&name=foo&ratio=0.5&since=2020-01-02&total=100`, string(buf), "zero values behind pointers are kept") {
+			return
+		}
+
+		var dst OptionalPayload
+		if !assert.NoError(t, urlenc.Unmarshal(buf, &dst), "Unmarshal succeeds") {
+			return
+		}
+		if !assert.Equal(t, src, dst, "round trip matches") {
+			return
+		}
+	})
+	t.Run("invalid value", func(t *testing.T) {
+		var dst OptionalPayload
+		if !assert.Error(t, urlenc.Unmarshal([]byte(`count=x`), &dst), "Unmarshal fails") {
+			return
+		}
+	})
+}
+
+type NullablePayload struct {
+	Count *int       `urlenc:"count"`
+	Name  *string    `urlenc:"name"`
+	Note  *string    `urlenc:"note,omitempty"`
+	Since *time.Time `urlenc:"since,layout:2006-01-02"`
+	Label string     `urlenc:"label"`
+}
+
+func TestNullMarker(t *testing.T) {
+	t.Run("Round trip", func(t *testing.T) {
+		name := "foo"
+		src := NullablePayload{Name: &name, Label: "null"}
+		buf, err := urlenc.MarshalWithOptions(src, urlenc.WithNullMarker("null"))
+		if !assert.NoError(t, err, "Marshal succeeds") {
+			return
+		}
+		if !assert.Equal(t, `count=null&label=null&name=foo&since=null`, string(buf), "nil pointers are given as the marker, omitempty fields are left out") {
+			return
+		}
+
+		count := 1
+		dst := NullablePayload{Count: &count}
+		if !assert.NoError(t, urlenc.UnmarshalWithOptions(buf, &dst, urlenc.WithNullMarker("null")), "Unmarshal succeeds") {
+			return
+		}
+		if !assert.Equal(t, src, dst, "round trip matches") {
+			return
+		}
+	})
+	t.Run("without the option", func(t *testing.T) {
+		buf, err := urlenc.Marshal(NullablePayload{})
+		if !assert.NoError(t, err, "Marshal succeeds") {
+			return
+		}
+		if !assert.Equal(t, `label=`, string(buf), "nil pointers are left out") {
+			return
+		}
+
+		var dst NullablePayload
+		if !assert.Error(t, urlenc.Unmarshal([]byte(`count=null`), &dst), "the marker is not a number") {
+			return
+		}
+	})
+	t.Run("marker for a string", func(t *testing.T) {
+		name := "null"
+		buf, err := urlenc.MarshalWithOptions(NullablePayload{Name: &name}, urlenc.WithNullMarker("null"))
+		if !assert.NoError(t, err, "Marshal succeeds") {
+			return
+		}
+		var dst NullablePayload
+		if !assert.NoError(t, urlenc.UnmarshalWithOptions(buf, &dst, urlenc.WithNullMarker("null")), "Unmarshal succeeds") {
+			return
+		}
+		if !assert.Nil(t, dst.Name, "a string equal to the marker becomes nil") {
+			return
+		}
+	})
+}
+
+type ArrayPayload struct {
+	Values [3]int `urlenc:"v"`
+}
+
+func TestArrayMismatchPolicy(t *testing.T) {
+	testcases := []struct {
+		Name     string
+		Policy   urlenc.ArrayMismatchPolicy
+		Query    string
+		Expected [3]int
+		Error    bool
+	}{
+		{Name: "error, exact", Policy: urlenc.ArrayMismatchError, Query: `v=1&v=2&v=3`, Expected: [3]int{1, 2, 3}},
+		{Name: "error, fewer", Policy: urlenc.ArrayMismatchError, Query: `v=1&v=2`, Error: true},
+		{Name: "error, more", Policy: urlenc.ArrayMismatchError, Query: `v=1&v=2&v=3&v=4`, Error: true},
+		{Name: "truncate, fewer", Policy: urlenc.ArrayMismatchTruncate, Query: `v=1&v=2`, Expected: [3]int{1, 2, 0}},
+		{Name: "truncate, more", Policy: urlenc.ArrayMismatchTruncate, Query: `v=1&v=2&v=3&v=4`, Expected: [3]int{1, 2, 3}},
+		{Name: "zerofill, fewer", Policy: urlenc.ArrayMismatchZeroFill, Query: `v=1`, Expected: [3]int{1, 0, 0}},
+		{Name: "zerofill, more", Policy: urlenc.ArrayMismatchZeroFill, Query: `v=1&v=2&v=3&v=4`, Error: true},
+	}
+
+	for _, tc := range testcases {
+		tc := tc
+		t.Run(tc.Name, func(t *testing.T) {
+			var s ArrayPayload
+			err := urlenc.UnmarshalWithOptions([]byte(tc.Query), &s, urlenc.WithArrayMismatchPolicy(tc.Policy))
+			if tc.Error {
+				if !assert.True(t, errors.Is(err, urlenc.ErrArrayLength), "Unmarshal fails with ErrArrayLength") {
+					return
+				}
+				return
+			}
+			if !assert.NoError(t, err, "Unmarshal succeeds") {
+				return
+			}
+			if !assert.Equal(t, tc.Expected, s.Values, "result matches") {
+				return
+			}
+		})
+	}
+
+	t.Run("Round trip", func(t *testing.T) {
+		src := ArrayPayload{Values: [3]int{4, 5, 6}}
+		buf, err := urlenc.Marshal(src)
+		if !assert.NoError(t, err, "Marshal succeeds") {
+			return
+		}
+		var dst ArrayPayload
+		if !assert.NoError(t, urlenc.Unmarshal(buf, &dst), "Unmarshal succeeds") {
+			return
+		}
+		if !assert.Equal(t, src, dst, "round trip matches") {
+			return
+		}
+	})
+}
+
+type FormTagPayload struct {
+	Name  string `form:"n" urlenc:"name"`
+	Count int    `form:"c,omitempty" json:"count"`
+	Note  string `json:"note"`
+}
+
+func TestWithTagName(t *testing.T) {
+	src := FormTagPayload{Name: "foo", Count: 0, Note: "bar"}
+
+	buf, err := urlenc.Marshal(src)
+	if !assert.NoError(t, err, "Marshal succeeds") {
+		return
+	}
+	if !assert.Equal(t, `count=0&name=foo&note=bar`, string(buf), "default tags are used") {
+		return
+	}
+
+	buf, err = urlenc.MarshalWithOptions(src, urlenc.WithTagName("form"))
+	if !assert.NoError(t, err, "Marshal succeeds") {
+		return
+	}
+	if !assert.Equal(t, `Note=bar&n=foo`, string(buf), "only the given tag is used") {
+		return
+	}
+
+	var dst FormTagPayload
+	if !assert.NoError(t, urlenc.UnmarshalWithOptions([]byte(`n=foo&c=2&Note=bar`), &dst, urlenc.WithTagName("form")), "Unmarshal succeeds") {
+		return
+	}
+	if !assert.Equal(t, FormTagPayload{Name: "foo", Count: 2, Note: "bar"}, dst, "result matches") {
+		return
+	}
+}
+
+func TestWithArrayFormat(t *testing.T) {
+	src := CasePayload{Name: "foo", Tags: []string{"a", "b"}, Count: 1}
+
+	testcases := []struct {
+		Name     string
+		Format   urlenc.ArrayFormat
+		Expected string
+	}{
+		{
+			Name:     "repeat",
+			Format:   urlenc.ArrayFormatRepeat,
+			Expected: `count=1&name=foo&tags=a&tags=b`,
+		},
+		{
+			Name:     "brackets",
+			Format:   urlenc.ArrayFormatBrackets,
+			Expected: `count=1&name=foo&tags%5B%5D=a&tags%5B%5D=b`,
+		},
+		{
+			Name:     "indices",
+			Format:   urlenc.ArrayFormatIndices,
+			Expected: `count=1&name=foo&tags%5B0%5D=a&tags%5B1%5D=b`,
+		},
+		{
+			Name:     "comma",
+			Format:   urlenc.ArrayFormatComma,
+			Expected: `count=1&name=foo&tags=a%2Cb`,
+		},
+	}
+
+	for _, tc := range testcases {
+		tc := tc
+		t.Run(tc.Name, func(t *testing.T) {
+			buf, err := urlenc.MarshalWithOptions(src, urlenc.WithArrayFormat(tc.Format))
+			if !assert.NoError(t, err, "Marshal succeeds") {
+				return
+			}
+			if !assert.Equal(t, tc.Expected, string(buf), "result matches") {
+				return
+			}
+		})
+	}
+
+	t.Run("two dimensional slices are not affected", func(t *testing.T) {
+		buf, err := urlenc.MarshalWithOptions(MatrixPayload{Matrix: [][]int{{1}}}, urlenc.WithArrayFormat(urlenc.ArrayFormatIndices))
+		if !assert.NoError(t, err, "Marshal succeeds") {
+			return
+		}
+		if !assert.Equal(t, `matrix%5B0%5D%5B%5D=1`, string(buf), "result matches") {
+			return
+		}
+	})
+}
+
+type LocalePayload struct {
+	Price    float64 `urlenc:"price"`
+	Quantity int     `urlenc:"qty"`
+	Tags     []uint  `urlenc:"tag,omitempty"`
+	Name     string  `urlenc:"name,omitempty"`
+}
+
+// parseEuropeanNumber accepts numbers such as 1.234,56
+func parseEuropeanNumber(kind reflect.Kind, s string) (interface{}, error) {
+	s = strings.ReplaceAll(s, ".", "")
+	s = strings.Replace(s, ",", ".", 1)
+	switch kind {
+	case reflect.Float32, reflect.Float64:
+		return strconv.ParseFloat(s, 64)
+	default:
+		return strconv.ParseInt(s, 10, 64)
+	}
+}
+
+func TestWithNumberParser(t *testing.T) {
+	var s LocalePayload
+	err := urlenc.UnmarshalWithOptions([]byte(`price=1.234,56&qty=1.000&tag=1.001&tag=2&name=1,5`), &s, urlenc.WithNumberParser(parseEuropeanNumber))
+	if !assert.NoError(t, err, "Unmarshal succeeds") {
+		return
+	}
+	if !assert.Equal(t, LocalePayload{Price: 1234.56, Quantity: 1000, Tags: []uint{1001, 2}, Name: "1,5"}, s, "result matches") {
+		return
+	}
+
+	if !assert.Error(t, urlenc.Unmarshal([]byte(`price=1.234,56&qty=1`), &s), "the default parser rejects the value") {
+		return
+	}
+
+	badParser := func(reflect.Kind, string) (interface{}, error) {
+		return "not a number", nil
+	}
+	if !assert.Error(t, urlenc.UnmarshalWithOptions([]byte(`price=1&qty=1`), &s, urlenc.WithNumberParser(badParser)), "non-numeric results are rejected") {
+		return
+	}
+
+	testcases := []struct {
+		Name   string
+		Query  string
+		Result interface{}
+		Error  error
+	}{
+		{Name: "int out of range", Query: `small=1`, Result: 300, Error: strconv.ErrRange},
+		{Name: "negative uint", Query: `count=1`, Result: -1, Error: strconv.ErrRange},
+		{Name: "uint out of range for int", Query: `n=1`, Result: uint64(math.MaxUint64), Error: strconv.ErrRange},
+		{Name: "float out of range for int", Query: `small=1`, Result: 300.0, Error: strconv.ErrRange},
+		{Name: "non-integral float", Query: `n=1`, Result: 1.7},
+		{Name: "float out of range for float32", Query: `ratio=1`, Result: math.MaxFloat64, Error: strconv.ErrRange},
+	}
+	for _, tc := range testcases {
+		tc := tc
+		t.Run(tc.Name, func(t *testing.T) {
+			parser := func(reflect.Kind, string) (interface{}, error) {
+				return tc.Result, nil
+			}
+			var s NumberRangePayload
+			err := urlenc.UnmarshalWithOptions([]byte(tc.Query), &s, urlenc.WithNumberParser(parser))
+			if !assert.Error(t, err, "results that do not fit are rejected") {
+				return
+			}
+			if tc.Error != nil {
+				if !assert.True(t, errors.Is(err, tc.Error), "error matches") {
+					return
+				}
+			}
+			if !assert.Equal(t, NumberRangePayload{}, s, "field is left alone") {
+				return
+			}
+		})
+	}
+
+	var r NumberRangePayload
+	parser := func(reflect.Kind, string) (interface{}, error) {
+		return 42.0, nil
+	}
+	if !assert.NoError(t, urlenc.UnmarshalWithOptions([]byte(`small=1&count=1&n=1&ratio=1`), &r, urlenc.WithNumberParser(parser)), "results that fit are accepted") {
+		return
+	}
+	if !assert.Equal(t, NumberRangePayload{Small: 42, Count: 42, N: 42, Ratio: 42}, r, "result matches") {
+		return
+	}
+}
+
+type NumberRangePayload struct {
+	Small int8    `urlenc:"small"`
+	Count uint    `urlenc:"count"`
+	N     int     `urlenc:"n"`
+	Ratio float32 `urlenc:"ratio"`
+}
+
+func TestUnmarshalArrayFormats(t *testing.T) {
+	testcases := []struct {
+		Name     string
+		Query    string
+		Options  []urlenc.Option
+		Expected []string
+	}{
+		{
+			Name:     "repeat",
+			Query:    `tags=a&tags=b`,
+			Expected: []string{"a", "b"},
+		},
+		{
+			Name:     "brackets",
+			Query:    `tags[]=a&tags[]=b`,
+			Expected: []string{"a", "b"},
+		},
+		{
+			Name:     "indices",
+			Query:    `tags[1]=b&tags[0]=a&tags[10]=c`,
+			Expected: []string{"a", "b", "c"},
+		},
+		{
+			Name:     "comma",
+			Query:    `tags=a,b`,
+			Options:  []urlenc.Option{urlenc.WithArrayFormat(urlenc.ArrayFormatComma)},
+			Expected: []string{"a", "b"},
+		},
+		{
+			Name:     "comma without the option",
+			Query:    `tags=a,b`,
+			Expected: []string{"a,b"},
+		},
+	}
+
+	for _, tc := range testcases {
+		tc := tc
+		t.Run(tc.Name, func(t *testing.T) {
+			var s CasePayload
+			options := append([]urlenc.Option{urlenc.WithDisallowUnknownKeys()}, tc.Options...)
+			if !assert.NoError(t, urlenc.UnmarshalWithOptions([]byte(`name=foo&count=1&`+tc.Query), &s, options...), "Unmarshal succeeds") {
+				return
+			}
+			if !assert.Equal(t, tc.Expected, s.Tags, "result matches") {
+				return
+			}
+		})
+	}
+
+	for _, format := range []urlenc.ArrayFormat{urlenc.ArrayFormatRepeat, urlenc.ArrayFormatBrackets, urlenc.ArrayFormatIndices, urlenc.ArrayFormatComma} {
+		src := CasePayload{Name: "foo", Tags: []string{"a", "b", "c", "d", "e", "f", "g", "h", "i", "j", "k"}, Count: 1}
+		buf, err := urlenc.MarshalWithOptions(src, urlenc.WithArrayFormat(format))
+		if !assert.NoError(t, err, "Marshal succeeds") {
+			return
+		}
+		var dst CasePayload
+		if !assert.NoError(t, urlenc.UnmarshalWithOptions(buf, &dst, urlenc.WithArrayFormat(format)), "Unmarshal succeeds") {
+			return
+		}
+		if !assert.Equal(t, src, dst, "round trip matches for format %d", format) {
+			return
+		}
+	}
+}
+
+type GapPayload struct {
+	Items []string `urlenc:"items"`
+	IDs   []int    `urlenc:"ids,omitempty"`
+	Codes [3]int   `urlenc:"codes,omitempty"`
+}
+
+func TestIndexGapPolicy(t *testing.T) {
+	testcases := []struct {
+		Name     string
+		Query    string
+		Policy   urlenc.IndexGapPolicy
+		Expected GapPayload
+		Error    bool
+	}{
+		{
+			Name:     "compact by default",
+			Query:    `items[0]=a&items[2]=c&ids[1]=1&ids[3]=3`,
+			Policy:   urlenc.IndexGapCompact,
+			Expected: GapPayload{Items: []string{"a", "c"}, IDs: []int{1, 3}},
+		},
+		{
+			Name:   "error",
+			Query:  `items[0]=a&items[2]=c`,
+			Policy: urlenc.IndexGapError,
+			Error:  true,
+		},
+		{
+			Name:     "error without gaps",
+			Query:    `items[1]=b&items[0]=a`,
+			Policy:   urlenc.IndexGapError,
+			Expected: GapPayload{Items: []string{"a", "b"}},
+		},
+		{
+			Name:     "fill",
+			Query:    `items[0]=a&items[2]=c&ids[1]=1&ids[3]=3&codes[2]=9`,
+			Policy:   urlenc.IndexGapFill,
+			Expected: GapPayload{Items: []string{"a", "", "c"}, IDs: []int{0, 1, 0, 3}, Codes: [3]int{0, 0, 9}},
+		},
+		{
+			Name:     "fill after repeated keys",
+			Query:    `items=x&items[1]=b`,
+			Policy:   urlenc.IndexGapFill,
+			Expected: GapPayload{Items: []string{"x", "", "b"}},
+		},
+	}
+
+	for _, tc := range testcases {
+		tc := tc
+		t.Run(tc.Name, func(t *testing.T) {
+			var s GapPayload
+			err := urlenc.UnmarshalWithOptions([]byte(tc.Query), &s, urlenc.WithIndexGapPolicy(tc.Policy))
+			if tc.Error {
+				if !assert.True(t, errors.Is(err, urlenc.ErrIndexGap), "Unmarshal returns ErrIndexGap") {
+					return
+				}
+				if !assert.Contains(t, err.Error(), "items[1]", "error names the missing index") {
+					return
+				}
+				return
+			}
+			if !assert.NoError(t, err, "Unmarshal succeeds") {
+				return
+			}
+			if !assert.Equal(t, tc.Expected, s, "result matches") {
+				return
+			}
+		})
+	}
+
+	t.Run("fill with a huge index", func(t *testing.T) {
+		var s GapPayload
+		err := urlenc.UnmarshalWithOptions([]byte(`items[50000000]=x`), &s, urlenc.WithIndexGapPolicy(urlenc.IndexGapFill))
+		if !assert.True(t, errors.Is(err, urlenc.ErrIndexGap), "Unmarshal returns ErrIndexGap") {
+			return
+		}
+		if !assert.Nil(t, s.Items, "field is left alone") {
+			return
+		}
+
+		// Gaps add up across indices
+		err = urlenc.UnmarshalWithOptions([]byte(`items[600]=x&items[1200]=y`), &s, urlenc.WithIndexGapPolicy(urlenc.IndexGapFill))
+		if !assert.True(t, errors.Is(err, urlenc.ErrIndexGap), "Unmarshal returns ErrIndexGap") {
+			return
+		}
+
+		if !assert.NoError(t, urlenc.UnmarshalWithOptions([]byte(`items[1000]=x`), &s, urlenc.WithIndexGapPolicy(urlenc.IndexGapFill)), "gaps up to the limit are filled") {
+			return
+		}
+		if !assert.Len(t, s.Items, 1001, "result has the given length") {
+			return
+		}
+	})
+	t.Run("fill overwrites reused slices", func(t *testing.T) {
+		s := GapPayload{IDs: []int{7, 7, 7}}
+		if !assert.NoError(t, urlenc.UnmarshalWithOptions([]byte(`items=a&ids[0]=1&ids[2]=3`), &s, urlenc.WithIndexGapPolicy(urlenc.IndexGapFill), urlenc.WithReuseSlices()), "Unmarshal succeeds") {
+			return
+		}
+		if !assert.Equal(t, []int{1, 0, 3}, s.IDs, "gaps are reset to zero values") {
+			return
+		}
+	})
+}
+
+// formatGroupedNumber formats numbers with thousands separators, such as
+// 1,234,567
+func formatGroupedNumber(rv reflect.Value) (string, error) {
+	var s string
+	switch rv.Kind() {
+	case reflect.Float32, reflect.Float64:
+		s = strconv.FormatFloat(rv.Float(), 'f', 2, 64)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		s = strconv.FormatUint(rv.Uint(), 10)
+	default:
+		s = strconv.FormatInt(rv.Int(), 10)
+	}
+
+	intPart, fracPart := s, ""
+	if i := strings.IndexByte(s, '.'); i >= 0 {
+		intPart, fracPart = s[:i], s[i:]
+	}
+	var sign string
+	if strings.HasPrefix(intPart, "-") {
+		sign, intPart = "-", intPart[1:]
+	}
+	for i := len(intPart) - 3; i > 0; i -= 3 {
+		intPart = intPart[:i] + "," + intPart[i:]
+	}
+	return sign + intPart + fracPart, nil
+}
+
+func TestWithNumberFormatter(t *testing.T) {
+	src := LocalePayload{Price: 1234567.5, Quantity: -1000, Tags: []uint{999, 1000}, Name: "1000"}
+	buf, err := urlenc.MarshalWithOptions(src, urlenc.WithNumberFormatter(formatGroupedNumber))
+	if !assert.NoError(t, err, "Marshal succeeds") {
+		return
+	}
+	if !assert.Equal(t, `name=1000&price=1%2C234%2C567.50&qty=-1%2C000&tag=999&tag=1%2C000`, string(buf), "numbers are formatted, strings are not") {
+		return
+	}
+
+	buf, err = urlenc.Marshal(src)
+	if !assert.NoError(t, err, "Marshal succeeds") {
+		return
+	}
+	if !assert.Equal(t, `name=1000&price=1234567.5&qty=-1000&tag=999&tag=1000`, string(buf), "default formatting is unchanged") {
+		return
+	}
+
+	failing := func(reflect.Value) (string, error) {
+		return "", errors.New("formatter failed")
+	}
+	if _, err := urlenc.MarshalWithOptions(src, urlenc.WithNumberFormatter(failing)); !assert.Error(t, err, "formatter errors are reported") {
+		return
+	}
+}
+
+type CSVPayload struct {
+	IDs   []int    `urlenc:"ids,csv"`
+	Names []string `urlenc:"names,omitempty,csv"`
+}
+
+func TestCSVField(t *testing.T) {
+	src := CSVPayload{IDs: []int{1, 2, 3}, Names: []string{"foo", "bar"}}
+	buf, err := urlenc.Marshal(src)
+	if !assert.NoError(t, err, "Marshal succeeds") {
+		return
+	}
+	if !assert.Equal(t, `ids=1%2C2%2C3&names=foo%2Cbar`, string(buf), "elements are joined with commas") {
+		return
+	}
+
+	var dst CSVPayload
+	if !assert.NoError(t, urlenc.Unmarshal(buf, &dst), "Unmarshal succeeds") {
+		return
+	}
+	if !assert.Equal(t, src, dst, "round trip matches") {
+		return
+	}
+
+	dst = CSVPayload{}
+	if !assert.NoError(t, urlenc.Unmarshal([]byte(`ids=1,,2,&names=,foo`), &dst), "Unmarshal succeeds") {
+		return
+	}
+	if !assert.Equal(t, CSVPayload{IDs: []int{1, 2}, Names: []string{"foo"}}, dst, "empty elements are dropped") {
+		return
+	}
+
+	for _, empty := range []CSVPayload{{}, {IDs: []int{}, Names: []string{}}} {
+		buf, err = urlenc.Marshal(empty)
+		if !assert.NoError(t, err, "Marshal succeeds") {
+			return
+		}
+		if !assert.Equal(t, ``, string(buf), "empty slices produce no value") {
+			return
+		}
+	}
+
+	buf, err = urlenc.MarshalWithOptions(src, urlenc.WithArrayFormat(urlenc.ArrayFormatIndices))
+	if !assert.NoError(t, err, "Marshal succeeds") {
+		return
+	}
+	if !assert.Equal(t, `ids=1%2C2%2C3&names=foo%2Cbar`, string(buf), "csv takes precedence over the array format") {
+		return
+	}
+}
+
+// PageToken decodes its own keys, and records the query it was given
+type PageToken struct {
+	Token string
+	Query string
+}
+
+func (p PageToken) MarshalURL() ([]byte, error) {
+	return []byte(url.Values{"token": {p.Token}}.Encode()), nil
+}
+
+func (p *PageToken) UnmarshalURL(data []byte) error {
+	q, err := url.ParseQuery(string(data))
+	if err != nil {
+		return err
+	}
+	p.Token = q.Get("token")
+	p.Query = string(data)
+	return nil
+}
+
+type SortOrder struct {
+	Sort string
+}
+
+func (s SortOrder) MarshalURL() ([]byte, error) {
+	return []byte(url.Values{"sort": {s.Sort}}.Encode()), nil
+}
+
+func (s *SortOrder) UnmarshalURL(data []byte) error {
+	q, err := url.ParseQuery(string(data))
+	if err != nil {
+		return err
+	}
+	s.Sort = q.Get("sort")
+	return nil
+}
+
+// TokenPayload is an Unmarshaler itself, as UnmarshalURL is promoted
+// from PageToken
+type TokenPayload struct {
+	PageToken
+	Limit int `urlenc:"limit"`
+}
+
+// ListPayload is not an Unmarshaler, as the UnmarshalURL methods of the
+// embedded structs are ambiguous
+type ListPayload struct {
+	PageToken
+	SortOrder
+	Limit int `urlenc:"limit"`
+}
+
+type CursorPayload struct {
+	Query   string               `urlenc:"q"`
+	Page    PageToken            `urlenc:"page"`
+	Next    *PageToken           `urlenc:"next"`
+	Cursors map[string]PageToken `urlenc:"cursors"`
+}
+
+func TestEmbeddedUnmarshaler(t *testing.T) {
+	t.Run("promoted method", func(t *testing.T) {
+		var dst TokenPayload
+		if !assert.NoError(t, urlenc.Unmarshal([]byte(`limit=10&token=abc`), &dst), "Unmarshal succeeds") {
+			return
+		}
+		if !assert.Equal(t, TokenPayload{PageToken: PageToken{Token: "abc", Query: `limit=10&token=abc`}}, dst, "the whole query is given to the promoted UnmarshalURL") {
+			return
+		}
+	})
+	t.Run("embedded fields", func(t *testing.T) {
+		src := ListPayload{PageToken: PageToken{Token: "abc"}, SortOrder: SortOrder{Sort: "name"}, Limit: 10}
+		buf, err := urlenc.Marshal(src)
+		if !assert.NoError(t, err, "Marshal succeeds") {
+			return
+		}
+		if !assert.Equal(t, `limit=10&sort=name&token=abc`, string(buf), "keys from MarshalURL are given as top-level keys") {
+			return
+		}
+
+		var dst ListPayload
+		if !assert.NoError(t, urlenc.UnmarshalWithOptions(buf, &dst, urlenc.WithDisallowUnknownKeys()), "Unmarshal succeeds") {
+			return
+		}
+		if !assert.Equal(t, `limit=10&sort=name&token=abc`, dst.Query, "embedded fields are given the whole query") {
+			return
+		}
+		dst.Query = ""
+		if !assert.Equal(t, src, dst, "round trip matches") {
+			return
+		}
+	})
+	t.Run("nested fields", func(t *testing.T) {
+		src := CursorPayload{
+			Query:   "foo",
+			Page:    PageToken{Token: "abc"},
+			Next:    &PageToken{Token: "def"},
+			Cursors: map[string]PageToken{"a": {Token: "ghi"}},
+		}
+		buf, err := urlenc.Marshal(src)
+		if !assert.NoError(t, err, "Marshal succeeds") {
+			return
+		}
+		if !assert.Equal(t, `cursors%5Ba%5D%5Btoken%5D=ghi&next.token=def&page.token=abc&q=foo`, string(buf), "result matches") {
+			return
+		}
+
+		var dst CursorPayload
+		if !assert.NoError(t, urlenc.UnmarshalWithOptions(buf, &dst, urlenc.WithDisallowUnknownKeys()), "Unmarshal succeeds") {
+			return
+		}
+		if !assert.Equal(t, `token=abc`, dst.Page.Query, "nested fields are given the keys under their own key") {
+			return
+		}
+		if !assert.Equal(t, "def", dst.Next.Token, "pointers are allocated") {
+			return
+		}
+		if !assert.Equal(t, "ghi", dst.Cursors["a"].Token, "map values decode themselves") {
+			return
+		}
+	})
+}
+
+type ScheduledPayload struct {
+	Dates []time.Time `urlenc:"dates,layout:2006-01-02"`
+	Slots []time.Time `urlenc:"slots,omitempty,split=|,layouts=15:04|Kitchen"`
+}
+
+type BadLayoutPayload struct {
+	Dates []time.Time `urlenc:"dates,layout:date"`
+}
+
+func TestTimeSliceLayouts(t *testing.T) {
+	src := ScheduledPayload{
+		Dates: []time.Time{
+			time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC),
+			time.Date(2020, 3, 4, 0, 0, 0, 0, time.UTC),
+		},
+		Slots: []time.Time{
+			time.Date(0, 1, 1, 9, 30, 0, 0, time.UTC),
+			time.Date(0, 1, 1, 14, 0, 0, 0, time.UTC),
+		},
+	}
+	buf, err := urlenc.Marshal(src)
+	if !assert.NoError(t, err, "Marshal succeeds") {
+		return
+	}
+	if !assert.Equal(t, `dates=2020-01-02&dates=2020-03-04&slots=09%3A30%7C14%3A00`, string(buf), "each element is formatted using the first layout") {
+		return
+	}
+
+	var dst ScheduledPayload
+	if !assert.NoError(t, urlenc.Unmarshal(buf, &dst), "Unmarshal succeeds") {
+		return
+	}
+	if !assert.Equal(t, src, dst, "round trip matches") {
+		return
+	}
+
+	if !assert.NoError(t, urlenc.Unmarshal([]byte(`dates=2020-01-02&slots=2:00PM`), &dst), "Unmarshal succeeds") {
+		return
+	}
+	if !assert.Equal(t, 14, dst.Slots[0].Hour(), "all layouts are tried") {
+		return
+	}
+
+	err = urlenc.Unmarshal([]byte(`dates=2020-01-02&dates=foo`), &dst)
+	if !assert.Error(t, err, "invalid elements are reported") {
+		return
+	}
+	if !assert.Contains(t, err.Error(), "failed to decode field Dates (key dates): element 1:", "error names the element") {
+		return
+	}
+
+	_, err = urlenc.Marshal(BadLayoutPayload{Dates: src.Dates})
+	if !assert.Error(t, err, "invalid layouts are reported") {
+		return
+	}
+	if !assert.Equal(t, `urlenc.Marshal: urlenc: invalid layouts for struct field Dates: layout "date" does not contain any elements of the reference time`, err.Error(), "the layout is reported once, regardless of the number of elements") {
+		return
+	}
+}
+
+func TestWithDisallowUnknownFields(t *testing.T) {
+	var s StrictPayload
+	err := urlenc.UnmarshalWithOptions([]byte(`name=foo&count=1&utm_source=x&debug=1`), &s, urlenc.WithDisallowUnknownFields())
+	if !assert.True(t, errors.Is(err, urlenc.ErrUnknownKeys), "unknown keys are reported") {
+		return
+	}
+	if !assert.Equal(t, `urlenc.Unmarshal: unknown keys: debug, utm_source`, err.Error(), "error names the keys") {
+		return
+	}
+}
+
+func TestBindValues(t *testing.T) {
+	u, err := url.Parse(`https://example.com/search?name=foo&count=2&enabled=true`)
+	if !assert.NoError(t, err, "url.Parse succeeds") {
+		return
+	}
+
+	var s StrictPayload
+	if !assert.NoError(t, urlenc.BindValues(u.Query(), &s), "BindValues succeeds") {
+		return
+	}
+	if !assert.Equal(t, StrictPayload{Name: "foo", Count: 2, Enabled: true}, s, "BindValues produces the expected result") {
+		return
+	}
+
+	uv, err := urlenc.ExtractValues(s)
+	if !assert.NoError(t, err, "ExtractValues succeeds") {
+		return
+	}
+	if !assert.Equal(t, u.Query(), uv, "ExtractValues produces the original values") {
+		return
+	}
+
+	if !assert.True(t, errors.Is(urlenc.BindValues(u.Query(), s), urlenc.ErrNotPointer), "BindValues requires a pointer") {
+		return
+	}
+}
+
+func TestFieldError(t *testing.T) {
+	var s StrictPayload
+	err := urlenc.Unmarshal([]byte(`name=foo&count=abc`), &s)
+
+	var fe *urlenc.FieldError
+	if !assert.True(t, errors.As(err, &fe), "error is a *FieldError") {
+		return
+	}
+	if !assert.Equal(t, "Count", fe.Field, "Field is the name of the struct field") {
+		return
+	}
+	if !assert.Equal(t, "count", fe.Key, "Key is the query key") {
+		return
+	}
+	if !assert.True(t, errors.Is(err, strconv.ErrSyntax), "the underlying error is unwrapped") {
+		return
+	}
+	if !assert.Equal(t, `urlenc.Unmarshal: failed to decode field Count (key count): strconv.ParseInt: parsing "abc": invalid syntax`, err.Error(), "message is readable") {
+		return
+	}
+
+	err = urlenc.Unmarshal([]byte(`ids=1&ids=x`), &struct {
+		IDs []int `urlenc:"ids"`
+	}{})
+	if !assert.True(t, errors.As(err, &fe), "slice element errors are *FieldError") {
+		return
+	}
+	if !assert.Equal(t, "ids", fe.Key, "Key is the query key") {
+		return
+	}
+}
+
+func TestWithCollectErrors(t *testing.T) {
+	var s StrictPayload
+	err := urlenc.UnmarshalWithOptions([]byte(`name=foo&count=abc&enabled=maybe&ratio=x`), &s, urlenc.WithCollectErrors())
+
+	var me urlenc.MultiError
+	if !assert.True(t, errors.As(err, &me), "error is a MultiError") {
+		return
+	}
+	if !assert.Len(t, me.Errors(), 3, "every failing field is reported") {
+		return
+	}
+
+	var fields []string
+	for _, err := range me.Errors() {
+		var fe *urlenc.FieldError
+		if !assert.True(t, errors.As(err, &fe), "each error is a *FieldError") {
+			return
+		}
+		fields = append(fields, fe.Field)
+	}
+	if !assert.Equal(t, []string{"Count", "Enabled", "Ratio"}, fields, "errors are in field order") {
+		return
+	}
+	if !assert.Equal(t, "foo", s.Name, "valid fields are still decoded") {
+		return
+	}
+
+	err = urlenc.UnmarshalWithOptions([]byte(`count=abc`), &s, urlenc.WithCollectErrors())
+	if !assert.True(t, errors.As(err, &me), "a single error is also a MultiError") {
+		return
+	}
+	if !assert.Len(t, me.Errors(), 1, "the error is reported") {
+		return
+	}
+
+	if !assert.NoError(t, urlenc.UnmarshalWithOptions([]byte(`count=1`), &s, urlenc.WithCollectErrors()), "no error without failures") {
+		return
+	}
+}
+
+type PlusKeyPayload struct {
+	Query string `urlenc:"c++"`
+	Name  string `urlenc:"name"`
+}
+
+func TestPlusInKey(t *testing.T) {
+	src := PlusKeyPayload{Query: "a+b c", Name: "foo"}
+	buf, err := urlenc.Marshal(src)
+	if !assert.NoError(t, err, "Marshal succeeds") {
+		return
+	}
+	if !assert.Equal(t, `c%2B%2B=a%2Bb+c&name=foo`, string(buf), "'+' in keys is percent-encoded") {
+		return
+	}
+
+	testcases := []struct {
+		Name  string
+		Query string
+	}{
+		{Name: "percent-encoded", Query: string(buf)},
+		{Name: "not encoded", Query: `c++=a%2Bb+c&name=foo`},
+	}
+	for _, tc := range testcases {
+		tc := tc
+		t.Run(tc.Name, func(t *testing.T) {
+			var dst PlusKeyPayload
+			if !assert.NoError(t, urlenc.UnmarshalWithOptions([]byte(tc.Query), &dst, urlenc.WithDisallowUnknownKeys()), "Unmarshal succeeds") {
+				return
+			}
+			if !assert.Equal(t, src, dst, "key with '+' is matched") {
+				return
+			}
+		})
+	}
+}
+
+func TestWithErrorOnEmptyOutput(t *testing.T) {
+	buf, err := urlenc.Marshal(DatedPayload{})
+	if !assert.NoError(t, err, "Marshal succeeds by default") {
+		return
+	}
+	if !assert.Equal(t, ``, string(buf), "empty query is returned by default") {
+		return
+	}
+
+	_, err = urlenc.MarshalWithOptions(DatedPayload{}, urlenc.WithErrorOnEmptyOutput())
+	if !assert.True(t, errors.Is(err, urlenc.ErrEmptyOutput), "error should be ErrEmptyOutput") {
+		return
+	}
+	_, err = urlenc.MarshalValues(map[string]string{}, urlenc.WithErrorOnEmptyOutput())
+	if !assert.True(t, errors.Is(err, urlenc.ErrEmptyOutput), "empty maps are reported too") {
+		return
+	}
+
+	d := DatedPayload{Created: time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC)}
+	_, err = urlenc.MarshalDiff(d, d, urlenc.WithErrorOnEmptyOutput())
+	if !assert.True(t, errors.Is(err, urlenc.ErrEmptyOutput), "MarshalDiff of equal values is reported") {
+		return
+	}
+	_, err = urlenc.MarshalBatch(BatchIDs{}, 2, urlenc.WithErrorOnEmptyOutput())
+	if !assert.True(t, errors.Is(err, urlenc.ErrEmptyOutput), "MarshalBatch of an empty struct is reported") {
+		return
+	}
+	_, err = urlenc.MarshalAppend([]byte("x=1&"), DatedPayload{}, urlenc.WithErrorOnEmptyOutput())
+	if !assert.True(t, errors.Is(err, urlenc.ErrEmptyOutput), "MarshalAppend only looks at the appended part") {
+		return
+	}
+
+	buf, err = urlenc.MarshalWithOptions(DatedPayload{Created: time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC)}, urlenc.WithErrorOnEmptyOutput())
+	if !assert.NoError(t, err, "Marshal with values succeeds") {
+		return
+	}
+	if !assert.Equal(t, `created=2020-01-02`, string(buf), "result matches") {
+		return
+	}
+}
+
+// Money can not be given methods, as far as this test is concerned
+type Money struct {
+	Currency string
+	Cents    int64
+}
+
+type InvoicePayload struct {
+	Total Money   `urlenc:"total"`
+	Items []Money `urlenc:"items,omitempty"`
+}
+
+func TestRegisterConverter(t *testing.T) {
+	err := urlenc.RegisterConverter(Money{},
+		func(v interface{}) (string, error) {
+			m := v.(Money)
+			return m.Currency + ":" + strconv.FormatInt(m.Cents, 10), nil
+		},
+		func(s string) (interface{}, error) {
+			i := strings.IndexByte(s, ':')
+			if i < 0 {
+				return nil, errors.New("missing currency")
+			}
+			cents, err := strconv.ParseInt(s[i+1:], 10, 64)
+			if err != nil {
+				return nil, err
+			}
+			return Money{Currency: s[:i], Cents: cents}, nil
+		},
+	)
+	if !assert.NoError(t, err, "RegisterConverter succeeds") {
+		return
+	}
+
+	src := InvoicePayload{
+		Total: Money{Currency: "USD", Cents: 1500},
+		Items: []Money{{Currency: "USD", Cents: 1000}, {Currency: "USD", Cents: 500}},
+	}
+	buf, err := urlenc.Marshal(src)
+	if !assert.NoError(t, err, "Marshal succeeds") {
+		return
+	}
+	if !assert.Equal(t, `items=USD%3A1000&items=USD%3A500&total=USD%3A1500`, string(buf), "the converter is used") {
+		return
+	}
+
+	var dst InvoicePayload
+	if !assert.NoError(t, urlenc.Unmarshal(buf, &dst), "Unmarshal succeeds") {
+		return
+	}
+	if !assert.Equal(t, src, dst, "round trip matches") {
+		return
+	}
+
+	err = urlenc.Unmarshal([]byte(`total=1500`), &dst)
+	if !assert.Error(t, err, "decode errors are reported") {
+		return
+	}
+	if !assert.Contains(t, err.Error(), "missing currency", "error is from the converter") {
+		return
+	}
+
+	if !assert.Error(t, urlenc.RegisterConverter(Money{}, nil, nil), "RegisterConverter without functions fails") {
+		return
+	}
+	if !assert.True(t, errors.Is(urlenc.RegisterConverter(nil, nil, nil), urlenc.ErrNilValue), "RegisterConverter with nil sample fails") {
+		return
+	}
+}
+
+// ConcurrentPayload is only used by TestConcurrentFirstUse, so that its
+// fields are not cached before the test starts
+type ConcurrentPayload struct {
+	Name  string   `urlenc:"name"`
+	Count int      `urlenc:"count"`
+	Tags  []string `urlenc:"tags"`
+}
+
+func TestConcurrentFirstUse(t *testing.T) {
+	const n = 64
+	src := ConcurrentPayload{Name: "foo", Count: 1, Tags: []string{"a", "b"}}
+
+	var wg sync.WaitGroup
+	results := make(chan string, n)
+	start := make(chan struct{})
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			buf, err := urlenc.Marshal(src)
+			if err != nil {
+				results <- err.Error()
+				return
+			}
+			results <- string(buf)
+		}()
+	}
+	close(start)
+	wg.Wait()
+	close(results)
+
+	for result := range results {
+		if !assert.Equal(t, `count=1&name=foo&tags=a&tags=b`, result, "Marshal succeeds from all goroutines") {
+			return
+		}
+	}
+}
+
+// FormPayload only has plain string fields, as is common for form binding
+type FormPayload struct {
+	First   string   `urlenc:"first"`
+	Last    string   `urlenc:"last"`
+	Email   string   `urlenc:"email"`
+	Phone   string   `urlenc:"phone,omitempty"`
+	Company string   `urlenc:"company"`
+	Title   string   `urlenc:"title"`
+	City    string   `urlenc:"city"`
+	Country string   `urlenc:"country"`
+	Tags    []string `urlenc:"tags"`
+	Notes   []string `urlenc:"notes,omitempty"`
+}
+
+// FormText is a defined type, so FormTextPayload goes through the generic
+// conversions even though it produces the same output as FormPayload
+type FormText string
+
+type FormTextPayload struct {
+	First   FormText   `urlenc:"first"`
+	Last    FormText   `urlenc:"last"`
+	Email   FormText   `urlenc:"email"`
+	Phone   FormText   `urlenc:"phone,omitempty"`
+	Company FormText   `urlenc:"company"`
+	Title   FormText   `urlenc:"title"`
+	City    FormText   `urlenc:"city"`
+	Country FormText   `urlenc:"country"`
+	Tags    []FormText `urlenc:"tags"`
+	Notes   []FormText `urlenc:"notes,omitempty"`
+}
+
+var formSource = FormPayload{
+	First:   "John",
+	Last:    "Doe",
+	Email:   "john@example.com",
+	Company: "Example & Co.",
+	Title:   "",
+	City:    "Tokyo",
+	Country: "JP",
+	Tags:    []string{"a", "b", "c"},
+}
+
+func BenchmarkPlainStrings(b *testing.B) {
+	buf, err := urlenc.Marshal(formSource)
+	if err != nil {
+		b.Fatal(err)
+	}
+	var named FormTextPayload
+	if err := urlenc.Unmarshal(buf, &named); err != nil {
+		b.Fatal(err)
+	}
+
+	b.Run("Marshal/plain", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := urlenc.Marshal(formSource); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("Marshal/generic", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := urlenc.Marshal(named); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("Unmarshal/plain", func(b *testing.B) {
+		b.ReportAllocs()
+		var s FormPayload
+		for i := 0; i < b.N; i++ {
+			if err := urlenc.Unmarshal(buf, &s); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("Unmarshal/generic", func(b *testing.B) {
+		b.ReportAllocs()
+		var s FormTextPayload
+		for i := 0; i < b.N; i++ {
+			if err := urlenc.Unmarshal(buf, &s); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func (p FormTextPayload) plain() FormPayload {
+	texts := func(list []FormText) []string {
+		if list == nil {
+			return nil
+		}
+		out := make([]string, len(list))
+		for i, v := range list {
+			out[i] = string(v)
+		}
+		return out
+	}
+	return FormPayload{
+		First:   string(p.First),
+		Last:    string(p.Last),
+		Email:   string(p.Email),
+		Phone:   string(p.Phone),
+		Company: string(p.Company),
+		Title:   string(p.Title),
+		City:    string(p.City),
+		Country: string(p.Country),
+		Tags:    texts(p.Tags),
+		Notes:   texts(p.Notes),
+	}
+}
+
+// TestPlainStrings checks that plain string fields produce the same
+// results as the generic conversions, which are used for FormText
+func TestPlainStrings(t *testing.T) {
+	var named FormTextPayload
+	buf, err := urlenc.Marshal(formSource)
+	if !assert.NoError(t, err, "Marshal succeeds") {
+		return
+	}
+	if !assert.NoError(t, urlenc.Unmarshal(buf, &named), "Unmarshal succeeds") {
+		return
+	}
+
+	t.Run("Marshal", func(t *testing.T) {
+		testcases := []struct {
+			Name    string
+			Options []urlenc.Option
+		}{
+			{Name: "default"},
+			{Name: "ValueCaseUpper", Options: []urlenc.Option{urlenc.WithValueCaseMode(urlenc.ValueCaseUpper)}},
+			{Name: "ArrayFormatBrackets", Options: []urlenc.Option{urlenc.WithArrayFormat(urlenc.ArrayFormatBrackets)}},
+			{Name: "ArrayFormatIndices", Options: []urlenc.Option{urlenc.WithArrayFormat(urlenc.ArrayFormatIndices)}},
+			{Name: "ArrayFormatComma", Options: []urlenc.Option{urlenc.WithArrayFormat(urlenc.ArrayFormatComma)}},
+			{Name: "WithKeyOrder", Options: []urlenc.Option{urlenc.WithKeyOrder([]string{"tags", "email"})}},
+			{Name: "WithSortValues", Options: []urlenc.Option{urlenc.WithSortValues()}},
+		}
+		for _, tc := range testcases {
+			tc := tc
+			t.Run(tc.Name, func(t *testing.T) {
+				expected, err := urlenc.MarshalWithOptions(named, tc.Options...)
+				if !assert.NoError(t, err, "Marshal of generic fields succeeds") {
+					return
+				}
+				got, err := urlenc.MarshalWithOptions(formSource, tc.Options...)
+				if !assert.NoError(t, err, "Marshal of plain fields succeeds") {
+					return
+				}
+				if !assert.Equal(t, string(expected), string(got), "results match") {
+					return
+				}
+			})
+		}
+	})
+
+	t.Run("Unmarshal", func(t *testing.T) {
+		testcases := []struct {
+			Name    string
+			Query   string
+			Options []urlenc.Option
+		}{
+			{Name: "default", Query: string(buf)},
+			{Name: "multiple values", Query: `first=a&first=b&tags=x&tags=y`},
+			{Name: "brackets and indices", Query: `tags[]=a&tags[1]=c&tags[0]=b&notes=x`},
+			{Name: "index gaps", Query: `tags[0]=a&tags[2]=c`, Options: []urlenc.Option{urlenc.WithIndexGapPolicy(urlenc.IndexGapFill)}},
+			{Name: "ArrayFormatComma", Query: `tags=a,b&first=a,b`, Options: []urlenc.Option{urlenc.WithArrayFormat(urlenc.ArrayFormatComma)}},
+			{Name: "plus in key", Query: `first=a+b&last=%2B`},
+			{Name: "WithRequireAllFields", Query: `first=a`, Options: []urlenc.Option{urlenc.WithRequireAllFields(), urlenc.WithCollectErrors()}},
+			{Name: "WithDisallowUnknownKeys", Query: `first=a&bogus=1`, Options: []urlenc.Option{urlenc.WithDisallowUnknownKeys()}},
+		}
+		for _, tc := range testcases {
+			tc := tc
+			t.Run(tc.Name, func(t *testing.T) {
+				var expected FormTextPayload
+				expectedErr := urlenc.UnmarshalWithOptions([]byte(tc.Query), &expected, tc.Options...)
+				var got FormPayload
+				gotErr := urlenc.UnmarshalWithOptions([]byte(tc.Query), &got, tc.Options...)
+				if expectedErr != nil {
+					if !assert.Error(t, gotErr, "Unmarshal of plain fields fails as well") {
+						return
+					}
+					if !assert.Equal(t, expectedErr.Error(), gotErr.Error(), "errors match") {
+						return
+					}
+				} else if !assert.NoError(t, gotErr, "Unmarshal of plain fields succeeds") {
+					return
+				}
+				if !assert.Equal(t, expected.plain(), got, "results match") {
+					return
+				}
+			})
+		}
+	})
+
+	t.Run("WithReuseSlices", func(t *testing.T) {
+		tags := make([]string, 1, 4)
+		s := FormPayload{Tags: tags}
+		if !assert.NoError(t, urlenc.UnmarshalWithOptions([]byte(`tags=a&tags=b`), &s, urlenc.WithReuseSlices()), "Unmarshal succeeds") {
+			return
+		}
+		if !assert.Equal(t, []string{"a", "b"}, s.Tags, "result matches") {
+			return
+		}
+		if !assert.Equal(t, "a", tags[:2][0], "backing array is reused") {
+			return
+		}
+	})
+}